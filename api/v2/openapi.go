@@ -0,0 +1,8 @@
+package api
+
+import _ "embed"
+
+// OpenAPI is the OpenAPI v2 document of the REST/JSON gateway of the API, generated by buf generate.
+//
+//go:embed shorty.swagger.json
+var OpenAPI []byte
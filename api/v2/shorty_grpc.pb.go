@@ -0,0 +1,495 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/v2/shorty.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ShortenerService_ShortRequest_FullMethodName      = "/api.v2.ShortenerService/ShortRequest"
+	ShortenerService_ShortID_FullMethodName           = "/api.v2.ShortenerService/ShortID"
+	ShortenerService_ShortRequestBatch_FullMethodName = "/api.v2.ShortenerService/ShortRequestBatch"
+	ShortenerService_ShortenStream_FullMethodName     = "/api.v2.ShortenerService/ShortenStream"
+	ShortenerService_ShortenUpload_FullMethodName     = "/api.v2.ShortenerService/ShortenUpload"
+	ShortenerService_GetStats_FullMethodName          = "/api.v2.ShortenerService/GetStats"
+	ShortenerService_GetURLStats_FullMethodName       = "/api.v2.ShortenerService/GetURLStats"
+	ShortenerService_GetUserURLs_FullMethodName       = "/api.v2.ShortenerService/GetUserURLs"
+	ShortenerService_DeleteUserURLs_FullMethodName    = "/api.v2.ShortenerService/DeleteUserURLs"
+)
+
+// ShortenerServiceClient is the client API for ShortenerService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ShortenerServiceClient interface {
+	// Create a new shortened URL
+	ShortRequest(ctx context.Context, in *ShortRequestRequest, opts ...grpc.CallOption) (*ShortRequestResponse, error)
+	// Get the real URL for a shortened URL
+	ShortID(ctx context.Context, in *ShortIDRequest, opts ...grpc.CallOption) (*ShortIDResponse, error)
+	// Creates a batch of URLs and returns their shortened versions
+	ShortRequestBatch(ctx context.Context, in *ShortRequestBatchRequest, opts ...grpc.CallOption) (*ShortRequestBatchResponse, error)
+	// Creates short URLs of the streamed items and streams their results back as they are saved.
+	// The items are saved in batches, the result of an item failure carries its code and message.
+	ShortenStream(ctx context.Context, opts ...grpc.CallOption) (ShortenerService_ShortenStreamClient, error)
+	// Creates short URLs of the streamed items and returns the number of saved and failed items
+	// when the client closes the stream.
+	ShortenUpload(ctx context.Context, opts ...grpc.CallOption) (ShortenerService_ShortenUploadClient, error)
+	// Get statistics
+	GetStats(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetStatsResponse, error)
+	// Get click statistics of a user's shortened URL
+	GetURLStats(ctx context.Context, in *GetURLStatsRequest, opts ...grpc.CallOption) (*GetURLStatsResponse, error)
+	// Get all shortened URLs of the user
+	GetUserURLs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetUserURLsResponse, error)
+	// Delete shortened URLs of the user, the deletion is asynchronous
+	DeleteUserURLs(ctx context.Context, in *DeleteUserURLsRequest, opts ...grpc.CallOption) (*DeleteUserURLsResponse, error)
+}
+
+type shortenerServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewShortenerServiceClient(cc grpc.ClientConnInterface) ShortenerServiceClient {
+	return &shortenerServiceClient{cc}
+}
+
+func (c *shortenerServiceClient) ShortRequest(ctx context.Context, in *ShortRequestRequest, opts ...grpc.CallOption) (*ShortRequestResponse, error) {
+	out := new(ShortRequestResponse)
+	err := c.cc.Invoke(ctx, ShortenerService_ShortRequest_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerServiceClient) ShortID(ctx context.Context, in *ShortIDRequest, opts ...grpc.CallOption) (*ShortIDResponse, error) {
+	out := new(ShortIDResponse)
+	err := c.cc.Invoke(ctx, ShortenerService_ShortID_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerServiceClient) ShortRequestBatch(ctx context.Context, in *ShortRequestBatchRequest, opts ...grpc.CallOption) (*ShortRequestBatchResponse, error) {
+	out := new(ShortRequestBatchResponse)
+	err := c.cc.Invoke(ctx, ShortenerService_ShortRequestBatch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerServiceClient) ShortenStream(ctx context.Context, opts ...grpc.CallOption) (ShortenerService_ShortenStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ShortenerService_ServiceDesc.Streams[0], ShortenerService_ShortenStream_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &shortenerServiceShortenStreamClient{stream}
+	return x, nil
+}
+
+type ShortenerService_ShortenStreamClient interface {
+	Send(*ShortenStreamRequest) error
+	Recv() (*ShortenStreamResponse, error)
+	grpc.ClientStream
+}
+
+type shortenerServiceShortenStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *shortenerServiceShortenStreamClient) Send(m *ShortenStreamRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *shortenerServiceShortenStreamClient) Recv() (*ShortenStreamResponse, error) {
+	m := new(ShortenStreamResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *shortenerServiceClient) ShortenUpload(ctx context.Context, opts ...grpc.CallOption) (ShortenerService_ShortenUploadClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ShortenerService_ServiceDesc.Streams[1], ShortenerService_ShortenUpload_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &shortenerServiceShortenUploadClient{stream}
+	return x, nil
+}
+
+type ShortenerService_ShortenUploadClient interface {
+	Send(*ShortenUploadRequest) error
+	CloseAndRecv() (*ShortenUploadResponse, error)
+	grpc.ClientStream
+}
+
+type shortenerServiceShortenUploadClient struct {
+	grpc.ClientStream
+}
+
+func (x *shortenerServiceShortenUploadClient) Send(m *ShortenUploadRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *shortenerServiceShortenUploadClient) CloseAndRecv() (*ShortenUploadResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ShortenUploadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *shortenerServiceClient) GetStats(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetStatsResponse, error) {
+	out := new(GetStatsResponse)
+	err := c.cc.Invoke(ctx, ShortenerService_GetStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerServiceClient) GetURLStats(ctx context.Context, in *GetURLStatsRequest, opts ...grpc.CallOption) (*GetURLStatsResponse, error) {
+	out := new(GetURLStatsResponse)
+	err := c.cc.Invoke(ctx, ShortenerService_GetURLStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerServiceClient) GetUserURLs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*GetUserURLsResponse, error) {
+	out := new(GetUserURLsResponse)
+	err := c.cc.Invoke(ctx, ShortenerService_GetUserURLs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shortenerServiceClient) DeleteUserURLs(ctx context.Context, in *DeleteUserURLsRequest, opts ...grpc.CallOption) (*DeleteUserURLsResponse, error) {
+	out := new(DeleteUserURLsResponse)
+	err := c.cc.Invoke(ctx, ShortenerService_DeleteUserURLs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ShortenerServiceServer is the server API for ShortenerService service.
+// All implementations must embed UnimplementedShortenerServiceServer
+// for forward compatibility
+type ShortenerServiceServer interface {
+	// Create a new shortened URL
+	ShortRequest(context.Context, *ShortRequestRequest) (*ShortRequestResponse, error)
+	// Get the real URL for a shortened URL
+	ShortID(context.Context, *ShortIDRequest) (*ShortIDResponse, error)
+	// Creates a batch of URLs and returns their shortened versions
+	ShortRequestBatch(context.Context, *ShortRequestBatchRequest) (*ShortRequestBatchResponse, error)
+	// Creates short URLs of the streamed items and streams their results back as they are saved.
+	// The items are saved in batches, the result of an item failure carries its code and message.
+	ShortenStream(ShortenerService_ShortenStreamServer) error
+	// Creates short URLs of the streamed items and returns the number of saved and failed items
+	// when the client closes the stream.
+	ShortenUpload(ShortenerService_ShortenUploadServer) error
+	// Get statistics
+	GetStats(context.Context, *emptypb.Empty) (*GetStatsResponse, error)
+	// Get click statistics of a user's shortened URL
+	GetURLStats(context.Context, *GetURLStatsRequest) (*GetURLStatsResponse, error)
+	// Get all shortened URLs of the user
+	GetUserURLs(context.Context, *emptypb.Empty) (*GetUserURLsResponse, error)
+	// Delete shortened URLs of the user, the deletion is asynchronous
+	DeleteUserURLs(context.Context, *DeleteUserURLsRequest) (*DeleteUserURLsResponse, error)
+	mustEmbedUnimplementedShortenerServiceServer()
+}
+
+// UnimplementedShortenerServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedShortenerServiceServer struct {
+}
+
+func (UnimplementedShortenerServiceServer) ShortRequest(context.Context, *ShortRequestRequest) (*ShortRequestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ShortRequest not implemented")
+}
+func (UnimplementedShortenerServiceServer) ShortID(context.Context, *ShortIDRequest) (*ShortIDResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ShortID not implemented")
+}
+func (UnimplementedShortenerServiceServer) ShortRequestBatch(context.Context, *ShortRequestBatchRequest) (*ShortRequestBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ShortRequestBatch not implemented")
+}
+func (UnimplementedShortenerServiceServer) ShortenStream(ShortenerService_ShortenStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ShortenStream not implemented")
+}
+func (UnimplementedShortenerServiceServer) ShortenUpload(ShortenerService_ShortenUploadServer) error {
+	return status.Errorf(codes.Unimplemented, "method ShortenUpload not implemented")
+}
+func (UnimplementedShortenerServiceServer) GetStats(context.Context, *emptypb.Empty) (*GetStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedShortenerServiceServer) GetURLStats(context.Context, *GetURLStatsRequest) (*GetURLStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetURLStats not implemented")
+}
+func (UnimplementedShortenerServiceServer) GetUserURLs(context.Context, *emptypb.Empty) (*GetUserURLsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserURLs not implemented")
+}
+func (UnimplementedShortenerServiceServer) DeleteUserURLs(context.Context, *DeleteUserURLsRequest) (*DeleteUserURLsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUserURLs not implemented")
+}
+func (UnimplementedShortenerServiceServer) mustEmbedUnimplementedShortenerServiceServer() {}
+
+// UnsafeShortenerServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ShortenerServiceServer will
+// result in compilation errors.
+type UnsafeShortenerServiceServer interface {
+	mustEmbedUnimplementedShortenerServiceServer()
+}
+
+func RegisterShortenerServiceServer(s grpc.ServiceRegistrar, srv ShortenerServiceServer) {
+	s.RegisterService(&ShortenerService_ServiceDesc, srv)
+}
+
+func _ShortenerService_ShortRequest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShortRequestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServiceServer).ShortRequest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShortenerService_ShortRequest_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServiceServer).ShortRequest(ctx, req.(*ShortRequestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShortenerService_ShortID_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShortIDRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServiceServer).ShortID(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShortenerService_ShortID_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServiceServer).ShortID(ctx, req.(*ShortIDRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShortenerService_ShortRequestBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShortRequestBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServiceServer).ShortRequestBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShortenerService_ShortRequestBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServiceServer).ShortRequestBatch(ctx, req.(*ShortRequestBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShortenerService_ShortenStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ShortenerServiceServer).ShortenStream(&shortenerServiceShortenStreamServer{stream})
+}
+
+type ShortenerService_ShortenStreamServer interface {
+	Send(*ShortenStreamResponse) error
+	Recv() (*ShortenStreamRequest, error)
+	grpc.ServerStream
+}
+
+type shortenerServiceShortenStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *shortenerServiceShortenStreamServer) Send(m *ShortenStreamResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *shortenerServiceShortenStreamServer) Recv() (*ShortenStreamRequest, error) {
+	m := new(ShortenStreamRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ShortenerService_ShortenUpload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ShortenerServiceServer).ShortenUpload(&shortenerServiceShortenUploadServer{stream})
+}
+
+type ShortenerService_ShortenUploadServer interface {
+	SendAndClose(*ShortenUploadResponse) error
+	Recv() (*ShortenUploadRequest, error)
+	grpc.ServerStream
+}
+
+type shortenerServiceShortenUploadServer struct {
+	grpc.ServerStream
+}
+
+func (x *shortenerServiceShortenUploadServer) SendAndClose(m *ShortenUploadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *shortenerServiceShortenUploadServer) Recv() (*ShortenUploadRequest, error) {
+	m := new(ShortenUploadRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ShortenerService_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServiceServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShortenerService_GetStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServiceServer).GetStats(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShortenerService_GetURLStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetURLStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServiceServer).GetURLStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShortenerService_GetURLStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServiceServer).GetURLStats(ctx, req.(*GetURLStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShortenerService_GetUserURLs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServiceServer).GetUserURLs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShortenerService_GetUserURLs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServiceServer).GetUserURLs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShortenerService_DeleteUserURLs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUserURLsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShortenerServiceServer).DeleteUserURLs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShortenerService_DeleteUserURLs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShortenerServiceServer).DeleteUserURLs(ctx, req.(*DeleteUserURLsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ShortenerService_ServiceDesc is the grpc.ServiceDesc for ShortenerService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ShortenerService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "api.v2.ShortenerService",
+	HandlerType: (*ShortenerServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ShortRequest",
+			Handler:    _ShortenerService_ShortRequest_Handler,
+		},
+		{
+			MethodName: "ShortID",
+			Handler:    _ShortenerService_ShortID_Handler,
+		},
+		{
+			MethodName: "ShortRequestBatch",
+			Handler:    _ShortenerService_ShortRequestBatch_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _ShortenerService_GetStats_Handler,
+		},
+		{
+			MethodName: "GetURLStats",
+			Handler:    _ShortenerService_GetURLStats_Handler,
+		},
+		{
+			MethodName: "GetUserURLs",
+			Handler:    _ShortenerService_GetUserURLs_Handler,
+		},
+		{
+			MethodName: "DeleteUserURLs",
+			Handler:    _ShortenerService_DeleteUserURLs_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ShortenStream",
+			Handler:       _ShortenerService_ShortenStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ShortenUpload",
+			Handler:       _ShortenerService_ShortenUpload_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "api/v2/shorty.proto",
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
@@ -30,7 +31,8 @@ var (
 
 // main is the entry point of the program.
 //
-// It initializes the configuration, creates a new storage instance, and sets up the logger.
+// It initializes the configuration and runs the command given after the flags if there is one,
+// e.g. migrate. Otherwise it creates a new storage instance, and sets up the logger.
 // Then it creates a new router and sets up middleware for request handling.
 // After that, it mounts the debug routes and sets up the routes for handling different requests.
 // Finally, it starts the HTTP server and listens for incoming requests.
@@ -38,6 +40,9 @@ func main() {
 	logger := logger.Get()
 	logger.Info("starting shorty", zap.String("version", buildVersion), zap.String("date", buildDate), zap.String("commit", buildCommit))
 	conf := config.NewConfig()
+	if args := flag.Args(); len(args) > 0 {
+		os.Exit(runCommand(conf, args))
+	}
 	logger.Info("config:", zap.String("storage type", conf.GetStorageType()))
 	logger.Info("config:", zap.Bool("https", conf.GetEnableHTTPS()))
 	pStorage, err := storage.New(conf)
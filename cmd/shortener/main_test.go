@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/stsg/shorty/internal/app"
@@ -75,6 +77,8 @@ func Test_getShortURL(t *testing.T) {
 		},
 	}
 
+	// the requests come from new users, the conflicts are reported in the global dedup scope
+	t.Setenv("DEDUP_SCOPE", config.DedupGlobal)
 	conf = config.NewConfig()
 	strg, err := storage.New(conf)
 	assert.NoError(t, err, "Error creating storage")
@@ -174,6 +178,8 @@ func Test_getRealURL(t *testing.T) {
 	//conf = config.NewConfig()
 	strg, err := storage.New(conf)
 	assert.NoError(t, err, "Error creating storage")
+	err = strg.Save(context.Background(), 1, "123456", "https://www.google.com", time.Time{})
+	assert.NoError(t, err, "Error saving short URL")
 
 	hndl := app.NewApp(conf, strg)
 
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/stsg/shorty/internal/config"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+// errNoDatabase is returned when the migrate command is run without the database configured.
+var errNoDatabase = errors.New("migrate needs database DSN, set it with -d, DATABASE_DSN or -storage db:dsn")
+
+// runCommand runs the command given after the flags instead of the server.
+//
+// The only command is migrate, it applies the embedded migrations to the configured database:
+//
+//	shortener -d DSN migrate up | down [N] | version | force V
+//
+// Parameters:
+// - conf: the configuration, the database is taken from it.
+// - args: the command and its arguments.
+//
+// Returns the exit code of the program.
+func runCommand(conf config.Config, args []string) int {
+	if args[0] != "migrate" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+	if conf.GetStorageType() != "db" {
+		fmt.Fprintln(os.Stderr, errNoDatabase)
+		return 2
+	}
+
+	err := storage.RunMigrate(context.Background(), conf.GetDBStorage(), args[1:], os.Stdout)
+	if errors.Is(err, storage.ErrMigrateUsage) {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/stsg/shorty/internal/config"
+	mylogger "github.com/stsg/shorty/internal/logger"
+)
+
+// acmeChallengePath is the path the ACME server requests the HTTP-01 challenges at.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// newACMEManager returns the manager that obtains and renews the certificates via ACME.
+//
+// The certificates are obtained on the first TLS handshake for each of the configured domains
+// and renewed before they expire, the account key and the certificates are kept in the cache directory.
+//
+// Parameters:
+// - conf: the ACME configuration.
+//
+// Returns:
+// - *autocert.Manager: the manager, its GetCertificate is used by the HTTPS and gRPC servers.
+// - error: an error if the CA bundle of the ACME server cannot be loaded.
+func newACMEManager(conf *config.ACMEConfig) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: conf.DirectoryURL}
+	if conf.CA != "" {
+		bundle, err := os.ReadFile(conf.CA)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ACME CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("no certificates in ACME CA")
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(conf.CacheDir),
+		HostPolicy: autocert.HostWhitelist(conf.Domains...),
+		Client:     client,
+		Email:      conf.Email,
+	}, nil
+}
+
+// acmeChallengeRouter returns the router of the plain HTTP server the ACME HTTP-01 challenges are served by.
+//
+// The other requests are redirected to HTTPS.
+//
+// Returns an http.Handler.
+func (app *App) acmeChallengeRouter() http.Handler {
+	challenges := app.acme.HTTPHandler(nil)
+
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(middleware.RealIP)
+	router.Use(mylogger.ZapLogger())
+	router.Handle(acmeChallengePath+"*", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// the host policy is checked against the host name only,
+		// the port is sent by the ACME servers validating on a non-standard one, e.g. Pebble
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			r.Host = host
+		}
+		challenges.ServeHTTP(rw, r)
+	}))
+	router.NotFound(challenges.ServeHTTP)
+	router.MethodNotAllowed(challenges.ServeHTTP)
+	return router
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stsg/shorty/internal/config"
+)
+
+func TestACME_HTTPChallenge(t *testing.T) {
+	cacheDir := t.TempDir()
+	manager, err := newACMEManager(&config.ACMEConfig{
+		Domains:      []string{"short.example"},
+		DirectoryURL: "https://acme.invalid/directory",
+		CacheDir:     cacheDir,
+		HTTPAddr:     ":80",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	app := App{acme: manager}
+	router := app.acmeChallengeRouter()
+
+	// the token is looked up in the cache when it is not issued by this instance
+	os.WriteFile(filepath.Join(cacheDir, "token+http-01"), []byte("token.thumbprint"), 0600)
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		code     int
+		response string
+	}{
+		{name: "challenge", host: "short.example", path: acmeChallengePath + "token", code: http.StatusOK, response: "token.thumbprint"},
+		{name: "challenge on a port", host: "short.example:5002", path: acmeChallengePath + "token", code: http.StatusOK, response: "token.thumbprint"},
+		{name: "unknown token", host: "short.example", path: acmeChallengePath + "unknown", code: http.StatusNotFound},
+		{name: "unknown domain", host: "other.example", path: acmeChallengePath + "token", code: http.StatusForbidden},
+		{name: "other path", host: "short.example", path: "/api/user/urls", code: http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, req)
+			if rw.Code != tt.code {
+				t.Errorf("Expected %d, but got %d", tt.code, rw.Code)
+			}
+			if tt.response != "" && rw.Body.String() != tt.response {
+				t.Errorf("Expected %q, but got %q", tt.response, rw.Body.String())
+			}
+		})
+	}
+}
+
+// TestACME_Pebble obtains a certificate from a local ACME test server.
+//
+// It runs if SHORTY_PEBBLE_DIRECTORY is set, e.g. for a Pebble v2.6.0 started with its default configuration:
+//
+//	pebble -config test/config/pebble-config.json
+//	SHORTY_PEBBLE_DIRECTORY=https://localhost:14000/dir SHORTY_PEBBLE_CA=test/certs/pebble.minica.pem go test -run Pebble ./internal/app
+//
+// The certificate is obtained for SHORTY_PEBBLE_DOMAIN, "shorty.localhost" by default, it should resolve
+// to this host for Pebble. The HTTP-01 challenges are served on SHORTY_PEBBLE_HTTP_ADDRESS,
+// ":5002" by default, which is the port Pebble validates them at.
+func TestACME_Pebble(t *testing.T) {
+	directory := os.Getenv("SHORTY_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("SHORTY_PEBBLE_DIRECTORY is not set")
+	}
+	domain := os.Getenv("SHORTY_PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "shorty.localhost"
+	}
+	httpAddr := os.Getenv("SHORTY_PEBBLE_HTTP_ADDRESS")
+	if httpAddr == "" {
+		httpAddr = ":5002"
+	}
+
+	manager, err := newACMEManager(&config.ACMEConfig{
+		Domains:      []string{domain},
+		DirectoryURL: directory,
+		CA:           os.Getenv("SHORTY_PEBBLE_CA"),
+		CacheDir:     t.TempDir(),
+		HTTPAddr:     httpAddr,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	app := App{acme: manager}
+	challengeSrv := &http.Server{Addr: httpAddr, Handler: app.acmeChallengeRouter(), ReadHeaderTimeout: time.Second}
+	go challengeSrv.ListenAndServe()
+	t.Cleanup(func() { challengeSrv.Close() })
+
+	cert, err := app.getCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := leaf.VerifyHostname(domain); err != nil {
+		t.Errorf("Expected a certificate for %s, but got %v", domain, err)
+	}
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// apiKeyPrefix is the prefix of the API keys, it makes a leaked key easy to recognize.
+const apiKeyPrefix = "shorty_"
+
+// apiKeyLength is the number of random bytes in an API key.
+const apiKeyLength = 32
+
+// userIDContextKey is the context key of the user ID resolved from an API key.
+type userIDContextKey struct{}
+
+// GenerateAPIKey returns a new random API key.
+//
+// No parameters.
+// Returns the key and an error if the random source fails.
+func GenerateAPIKey() (string, error) {
+	key := make([]byte, apiKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// HashAPIKey returns the hex-encoded SHA-256 hash of the API key, only the hash is stored.
+//
+// Parameters:
+// - key: the API key.
+//
+// Returns:
+// - string: the hash of the key.
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header value.
+//
+// It returns false if the value is not a bearer authorization.
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// withUserID returns a copy of the context carrying the user ID resolved from an API key.
+func withUserID(ctx context.Context, userID uint64) context.Context {
+	return context.WithValue(ctx, userIDContextKey{}, userID)
+}
+
+// userIDFromContext returns the user ID resolved from an API key by APIKeyAuth or APIKeyInterceptor.
+//
+// It returns false if the request was not authenticated with an API key.
+func userIDFromContext(ctx context.Context) (uint64, bool) {
+	userID, ok := ctx.Value(userIDContextKey{}).(uint64)
+	return userID, ok
+}
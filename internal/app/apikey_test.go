@@ -0,0 +1,82 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/stsg/shorty/internal/config"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+func TestAPIKeys(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	app := App{
+		Config:  config.Config{},
+		storage: mStorage,
+		Session: NewSession(mStorage, [][]byte{oldSessionKey}, time.Hour),
+	}
+	router := chi.NewRouter()
+	router.Use(app.APIKeyAuth())
+	router.Post("/api/user/keys", app.HandleCreateAPIKey)
+	router.Get("/api/user/keys", app.HandleGetAPIKeys)
+	router.Delete("/api/user/keys/{id}", app.HandleRevokeAPIKey)
+
+	// A client without a session gets a new user and a key
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/api/user/keys", strings.NewReader(`{"name":"cron"}`)))
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, but got %d", http.StatusCreated, rw.Code)
+	}
+	var created storage.ResJSONAPIKey
+	_ = json.Unmarshal(rw.Body.Bytes(), &created)
+	if !strings.HasPrefix(created.Key, apiKeyPrefix) || created.Name != "cron" {
+		t.Errorf("Expected a named key, but got %v", created)
+	}
+
+	// The key is accepted as a bearer token and is never shown again
+	req := httptest.NewRequest(http.MethodGet, "/api/user/keys", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected %d, but got %d", http.StatusOK, rw.Code)
+	}
+	var listed []storage.ResJSONAPIKey
+	_ = json.Unmarshal(rw.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].ID != created.ID || listed[0].Key != "" || listed[0].LastUsedAt == nil {
+		t.Errorf("Expected the used key without the key itself, but got %v", listed)
+	}
+
+	for _, authorization := range []string{"Bearer shorty_unknown", "Basic " + created.Key, "Bearer"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/keys", nil)
+		req.Header.Set("Authorization", authorization)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		if rw.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %d for %q, but got %d", http.StatusUnauthorized, authorization, rw.Code)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/user/keys/"+created.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("Expected %d, but got %d", http.StatusNoContent, rw.Code)
+	}
+
+	// The revoked key is rejected
+	req = httptest.NewRequest(http.MethodGet, "/api/user/keys", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Key)
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %d, but got %d", http.StatusUnauthorized, rw.Code)
+	}
+}
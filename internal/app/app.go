@@ -2,26 +2,25 @@
 package app
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"math/big"
-	"net"
 	"net/http"
 	"os"
-	"sync/atomic"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 
+	pb "github.com/stsg/shorty/api/v1"
+	pbv2 "github.com/stsg/shorty/api/v2"
 	"github.com/stsg/shorty/internal/config"
 	"github.com/stsg/shorty/internal/storage"
 
@@ -31,11 +30,11 @@ import (
 	mylogger "github.com/stsg/shorty/internal/logger"
 )
 
-const certSerialMaxInt = 1024
-const grpcListenPort = ":63067"
+const maxClickBatch = 100
 
 var protectedURLs = []string{
 	"/api/internal/stats",
+	"/v2/internal/stats",
 }
 
 // App class definition defines a struct named App with the following fields:
@@ -43,22 +42,25 @@ var protectedURLs = []string{
 // Config of type config.Config
 // storage of type storage.Storage
 // Session of type *Session (pointer to Session)
-// delChan of type chan map[string]uint64 (channel of map[string]uint64)
+// deletions of type *deletionQueue (queued deletions saved to the storage in batches)
+// clickChan of type chan storage.Click (channel of redirects to be saved)
+// certs of type *certReloader (TLS certificate of the HTTPS and gRPC servers, nil without HTTPS or with ACME)
+// acme of type *autocert.Manager (ACME certificates of the HTTPS and gRPC servers, nil if ACME is disabled)
+// queues of type *workQueues (state of deletions and clickChan and their workers, for draining on shutdown)
 //
-// App holds main application
+// App holds main application, it implements the gRPC ShortenerService
+// and is registered with its gRPC server by NewApp.
 type App struct {
+	pb.UnimplementedShortenerServiceServer
 	storage    storage.Storage
 	Session    *Session
-	delChan    chan map[string]uint64
+	deletions  *deletionQueue
+	clickChan  chan storage.Click
 	Config     config.Config
 	GRPCServer *GRPCServer
-}
-
-// Session is a struct that holds user session data.
-type Session struct {
-	storage     storage.Storage
-	userSession map[string]uint64
-	count       *atomic.Uint64
+	certs      *certReloader
+	acme       *autocert.Manager
+	queues     *workQueues
 }
 
 // Run runs the App.
@@ -83,9 +85,16 @@ func (app *App) Run(ctx context.Context) error {
 	router.Use(app.Decompress())
 	router.Use(middleware.Compress(5, "application/json", "text/html"))
 	router.Use(app.TrustedSubnets())
+	router.Use(app.APIKeyAuth())
 
 	router.Mount("/debug", middleware.Profiler())
 
+	gateway, err := app.NewGatewayHandler()
+	if err != nil {
+		return fmt.Errorf("cannot create REST gateway: %w", err)
+	}
+	router.Mount(gatewayPrefix, gateway)
+
 	router.Post("/", app.HandleShortRequest)
 	router.Get("/ping", app.HandlePing)
 	router.Get("/{id}", app.HandleShortID)
@@ -93,41 +102,87 @@ func (app *App) Run(ctx context.Context) error {
 		childRouter.Post("/shorten", app.HandleShortRequestJSON)
 		childRouter.Post("/shorten/batch", app.HandleShortRequestJSONBatch)
 		childRouter.Get("/user/urls", app.HandleGetAllURLs)
+		childRouter.Get("/user/urls/{id}/stats", app.HandleURLStats)
 		childRouter.Delete("/user/urls", app.HandleDeleteURLs)
+		childRouter.Post("/user/keys", app.HandleCreateAPIKey)
+		childRouter.Get("/user/keys", app.HandleGetAPIKeys)
+		childRouter.Delete("/user/keys/{id}", app.HandleRevokeAPIKey)
 		childRouter.Get("/internal/stats", app.HandleInternalStats)
 	})
 
+	var handler http.Handler = router
+	if app.Config.GetSinglePort() && app.Config.GetGRPCAddr() != "" {
+		handler = app.grpcMux(router)
+	}
+
 	srv := &http.Server{
 		Addr:              app.Config.GetRunAddr(),
-		Handler:           router,
+		Handler:           handler,
 		ReadHeaderTimeout: 30 * time.Second,
 		IdleTimeout:       time.Second,
 	}
 
+	var challengeSrv *http.Server
+	if acmeConf := app.Config.GetACME(); acmeConf != nil {
+		app.acme, err = newACMEManager(acmeConf)
+		if err != nil {
+			panic(fmt.Sprintf("cannot create ACME manager: %v", err))
+		}
+		logger.Info("Obtaining certificates via ACME",
+			zap.Strings("domains", acmeConf.Domains),
+			zap.String("directory", acmeConf.DirectoryURL),
+		)
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: app.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		if acmeConf.TLSALPN {
+			srv.TLSConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		}
+		if acmeConf.HTTPAddr != "" {
+			challengeSrv = &http.Server{
+				Addr:              acmeConf.HTTPAddr,
+				Handler:           app.acmeChallengeRouter(),
+				ReadHeaderTimeout: 30 * time.Second,
+			}
+		}
+	} else if app.Config.GetEnableHTTPS() {
+		if app.Config.GetTLSSelfSigned() {
+			logger.Warn("Creating self-signed certificate, it is for development only...", zap.Strings("hosts", app.certificateHosts()))
+			err := createCertificate(app.Config.GetTLSCert(), app.Config.GetTLSKey(), app.certificateHosts())
+			if err != nil {
+				panic(fmt.Sprintf("cannot create certificate: %v", err))
+			}
+			logger.Info("Certificate created.")
+		}
+		app.certs, err = newCertReloader(app.Config.GetTLSCert(), app.Config.GetTLSKey())
+		if err != nil {
+			panic(fmt.Sprintf("cannot load certificate: %v", err))
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: app.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
 	grp, ctx := errgroup.WithContext(ctx)
 
 	logger.Info("Starting http")
-	go func() {
+	grp.Go(func() error {
 		<-ctx.Done()
-		if srv != nil {
-			if err := srv.Close(); err != nil {
-				logger.Error("shutting down http by signal")
-			}
+		logger.Info("Shutting down", zap.Duration("timeout", app.Config.GetShutdownTimeout()))
+		err := app.shutdown(srv, challengeSrv, app.Config.GetShutdownTimeout())
+		if err != nil {
+			logger.Error("cannot close storage", zap.Error(err))
 		}
-		app.GRPCServer.grpcServer.GracefulStop()
-	}()
+		return err
+	})
 
 	grp.Go(func() error {
 		var err error
 
 		if app.Config.GetEnableHTTPS() {
-			logger.Info("Creating certificate...")
-			err := app.createCertificate()
-			if err != nil {
-				panic(fmt.Sprintf("cannot create certificate: %v", err))
-			}
-			logger.Info("Certificate created.")
-			err = srv.ListenAndServeTLS("./data/cert/cert.pem", "./data/cert/key.pem")
+			err := srv.ListenAndServeTLS("", "")
 			if err != nil && !errors.Is(err, http.ErrServerClosed) {
 				panic(fmt.Sprintf("cannot run https server: %v", err))
 			}
@@ -141,126 +196,112 @@ func (app *App) Run(ctx context.Context) error {
 		return err
 	})
 
-	listener, err := net.Listen("tcp", grpcListenPort)
-	if err != nil {
-		panic(fmt.Sprintf("cannot run gRPC server: %v", err))
-	}
-	logger.Info("Starting gRPC", zap.String("port", grpcListenPort))
-
-	grp.Go(func() error {
-		err = app.GRPCServer.grpcServer.Serve(listener)
-
-		return err
-	})
-
-	if err := grp.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		logger.Error("error", zap.Error(err))
-		return err
+	if challengeSrv != nil {
+		logger.Info("Serving ACME HTTP-01 challenges", zap.String("address", challengeSrv.Addr))
+		grp.Go(func() error {
+			err := challengeSrv.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic(fmt.Sprintf("cannot run ACME challenge server: %v", err))
+			}
+			return nil
+		})
 	}
 
-	return nil
-}
-
-// createCertificate generates a certificate and private key, saving them to disk.
-//
-// No parameters.
-// Returns an error.
-func (app *App) createCertificate() error {
-	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(int64(certSerialMaxInt)),
-		Subject: pkix.Name{
-			Organization:       []string{"Localhost Ent."},
-			OrganizationalUnit: []string{"Shorty Server"},
-			CommonName:         "localhost",
-			Country:            []string{"RU"},
-		},
-		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
+	if app.certs != nil {
+		grp.Go(func() error {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			defer signal.Stop(hup)
+			app.certs.watch(ctx, certReloadInterval, hup)
+			return nil
+		})
 	}
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return fmt.Errorf("error generate key %w", err)
+	if app.Config.GetReaperInterval() > 0 {
+		logger.Info("Starting expired URLs reaper", zap.Duration("interval", app.Config.GetReaperInterval()))
+		grp.Go(func() error {
+			app.reapExpiredURLs(ctx, app.Config.GetReaperInterval())
+			return nil
+		})
 	}
 
-	certData, err := x509.CreateCertificate(rand.Reader, cert, cert, &privateKey.PublicKey, privateKey)
-	if err != nil {
-		return fmt.Errorf("error create certificate %w", err)
+	if app.GRPCServer.health != nil {
+		grp.Go(func() error {
+			app.watchHealth(ctx, healthCheckInterval)
+			return nil
+		})
 	}
 
-	var certDataBytes bytes.Buffer
-	err = pem.Encode(&certDataBytes, &pem.Block{Type: "CERTIFICATE", Bytes: certData})
-	if err != nil {
-		return fmt.Errorf("error encode certificate %w", err)
-	}
-	err = os.WriteFile("./data/cert/cert.pem", certDataBytes.Bytes(), 0644)
-	if err != nil {
-		return fmt.Errorf("error write certificate %w", err)
+	if app.Config.GetSinglePort() && app.Config.GetGRPCAddr() != "" {
+		logger.Info("Serving gRPC on http address", zap.String("address", app.Config.GetRunAddr()))
+	} else if app.Config.GetGRPCAddr() != "" {
+		listener, err := app.grpcListener()
+		if err != nil {
+			panic(fmt.Sprintf("cannot run gRPC server: %v", err))
+		}
+		logger.Info("Starting gRPC",
+			zap.String("address", app.Config.GetGRPCAddr()),
+			zap.Bool("tls", app.Config.GetEnableHTTPS()),
+			zap.Bool("mtls", app.Config.GetGRPCClientCA() != ""),
+		)
+
+		grp.Go(func() error {
+			return app.GRPCServer.grpcServer.Serve(listener)
+		})
 	}
 
-	var privateKeyBytes bytes.Buffer
-	err = pem.Encode(&privateKeyBytes, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-	if err != nil {
-		return fmt.Errorf("error encode private key %w", err)
-	}
-	err = os.WriteFile("./data/cert/key.pem", privateKeyBytes.Bytes(), 0644)
-	if err != nil {
-		return fmt.Errorf("error write private key %w", err)
+	if err := grp.Wait(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("error", zap.Error(err))
+		return err
 	}
 
 	return nil
 }
 
-// NewSession creates a new session with the given storage.
-//
-// It retrieves the last ID from the storage and initializes a new atomic ID
-// with that value. It then creates and returns a new Session object with the
-// provided storage, an empty user session map, and the initialized atomic ID.
+// reapExpiredURLs periodically deletes expired URLs from the storage until the context is done.
 //
 // Parameters:
-// - storage: The storage to be used for the session.
-//
-// Returns:
-// - *Session: A pointer to the newly created session.
-func NewSession(storage storage.Storage) *Session {
-	lastID, err := storage.GetLastID()
-	if err != nil {
-		return nil
-	}
+// - ctx: the context that stops the reaper.
+// - interval: the interval between cleanups.
+func (app *App) reapExpiredURLs(ctx context.Context, interval time.Duration) {
+	logger := mylogger.Get()
 
-	newID := atomic.Uint64{}
-	newID.Store(uint64(lastID))
-	return &Session{
-		storage:     storage,
-		userSession: make(map[string]uint64),
-		count:       &newID,
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			count, err := app.storage.DeleteExpired(ctx, now)
+			if err != nil {
+				logger.Error("cannot delete expired URLs", zap.Error(err))
+				continue
+			}
+			if count > 0 {
+				logger.Info("expired URLs deleted", zap.Int("count", count))
+			}
+		}
 	}
 }
 
-// GetUserSessionID returns the user session ID associated with the given session ID.
-//
-// Parameters:
-// - sessionID: The ID of the session.
+// saveClicks saves the queued clicks to the storage until the click channel is closed.
 //
-// Returns:
-// - uint64: The user session ID.
-func (s *Session) GetUserSessionID(sessionID string) uint64 {
-	return s.userSession[sessionID]
-}
+// The clicks that are already queued are saved together in batches of up to maxClickBatch.
+func (app *App) saveClicks() {
+	logger := mylogger.Get()
 
-// AddUserSession adds a new user session to the Session struct.
-//
-// No parameters.
-// Returns a string representing the session and a uint64 representing the count.
-func (s *Session) AddUserSession() (session string, count uint64) {
-	s.count.Add(1)
-	session = uuid.New().String()
-	s.userSession[session] = s.count.Load()
-	return session, s.count.Load()
+	for click := range app.clickChan {
+		clicks := []storage.Click{click}
+		for len(clicks) < maxClickBatch && len(app.clickChan) > 0 {
+			clicks = append(clicks, <-app.clickChan)
+		}
+		err := app.storage.SaveClicks(context.Background(), clicks)
+		if err != nil {
+			logger.Error("cannot save clicks", zap.Int("count", len(clicks)), zap.Error(err))
+		}
+	}
 }
 
 // SetSession sets a session for the Handle.
@@ -268,31 +309,46 @@ func (s *Session) AddUserSession() (session string, count uint64) {
 // It takes the http.ResponseWriter and session string as parameters and does not return anything.
 func (app *App) SetSession(rw http.ResponseWriter, session string) {
 	http.SetCookie(rw, &http.Cookie{
-		Name:    "token",
-		Value:   session,
-		Expires: time.Now().Add(24 * time.Hour),
+		Name:     "token",
+		Value:    session,
+		Expires:  time.Now().Add(app.Session.ttl),
+		HttpOnly: true,
 	})
 }
 
 // NewApp creates a new handle object with the provided configuration and storage.
 // It returns the handle object along with a new session object.
-func NewApp(config config.Config, storage storage.Storage) App {
+//
+// The deletions left in the deletion journal by the previous run are queued again,
+// NewApp panics if the journal cannot be read.
+func NewApp(config config.Config, pStorage storage.Storage) App {
+	deletions, err := newDeletionQueue(pStorage, config.GetDeleteBatchSize(), config.GetDeleteFlushInterval(), config.GetDeleteJournal())
+	if err != nil {
+		panic(err)
+	}
 	app := App{
-		Config:     config,
-		storage:    storage,
-		Session:    NewSession(storage),
-		delChan:    make(chan map[string]uint64, 500),
-		GRPCServer: NewGRPCServer(),
+		Config:    config,
+		storage:   pStorage,
+		Session:   NewSession(pStorage, config.GetSessionKeys(), config.GetSessionTTL()),
+		deletions: deletions,
+		clickChan: make(chan storage.Click, 500),
+		queues:    &workQueues{},
+	}
+	app.GRPCServer = NewGRPCServer(
+		[]grpc.UnaryServerInterceptor{app.APIKeyInterceptor},
+		[]grpc.StreamServerInterceptor{app.APIKeyStreamInterceptor},
+	)
+	pb.RegisterShortenerServiceServer(app.GRPCServer.grpcServer, &app)
+	pbv2.RegisterShortenerServiceServer(app.GRPCServer.grpcServer, &GRPCServerV2{app: &app})
+	if config.GetGRPCHealth() {
+		app.enableHealth()
+	}
+	if config.GetGRPCReflection() {
+		reflection.Register(app.GRPCServer.grpcServer)
 	}
 
-	go func() {
-		for delURL := range app.delChan {
-			err := storage.DeleteURL(delURL)
-			if err != nil {
-				continue
-			}
-		}
-	}()
+	app.startWorker(app.deletions.run)
+	app.startWorker(app.saveClicks)
 
 	return app
 }
@@ -0,0 +1,274 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	mylogger "github.com/stsg/shorty/internal/logger"
+)
+
+// certReloadInterval is the interval the TLS certificate files are checked for changes at.
+const certReloadInterval = 10 * time.Second
+
+// certReloader holds the TLS certificate loaded from the certificate and key files.
+//
+// It is used as tls.Config.GetCertificate by the HTTPS and gRPC servers,
+// so a renewed certificate is served to new connections without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+// newCertReloader loads the certificate and returns the reloader of it.
+//
+// Parameters:
+// - certFile: the PEM certificate chain.
+// - keyFile: the PEM private key of the certificate.
+//
+// Returns:
+// - *certReloader: the reloader.
+// - error: an error if the certificate cannot be loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate returns the loaded certificate for every TLS handshake.
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reload loads the certificate files again.
+//
+// The loaded certificate is kept if the files cannot be loaded,
+// e.g. while the certificate is already replaced and the key is not yet.
+//
+// Returns an error if the files cannot be loaded.
+func (r *certReloader) reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// changed reports whether the certificate files are modified since they were loaded.
+func (r *certReloader) changed() (bool, error) {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !modTime.Equal(r.modTime), nil
+}
+
+// filesModTime returns the latest modification time of the certificate files.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cannot stat certificate: %w", err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// watch reloads the certificate when its files change or a signal is received until the context is done.
+//
+// Parameters:
+// - ctx: the context that stops the watching.
+// - interval: the interval the files are checked for changes at.
+// - hup: the channel of the signals that force the reload, usually SIGHUP.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration, hup <-chan os.Signal) {
+	logger := mylogger.Get()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			changed, err := r.changed()
+			if err != nil {
+				logger.Error("cannot check certificate", zap.Error(err))
+				continue
+			}
+			if !changed {
+				continue
+			}
+		}
+
+		err := r.reload()
+		if err != nil {
+			logger.Error("cannot reload certificate, keeping the loaded one", zap.Error(err))
+			continue
+		}
+		logger.Info("certificate reloaded", zap.String("path", r.certFile))
+	}
+}
+
+// getCertificate returns the certificate of the HTTPS and gRPC servers for the TLS handshake.
+//
+// It is obtained via ACME if it is enabled, the loaded certificate files are used otherwise.
+func (app *App) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if app.acme != nil {
+		return app.acme.GetCertificate(hello)
+	}
+	return app.certs.GetCertificate(hello)
+}
+
+// certificateHosts returns the host names and IP addresses the server is reachable at by the configuration.
+//
+// They are the hosts of the base, run and gRPC addresses along with the loopback ones.
+//
+// Returns a slice of unique hosts.
+func (app *App) certificateHosts() []string {
+	hosts := []string{}
+	if baseAddr, err := url.Parse(app.Config.GetBaseAddr()); err == nil {
+		hosts = append(hosts, baseAddr.Hostname())
+	}
+	for _, addr := range []string{app.Config.GetRunAddr(), app.Config.GetGRPCAddr()} {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	hosts = append(hosts, "localhost", "127.0.0.1", "::1")
+
+	seen := make(map[string]bool, len(hosts))
+	res := hosts[:0]
+	for _, host := range hosts {
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		res = append(res, host)
+	}
+	return res
+}
+
+// createCertificate generates a self-signed certificate and private key, saving them to disk.
+//
+// It is the development mode of HTTPS, the key is readable by the owner only.
+//
+// Parameters:
+// - certFile: the path to write the PEM certificate to.
+// - keyFile: the path to write the PEM private key to.
+// - hosts: the host names and IP addresses the certificate is valid for, the first one is the common name.
+//
+// Returns an error.
+func createCertificate(certFile, keyFile string, hosts []string) error {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("error generate serial number %w", err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization:       []string{"Localhost Ent."},
+			OrganizationalUnit: []string{"Shorty Server"},
+			Country:            []string{"RU"},
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			cert.IPAddresses = append(cert.IPAddresses, ip)
+		} else {
+			cert.DNSNames = append(cert.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		cert.Subject.CommonName = hosts[0]
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("error generate key %w", err)
+	}
+
+	certData, err := x509.CreateCertificate(rand.Reader, cert, cert, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return fmt.Errorf("error create certificate %w", err)
+	}
+
+	for _, name := range []string{certFile, keyFile} {
+		err = os.MkdirAll(filepath.Dir(name), 0700)
+		if err != nil {
+			return fmt.Errorf("error create certificate directory %w", err)
+		}
+	}
+
+	var privateKeyBytes bytes.Buffer
+	err = pem.Encode(&privateKeyBytes, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	if err != nil {
+		return fmt.Errorf("error encode private key %w", err)
+	}
+	err = os.WriteFile(keyFile, privateKeyBytes.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("error write private key %w", err)
+	}
+	// the key may be left world-readable by an older version
+	err = os.Chmod(keyFile, 0600)
+	if err != nil {
+		return fmt.Errorf("error write private key %w", err)
+	}
+
+	var certDataBytes bytes.Buffer
+	err = pem.Encode(&certDataBytes, &pem.Block{Type: "CERTIFICATE", Bytes: certData})
+	if err != nil {
+		return fmt.Errorf("error encode certificate %w", err)
+	}
+	err = os.WriteFile(certFile, certDataBytes.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("error write certificate %w", err)
+	}
+
+	return nil
+}
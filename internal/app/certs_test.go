@@ -0,0 +1,113 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCreateCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert", "cert.pem")
+	keyFile := filepath.Join(dir, "cert", "key.pem")
+
+	err := createCertificate(certFile, keyFile, []string{"shorty.local", "localhost", "127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key readable by the owner only, but got %v", info.Mode().Perm())
+	}
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cert, _ := certs.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, host := range []string{"shorty.local", "localhost", "127.0.0.1", "::1"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("Expected the certificate valid for %s, but got %v", host, err)
+		}
+	}
+	if err := leaf.VerifyHostname("example.com"); err == nil {
+		t.Errorf("Expected the certificate invalid for example.com")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	renewals := 0
+	renew := func() []byte {
+		if err := createCertificate(certFile, keyFile, []string{"localhost"}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		// the files may be rewritten within the file system timestamp granularity
+		renewals++
+		modTime := time.Now().Add(time.Duration(renewals) * time.Minute)
+		os.Chtimes(certFile, modTime, modTime)
+		os.Chtimes(keyFile, modTime, modTime)
+		cert, _ := tls.LoadX509KeyPair(certFile, keyFile)
+		return cert.Certificate[0]
+	}
+	renew()
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	served := func() []byte {
+		cert, _ := certs.GetCertificate(nil)
+		return cert.Certificate[0]
+	}
+	waitFor := func(expected []byte) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !bytes.Equal(served(), expected) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the renewed certificate to be served")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A broken key keeps the loaded certificate
+	loaded := served()
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	if err := certs.reload(); err == nil {
+		t.Errorf("Expected an error for the broken key")
+	}
+	if !bytes.Equal(served(), loaded) {
+		t.Errorf("Expected the loaded certificate to be kept")
+	}
+
+	// Changed files are reloaded
+	ctx, cancel := context.WithCancel(context.Background())
+	go certs.watch(ctx, 10*time.Millisecond, nil)
+	waitFor(renew())
+	cancel()
+
+	// SIGHUP reloads the files without waiting for the check
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	hup := make(chan os.Signal, 1)
+	go certs.watch(ctx, time.Hour, hup)
+	renewed := renew()
+	hup <- syscall.SIGHUP
+	waitFor(renewed)
+}
@@ -0,0 +1,386 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	mylogger "github.com/stsg/shorty/internal/logger"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+// Defaults of the deletion queue of an App with a zero Config.
+const (
+	defaultDeleteBatchSize = 500
+	defaultDeleteFlush     = time.Second
+)
+
+// Retries of a batch of deletions the storage fails to save.
+const (
+	maxDeleteAttempts = 5
+	deleteBackoff     = 100 * time.Millisecond
+	maxDeleteBackoff  = 5 * time.Second
+)
+
+// deletion is a queued deletion of a short URL of a user.
+type deletion struct {
+	shortURL string
+	userID   uint64
+}
+
+// journalRecord is a line of the deletion journal: the deletions of a request,
+// or the pending deletions of a user after the journal is compacted.
+type journalRecord struct {
+	UserID    uint64   `json:"user_id"`
+	ShortURLs []string `json:"short_urls"`
+}
+
+// deletionQueue buffers the deletions of the short URLs and saves them to the storage in batches.
+//
+// The repeated deletions are coalesced. A batch is saved once batchSize deletions are queued or every flush
+// interval, a batch the storage fails to save is retried with backoff and stays queued if it still fails.
+// A permanent failure, a closed storage or a canceled request, is not retried and stops the saving,
+// the deletions stay queued until the queue is closed.
+// With a journal the queued deletions are appended and synced to it before they are accepted and it is compacted
+// to the pending ones after they are saved, the deletions left in it are queued again on start.
+type deletionQueue struct {
+	storage   storage.Storage
+	batchSize int
+	interval  time.Duration
+	backoff   time.Duration
+
+	mu      sync.Mutex
+	pending map[deletion]struct{}
+	path    string
+	journal *os.File
+
+	full   chan struct{}
+	closed chan struct{}
+}
+
+// newDeletionQueue creates the deletion queue of the storage.
+//
+// Parameters:
+// - s: the storage the deletions are saved to.
+// - batchSize: the maximal number of the deletions saved at once, defaultDeleteBatchSize if it is not positive.
+// - interval: the interval the deletions are saved at, defaultDeleteFlush if it is not positive.
+// - path: the path to the journal, empty to keep the deletions in memory only.
+//
+// Returns:
+// - *deletionQueue: the queue with the deletions restored from the journal.
+// - error: an error if the journal cannot be read or written.
+func newDeletionQueue(s storage.Storage, batchSize int, interval time.Duration, path string) (*deletionQueue, error) {
+	q := &deletionQueue{
+		storage:   s,
+		batchSize: batchSize,
+		interval:  interval,
+		backoff:   deleteBackoff,
+		pending:   make(map[deletion]struct{}),
+		path:      path,
+		full:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	if q.batchSize < 1 {
+		q.batchSize = defaultDeleteBatchSize
+	}
+	if q.interval <= 0 {
+		q.interval = defaultDeleteFlush
+	}
+	if q.path == "" {
+		return q, nil
+	}
+
+	restored, err := q.restore()
+	if err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	if restored > 0 {
+		mylogger.Get().Info("queued deletions restored", zap.String("journal", q.path), zap.Int("count", restored))
+	}
+	return q, nil
+}
+
+// restore queues the deletions of the journal, a line left incomplete by a crash is skipped.
+//
+// It returns the number of the restored deletions.
+func (q *deletionQueue) restore() (int, error) {
+	file, err := os.Open(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot open deletion journal: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot read deletion journal: %w", err)
+		}
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			mylogger.Get().Warn("invalid deletion journal record skipped", zap.String("journal", q.path), zap.Error(err))
+			continue
+		}
+		q.queue(record)
+	}
+	return len(q.pending), nil
+}
+
+// add queues the deletions of the short URLs of the user.
+//
+// Parameters:
+// - userID: the user the URLs are deleted for.
+// - shortURLs: the IDs of the short URLs.
+//
+// Returns:
+// - error: an error if the deletions cannot be appended to the journal or synced, they are not queued then.
+func (q *deletionQueue) add(userID uint64, shortURLs []string) error {
+	if len(shortURLs) == 0 {
+		return nil
+	}
+	record := journalRecord{UserID: userID, ShortURLs: shortURLs}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.journal != nil {
+		if err := writeJournalRecord(q.journal, record); err != nil {
+			return fmt.Errorf("cannot write deletion journal: %w", err)
+		}
+		if err := q.journal.Sync(); err != nil {
+			return fmt.Errorf("cannot sync deletion journal: %w", err)
+		}
+	}
+	q.queue(record)
+	if len(q.pending) >= q.batchSize {
+		select {
+		case q.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// queue adds the deletions of the record to the pending ones, the lock should be held by the caller.
+func (q *deletionQueue) queue(record journalRecord) {
+	for _, shortURL := range record.ShortURLs {
+		q.pending[deletion{shortURL: shortURL, userID: record.UserID}] = struct{}{}
+	}
+}
+
+// depth returns the number of the queued deletions that are not saved yet.
+func (q *deletionQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// close stops the queue, run saves the deletions queued by then and returns.
+func (q *deletionQueue) close() {
+	close(q.closed)
+}
+
+// run saves the queued deletions in batches until the queue is closed.
+//
+// The deletions queued by then are saved before it returns, the ones the storage fails to save are kept in the journal.
+// After a permanent failure the deletions are no longer saved, run only waits for the queue to be closed.
+func (q *deletionQueue) run() {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.full:
+		case <-ticker.C:
+		case <-q.closed:
+			q.flush()
+			q.closeJournal()
+			return
+		}
+		if err := q.flush(); err != nil {
+			mylogger.Get().Error("deletion queue stopped, the queued deletions are not saved", zap.Int("count", q.depth()), zap.Error(err))
+			<-q.closed
+			q.closeJournal()
+			return
+		}
+	}
+}
+
+// flush saves the deletions queued so far in batches and compacts the journal.
+//
+// It stops at the first batch the storage fails to save, the batch stays queued and is retried by the next flush.
+// It returns the error of a batch that failed permanently, so it cannot be saved by the next flush either.
+func (q *deletionQueue) flush() error {
+	logger := mylogger.Get()
+
+	var permanent error
+	saved := false
+	for n := q.depth(); n > 0; {
+		batch := q.nextBatch()
+		if err := q.save(batch); err != nil {
+			logger.Error("cannot delete URLs, they stay queued", zap.Int("count", len(batch)), zap.Error(err))
+			if isPermanentDeleteError(err) {
+				permanent = err
+			}
+			break
+		}
+		q.done(batch)
+		saved = true
+		n -= len(batch)
+	}
+
+	if saved {
+		q.mu.Lock()
+		err := q.compact()
+		q.mu.Unlock()
+		if err != nil {
+			logger.Error("cannot compact deletion journal", zap.String("journal", q.path), zap.Error(err))
+		}
+	}
+	return permanent
+}
+
+// nextBatch returns up to batchSize queued deletions, they stay queued until they are saved.
+//
+// A short URL deleted by several users is put in a batch once, the other deletions wait for the next batch.
+func (q *deletionQueue) nextBatch() map[string]uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	batch := make(map[string]uint64, min(q.batchSize, len(q.pending)))
+	for d := range q.pending {
+		if len(batch) == q.batchSize {
+			break
+		}
+		if _, ok := batch[d.shortURL]; !ok {
+			batch[d.shortURL] = d.userID
+		}
+	}
+	return batch
+}
+
+// save deletes the URLs of the batch from the storage, it retries with exponential backoff
+// up to maxDeleteAttempts times, a permanent failure is returned at once.
+func (q *deletionQueue) save(batch map[string]uint64) error {
+	backoff := q.backoff
+	for attempt := 1; ; attempt++ {
+		err := q.storage.DeleteURL(context.Background(), batch)
+		if err == nil || attempt == maxDeleteAttempts || isPermanentDeleteError(err) {
+			return err
+		}
+		mylogger.Get().Warn("cannot delete URLs, retrying",
+			zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxDeleteBackoff)
+	}
+}
+
+// isPermanentDeleteError reports whether the storage failed to save the deletions for a reason a retry does not fix:
+// the storage is closed or the request is canceled.
+func isPermanentDeleteError(err error) bool {
+	return errors.Is(err, storage.ErrStorageClosed) ||
+		errors.Is(err, storage.ErrRequestCanceled) || errors.Is(err, storage.ErrDeadlineExceeded) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// done removes the saved deletions of the batch from the queue.
+func (q *deletionQueue) done(batch map[string]uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for shortURL, userID := range batch {
+		delete(q.pending, deletion{shortURL: shortURL, userID: userID})
+	}
+}
+
+// compact replaces the journal with the pending deletions and reopens it for appending,
+// the lock should be held by the caller.
+//
+// The new journal is written to a temporary file that is renamed over the old one, so a crash leaves either of them.
+func (q *deletionQueue) compact() error {
+	if q.path == "" {
+		return nil
+	}
+
+	byUser := make(map[uint64][]string)
+	for d := range q.pending {
+		byUser[d.userID] = append(byUser[d.userID], d.shortURL)
+	}
+	tmpPath := q.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for userID, shortURLs := range byUser {
+		if err := writeJournalRecord(tmp, journalRecord{UserID: userID, ShortURLs: shortURLs}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if q.journal != nil {
+		q.journal.Close()
+	}
+	q.journal = journal
+	return nil
+}
+
+// closeJournal closes the journal, the deletions left in it are queued again on the next start.
+func (q *deletionQueue) closeJournal() {
+	logger := mylogger.Get()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.journal != nil {
+		if err := q.journal.Close(); err != nil {
+			logger.Error("cannot close deletion journal", zap.String("journal", q.path), zap.Error(err))
+		}
+		q.journal = nil
+	}
+	switch {
+	case len(q.pending) == 0:
+	case q.path != "":
+		logger.Warn("queued deletions are not saved, they are kept in journal", zap.String("journal", q.path), zap.Int("count", len(q.pending)))
+	default:
+		logger.Error("queued deletions are not saved and lost", zap.Int("count", len(q.pending)))
+	}
+}
+
+// writeJournalRecord appends the record to the journal as a JSON line.
+func writeJournalRecord(w io.Writer, record journalRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
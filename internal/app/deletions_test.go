@@ -0,0 +1,208 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stsg/shorty/internal/storage"
+)
+
+// batchStorage is a memory storage that records the sizes of the deletion batches and fails the first ones
+// with err, an unavailable storage if it is nil.
+type batchStorage struct {
+	*storage.MapStorage
+	mu      sync.Mutex
+	fails   int
+	err     error
+	calls   int
+	batches []int
+}
+
+func (s *batchStorage) DeleteURL(ctx context.Context, delURL map[string]uint64) error {
+	s.mu.Lock()
+	s.calls++
+	if s.fails > 0 {
+		s.fails--
+		s.mu.Unlock()
+		if s.err != nil {
+			return s.err
+		}
+		return errors.New("storage is unavailable")
+	}
+	s.batches = append(s.batches, len(delURL))
+	s.mu.Unlock()
+	return s.MapStorage.DeleteURL(ctx, delURL)
+}
+
+// saveURLs saves n short URLs of the user to the storage and returns them.
+func saveURLs(t *testing.T, s storage.Storage, userID uint64, n int) []string {
+	t.Helper()
+	var shortURLs []string
+	for i := 0; i < n; i++ {
+		shortURL := fmt.Sprintf("del%d", i)
+		if err := s.Save(context.Background(), userID, shortURL, "https://example.com/"+shortURL, time.Time{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		shortURLs = append(shortURLs, shortURL)
+	}
+	return shortURLs
+}
+
+// waitDepth waits until the queue depth is zero.
+func waitDepth(t *testing.T, q *deletionQueue) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.depth() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the deletions to be saved, but %d are queued", q.depth())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeletionQueue_Batches(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	bStorage := &batchStorage{MapStorage: mStorage}
+	shortURLs := saveURLs(t, bStorage, 1, 7)
+
+	// A full batch is saved without waiting for the flush interval
+	q, err := newDeletionQueue(bStorage, 3, time.Hour, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	go q.run()
+	defer q.close()
+
+	q.add(1, shortURLs[:2])
+	q.add(1, shortURLs[:2])
+	if depth := q.depth(); depth != 2 {
+		t.Errorf("Expected the repeated deletions to be coalesced, but got %d queued", depth)
+	}
+	q.add(1, shortURLs[2:])
+	waitDepth(t, q)
+
+	bStorage.mu.Lock()
+	defer bStorage.mu.Unlock()
+	if fmt.Sprint(bStorage.batches) != "[3 3 1]" {
+		t.Errorf("Expected batches of 3, 3 and 1, but got %v", bStorage.batches)
+	}
+	for _, shortURL := range shortURLs {
+		if _, err := mStorage.GetRealURL(context.Background(), shortURL); err == nil {
+			t.Errorf("Expected %s to be deleted", shortURL)
+		}
+	}
+}
+
+func TestDeletionQueue_Retry(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	bStorage := &batchStorage{MapStorage: mStorage}
+	shortURLs := saveURLs(t, bStorage, 1, 2)
+
+	// The batch is saved after the failures on the next flush interval
+	bStorage.fails = maxDeleteAttempts + 1
+	q, err := newDeletionQueue(bStorage, 10, 20*time.Millisecond, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q.backoff = time.Millisecond
+	go q.run()
+	defer q.close()
+
+	q.add(1, shortURLs)
+	waitDepth(t, q)
+
+	bStorage.mu.Lock()
+	defer bStorage.mu.Unlock()
+	if bStorage.fails != 0 || fmt.Sprint(bStorage.batches) != "[2]" {
+		t.Errorf("Expected a batch of 2 after the failures, but got %v, %d failures left", bStorage.batches, bStorage.fails)
+	}
+}
+
+func TestDeletionQueue_PermanentError(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	bStorage := &batchStorage{MapStorage: mStorage}
+	shortURLs := saveURLs(t, bStorage, 1, 2)
+
+	// A closed storage is neither retried nor saved to by the next flushes
+	bStorage.fails = 1
+	bStorage.err = fmt.Errorf("%w: %w", storage.ErrStorageClosed, os.ErrClosed)
+	q, err := newDeletionQueue(bStorage, 10, 10*time.Millisecond, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q.backoff = time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		q.run()
+		close(done)
+	}()
+
+	q.add(1, shortURLs)
+	time.Sleep(100 * time.Millisecond)
+	q.close()
+	<-done
+
+	bStorage.mu.Lock()
+	defer bStorage.mu.Unlock()
+	if bStorage.calls != 1 || q.depth() != 2 {
+		t.Errorf("Expected a single attempt and 2 queued deletions, but got %d attempts, %d queued", bStorage.calls, q.depth())
+	}
+}
+
+func TestDeletionQueue_Journal(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	shortURLs := saveURLs(t, mStorage, 1, 3)
+	path := filepath.Join(t.TempDir(), "deletions.log")
+
+	// The queued deletions are journaled before the crash
+	q, err := newDeletionQueue(mStorage, 10, time.Hour, path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := q.add(1, shortURLs[:2]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := q.add(1, shortURLs[2:]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	q.journal.Close()
+
+	// A record left incomplete by the crash is skipped
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	file.WriteString(`{"user_id":1,"short_u`)
+	file.Close()
+
+	q, err = newDeletionQueue(mStorage, 10, time.Hour, path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if depth := q.depth(); depth != 3 {
+		t.Fatalf("Expected 3 restored deletions, but got %d", depth)
+	}
+	done := make(chan struct{})
+	go func() {
+		q.run()
+		close(done)
+	}()
+	q.close()
+	<-done
+
+	for _, shortURL := range shortURLs {
+		if _, err := mStorage.GetRealURL(context.Background(), shortURL); err == nil {
+			t.Errorf("Expected %s to be deleted", shortURL)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) != 0 {
+		t.Errorf("Expected the journal to be empty, but got %q, %v", data, err)
+	}
+}
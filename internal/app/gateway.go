@@ -0,0 +1,122 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pbv2 "github.com/stsg/shorty/api/v2"
+	mylogger "github.com/stsg/shorty/internal/logger"
+)
+
+// gatewayPrefix is the path the REST/JSON gateway of the v2 API is mounted at.
+const gatewayPrefix = "/v2"
+
+// gatewayBufferSize is the size of the buffer of the in-memory connections of the gateway to the gRPC server.
+const gatewayBufferSize = 1 << 20
+
+// NewGatewayHandler returns the REST/JSON gateway of the v2 gRPC API.
+//
+// The routes are generated from the google.api.http options of the proto definitions,
+// the OpenAPI document of them is served at /v2/openapi.json.
+// The RPCs are called on the gRPC server of the App over an in-memory connection, so they pass
+// the interceptors of the server like the RPCs of the gRPC clients do and the streaming RPCs work too.
+// The "Authorization" header is passed to the RPCs as the "authorization" metadata and the "token" cookie
+// as the "token" metadata, a new session token returned in the "token" header metadata is set as the cookie.
+// The connection is closed when the gRPC server is stopped.
+//
+// Returns:
+// - http.Handler: the gateway handler.
+// - error: an error if the gateway routes cannot be registered.
+func (app *App) NewGatewayHandler() (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions: protojson.MarshalOptions{UseProtoNames: true},
+		}),
+		runtime.WithMetadata(sessionMetadata),
+		runtime.WithIncomingHeaderMatcher(incomingHeaderMatcher),
+		runtime.WithOutgoingHeaderMatcher(outgoingHeaderMatcher),
+		runtime.WithForwardResponseOption(app.forwardSession),
+	)
+
+	listener := bufconn.Listen(gatewayBufferSize)
+	go func() {
+		err := app.GRPCServer.grpcServer.Serve(listener)
+		if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			mylogger.Get().Error("cannot serve REST gateway", zap.Error(err))
+		}
+	}()
+	conn, err := grpc.NewClient("passthrough:///gateway",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	app.GRPCServer.gateway = conn
+
+	err = pbv2.RegisterShortenerServiceHandler(context.Background(), mux, conn)
+	if err != nil {
+		return nil, err
+	}
+	err = mux.HandlePath(http.MethodGet, gatewayPrefix+"/openapi.json", func(rw http.ResponseWriter, _ *http.Request, _ map[string]string) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(pbv2.OpenAPI)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mux, nil
+}
+
+// sessionMetadata passes the "token" cookie of the request to the RPCs as the "token" metadata.
+func sessionMetadata(_ context.Context, req *http.Request) metadata.MD {
+	cookie, err := req.Cookie("token")
+	if err != nil {
+		return nil
+	}
+	return metadata.Pairs("token", cookie.Value)
+}
+
+// incomingHeaderMatcher passes the "Authorization" header to the RPCs as the "authorization" metadata
+// checked by the API key interceptors, the other headers are passed the default way.
+func incomingHeaderMatcher(key string) (string, bool) {
+	if http.CanonicalHeaderKey(key) == "Authorization" {
+		return "authorization", true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// outgoingHeaderMatcher forwards the header metadata of the RPCs as Grpc-Metadata-* headers
+// except the session token, which is set as the cookie by forwardSession.
+func outgoingHeaderMatcher(key string) (string, bool) {
+	if key == "token" {
+		return "", false
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// forwardSession sets the session token created by the RPC as the "token" cookie of the response.
+func (app *App) forwardSession(ctx context.Context, rw http.ResponseWriter, _ proto.Message) error {
+	md, ok := runtime.ServerMetadataFromContext(ctx)
+	if !ok || len(md.HeaderMD.Get("token")) == 0 {
+		return nil
+	}
+	app.SetSession(rw, md.HeaderMD.Get("token")[0])
+	return nil
+}
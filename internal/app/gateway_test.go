@@ -0,0 +1,101 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/stsg/shorty/internal/config"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+func TestGateway(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	app := NewApp(config.NewConfig(), mStorage)
+	gateway, err := app.NewGatewayHandler()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	router := chi.NewRouter()
+	router.Use(app.APIKeyAuth())
+	router.Mount(gatewayPrefix, gateway)
+
+	// A client without a session gets a new user in the cookie
+	rw := httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/v2/shorten", strings.NewReader(`{"url":"https://example.com/rest"}`)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d: %s", rw.Code, rw.Body)
+	}
+	var created struct {
+		ShortURL string `json:"short_url"`
+	}
+	json.Unmarshal(rw.Body.Bytes(), &created)
+	cookies := rw.Result().Cookies()
+	if created.ShortURL == "" || len(cookies) != 1 || cookies[0].Name != "token" {
+		t.Fatalf("Expected a short URL and a session cookie, but got %s, %v", rw.Body, cookies)
+	}
+	if rw.Header().Get("Grpc-Metadata-Token") != "" {
+		t.Errorf("Expected the session token in the cookie only")
+	}
+
+	// A conflict is reported with the status details
+	req := httptest.NewRequest(http.MethodPost, "/v2/shorten", strings.NewReader(`{"url":"https://example.com/rest"}`))
+	req.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusConflict || !strings.Contains(rw.Body.String(), created.ShortURL) {
+		t.Errorf("Expected status 409 with the existing short URL, but got %d: %s", rw.Code, rw.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/user/urls", nil)
+	req.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "https://example.com/rest") {
+		t.Errorf("Expected the user URLs, but got %d: %s", rw.Code, rw.Body)
+	}
+
+	// The user URLs need a session
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/v2/user/urls", nil))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, but got %d", rw.Code)
+	}
+
+	// The RPCs pass the interceptors of the gRPC server, which check the API key
+	req = httptest.NewRequest(http.MethodGet, "/v2/user/urls", nil)
+	req.Header.Set("Authorization", "Bearer unknown")
+	rw = httptest.NewRecorder()
+	gateway.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for an unknown API key, but got %d", rw.Code)
+	}
+
+	// The streamed items are newline-delimited JSON objects
+	req = httptest.NewRequest(http.MethodPost, "/v2/shorten/upload",
+		strings.NewReader(`{"original_url":"https://example.com/upload"}`+"\n"+`{"original_url":"https://example.com/rest"}`))
+	req.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"shortened":1`) || !strings.Contains(rw.Body.String(), `"failed":1`) {
+		t.Errorf("Expected an uploaded and a failed item, but got %d: %s", rw.Code, rw.Body)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/v2/shorten/stream",
+		strings.NewReader(`{"correlation_id":"1","original_url":"https://example.com/stream"}`))
+	req.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"correlation_id":"1"`) || !strings.Contains(rw.Body.String(), `"short_url":`) {
+		t.Errorf("Expected the streamed result, but got %d: %s", rw.Code, rw.Body)
+	}
+
+	rw = httptest.NewRecorder()
+	router.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/v2/openapi.json", nil))
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"/v2/shorten"`) {
+		t.Errorf("Expected the OpenAPI document, but got %d", rw.Code)
+	}
+}
@@ -2,52 +2,189 @@ package app
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	grpcmiddleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/metadata"
 	status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	pb "github.com/stsg/shorty/api/v1"
 	"github.com/stsg/shorty/internal/logger"
 	"github.com/stsg/shorty/internal/storage"
 )
 
+// okStatusError is the Error field of the successful v1 responses, the string form of the codes.OK status
+// formatted like the errors of the failed ones, the v1 clients check it.
+var okStatusError = status.New(codes.OK, "").String()
+
 // GRPCServer is a struct that holds gRPC server data.
 type GRPCServer struct {
-	pb.UnimplementedShortenerServiceServer
 	grpcServer *grpc.Server
+	// health is the health checking service, nil if it is disabled
+	health *health.Server
+	// gateway is the connection of the REST/JSON gateway to the server, nil if the gateway is not created
+	gateway *grpc.ClientConn
 }
 
 // NewGRPCServer creates a new instance of the GRPCServer struct.
 //
-// It initializes the GRPCServer with the provided interceptors and registers the
-// ShortenerServer with the gRPC server.
+// It initializes the GRPCServer with the request loggers followed by the provided interceptors.
+// The services are registered by the caller.
+//
+// Parameters:
+// - unary: the interceptors of the unary calls.
+// - stream: the interceptors of the streaming calls.
 //
 // Returns a pointer to the GRPCServer instance.
-func NewGRPCServer() *GRPCServer {
-	interceptors := []grpc.UnaryServerInterceptor{
+func NewGRPCServer(unary []grpc.UnaryServerInterceptor, stream []grpc.StreamServerInterceptor) *GRPCServer {
+	unary = append([]grpc.UnaryServerInterceptor{
 		GRPCRequestLogger,
-	}
+	}, unary...)
+	stream = append([]grpc.StreamServerInterceptor{
+		GRPCStreamRequestLogger,
+	}, stream...)
 
 	srv := grpc.NewServer(
-		grpc.UnaryInterceptor(grpcmiddleware.ChainUnaryServer(interceptors...)),
+		grpc.UnaryInterceptor(grpcmiddleware.ChainUnaryServer(unary...)),
+		grpc.StreamInterceptor(grpcmiddleware.ChainStreamServer(stream...)),
 	)
-	pb.RegisterShortenerServiceServer(srv, &GRPCServer{
-		grpcServer: srv,
-	})
 
 	return &GRPCServer{
 		grpcServer: srv,
 	}
 }
 
+// grpcMux returns the handler serving the gRPC requests with the gRPC server of the App and the rest with next.
+//
+// The gRPC requests are told apart by HTTP/2 and the application/grpc content type.
+// HTTP/2 without TLS (h2c) is accepted along with HTTP/1.1, so gRPC clients can use a plaintext port too,
+// over TLS HTTP/2 is negotiated by the HTTP server.
+func (app *App) grpcMux(next http.Handler) http.Handler {
+	return h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+			app.GRPCServer.grpcServer.ServeHTTP(rw, req)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	}), &http2.Server{})
+}
+
+// grpcListener returns the listener of the gRPC server on the configured address.
+//
+// With HTTPS enabled the connections are served over TLS with the HTTPS certificate,
+// so the reloaded or ACME certificate is used by the gRPC server too, see grpcTLSConfig.
+//
+// Returns:
+// - net.Listener: the listener.
+// - error: an error if the address cannot be listened on or the TLS configuration cannot be loaded.
+func (app *App) grpcListener() (net.Listener, error) {
+	listener, err := net.Listen("tcp", app.Config.GetGRPCAddr())
+	if err != nil {
+		return nil, err
+	}
+	if !app.Config.GetEnableHTTPS() {
+		return listener, nil
+	}
+
+	tlsConfig, err := grpcTLSConfig(app.getCertificate, app.Config.GetGRPCClientCA())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// grpcTLSConfig returns the TLS configuration of the gRPC server.
+//
+// Parameters:
+// - getCertificate: returns the certificate of the server for the TLS handshake.
+// - clientCA: the PEM bundle of the CAs to verify the client certificates with,
+// if it is empty the client certificates are not required.
+//
+// Returns:
+// - *tls.Config: the configuration, it negotiates HTTP/2 as gRPC clients require.
+// - error: an error if the client CA bundle cannot be loaded or has no certificates.
+func grpcTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), clientCA string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"h2"},
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCA == "" {
+		return tlsConfig, nil
+	}
+
+	bundle, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates in client CA")
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return tlsConfig, nil
+}
+
+// storageErrorCode returns the gRPC status code for storage errors caused by a done request context.
+//
+// Parameters:
+// - err: the error returned by the storage.
+//
+// Returns:
+// - codes.Code: codes.Canceled for a canceled request, codes.DeadlineExceeded for an expired deadline.
+// - bool: false if err is not a context related storage error.
+func storageErrorCode(err error) (codes.Code, bool) {
+	switch {
+	case errors.Is(err, storage.ErrRequestCanceled):
+		return codes.Canceled, true
+	case errors.Is(err, storage.ErrDeadlineExceeded):
+		return codes.DeadlineExceeded, true
+	}
+	return codes.OK, false
+}
+
+// expirationFromProto converts the optional protobuf expiration fields to the form used by the storage requests.
+//
+// Parameters:
+// - expiresAt: the absolute expiration time, nil if not requested.
+// - ttl: the time to live, nil if not requested.
+//
+// Returns:
+// - *time.Time: the absolute expiration time, nil if not requested.
+// - int64: the time to live in seconds, 0 if not requested.
+func expirationFromProto(expiresAt *timestamppb.Timestamp, ttl *durationpb.Duration) (*time.Time, int64) {
+	var reqExpiresAt *time.Time
+	var reqTTL int64
+
+	if expiresAt != nil {
+		t := expiresAt.AsTime()
+		reqExpiresAt = &t
+	}
+	if ttl != nil {
+		reqTTL = int64(ttl.AsDuration() / time.Second)
+	}
+	return reqExpiresAt, reqTTL
+}
+
 // ShortRequest handles the request to save a URL and generates a short URL.
 //
 // Takes a context.Context and a pb.SaveURLRequest as input parameters.
@@ -55,11 +192,33 @@ func NewGRPCServer() *GRPCServer {
 func (app *App) ShortRequest(ctx context.Context, req *pb.ShortRequestRequest) (*pb.ShortRequestResponse, error) {
 	logger := logger.Get()
 
-	_, userID := app.Session.AddUserSession()
-	shortURL, err := app.storage.GetShortURL(userID, req.Url)
+	var shortURL string
+
+	reqExpiresAt, reqTTL := expirationFromProto(req.ExpiresAt, req.Ttl)
+	expiresAt, err := storage.ExpirationTime(reqExpiresAt, reqTTL, time.Now())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	userID, err := app.userIDFromMetadata(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if req.Alias != "" {
+		err = storage.ValidateAlias(req.Alias)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		shortURL, err = app.storage.SaveAlias(ctx, userID, req.Alias, req.Url, expiresAt)
+	} else {
+		shortURL, err = app.storage.GetShortURL(ctx, userID, req.Url, expiresAt)
+	}
 	result := app.Config.GetBaseAddr() + "/" + shortURL
 	if err != nil {
-		if errors.Is(err, storage.ErrUniqueViolation) {
+		if code, ok := storageErrorCode(err); ok {
+			return nil, status.Error(code, err.Error())
+		}
+		if errors.Is(err, storage.ErrUniqueViolation) || errors.Is(err, storage.ErrAliasTaken) {
 			return &pb.ShortRequestResponse{
 				Result: result,
 				Error:  status.Error(codes.AlreadyExists, err.Error()).Error(),
@@ -75,7 +234,7 @@ func (app *App) ShortRequest(ctx context.Context, req *pb.ShortRequestRequest) (
 
 	return &pb.ShortRequestResponse{
 		Result: result,
-		Error:  status.Error(codes.OK, "").Error(),
+		Error:  okStatusError,
 	}, nil
 }
 
@@ -90,9 +249,12 @@ func (app *App) ShortID(ctx context.Context, req *pb.ShortIDRequest) (*pb.ShortI
 
 	id := strings.TrimPrefix(req.Url, "/")
 	id = strings.TrimSuffix(id, "/")
-	longURL, err := app.storage.GetRealURL(id)
+	longURL, err := app.storage.GetRealURL(ctx, id)
 	if err != nil {
-		if errors.Is(err, storage.ErrURLDeleted) {
+		if code, ok := storageErrorCode(err); ok {
+			return nil, status.Error(code, err.Error())
+		}
+		if errors.Is(err, storage.ErrURLDeleted) || errors.Is(err, storage.ErrURLExpired) {
 			return &pb.ShortIDResponse{
 				Result: longURL,
 				Error:  status.Error(codes.NotFound, err.Error()).Error(),
@@ -108,7 +270,7 @@ func (app *App) ShortID(ctx context.Context, req *pb.ShortIDRequest) (*pb.ShortI
 
 	return &pb.ShortIDResponse{
 		Result: longURL,
-		Error:  status.Error(codes.OK, "").Error(),
+		Error:  okStatusError,
 	}, nil
 }
 
@@ -121,22 +283,27 @@ func (app *App) ShortRequestBatch(ctx context.Context, req *pb.ShortRequestBatch
 
 	logger := logger.Get()
 
-	_, userID := app.Session.AddUserSession()
-
-	body, err := json.Marshal(req.Items)
+	userID, err := app.userIDFromMetadata(ctx, true)
 	if err != nil {
-		logger.Error("gRPC server ShortRequestBatch: cannot marshal request body", zap.Error(err))
-		return nil, fmt.Errorf("%w", status.Error(codes.InvalidArgument, err.Error()))
+		return nil, err
 	}
 
-	err = json.Unmarshal(body, &rqJSON)
-	if err != nil {
-		logger.Error("gRPC server ShortRequestBatch: cannot unmarshal request body", zap.Error(err))
-		return nil, fmt.Errorf("%w", status.Error(codes.InvalidArgument, err.Error()))
+	for _, item := range req.Items {
+		expiresAt, ttl := expirationFromProto(item.ExpiresAt, item.Ttl)
+		rqJSON = append(rqJSON, storage.ReqJSONBatch{
+			ID:        item.CorrelationId,
+			URL:       item.OriginalUrl,
+			Alias:     item.Alias,
+			ExpiresAt: expiresAt,
+			TTL:       ttl,
+		})
 	}
 
-	rwJSON, err := app.storage.GetShortURLBatch(userID, app.Config.GetBaseAddr(), rqJSON)
+	rwJSON, err := app.storage.GetShortURLBatch(ctx, userID, app.Config.GetBaseAddr(), rqJSON)
 	if err != nil {
+		if code, ok := storageErrorCode(err); ok {
+			return nil, status.Error(code, err.Error())
+		}
 		logger.Error("gRPC server ShortRequestBatch: cannot get short URL batch", zap.Error(err))
 		return nil, fmt.Errorf("%w", status.Error(codes.InvalidArgument, err.Error()))
 	}
@@ -157,18 +324,165 @@ func (app *App) ShortRequestBatch(ctx context.Context, req *pb.ShortRequestBatch
 // GetStats retrieves the statistics of URLs and users from the App's storage.
 //
 // It takes a context and an empty protobuf message as input parameters.
-// It returns a GetStatsResponse protobuf message containing the number of URLs and users, and an error if any.
+// It returns a GetStatsResponse protobuf message containing the number of URLs and users and the number
+// of the queued deletions, and an error if any.
 func (app *App) GetStats(ctx context.Context, _ *emptypb.Empty) (*pb.GetStatsResponse, error) {
 	logger := logger.Get()
 
-	stats, err := app.storage.GetStats()
+	stats, err := app.storage.GetStats(ctx)
 	if err != nil {
+		if code, ok := storageErrorCode(err); ok {
+			return nil, status.Error(code, err.Error())
+		}
 		logger.Error("gRPC server GetStats: cannot get stats", zap.Error(err))
 		return nil, fmt.Errorf("%w", status.Error(codes.InvalidArgument, err.Error()))
 	}
 
 	return &pb.GetStatsResponse{
-		Urls:  uint32(stats.URLCount),
-		Users: uint32(stats.UserCount),
+		Urls:             uint32(stats.URLCount),
+		Users:            uint32(stats.UserCount),
+		PendingDeletions: uint32(app.deletions.depth()),
+	}, nil
+}
+
+// userIDFromMetadata returns the user ID of the API key resolved by APIKeyInterceptor
+// or of the session passed in the "token" metadata of the gRPC request.
+//
+// Without a token a new session is created if create is true, its token is sent
+// in the "token" response header just like the cookie of the HTTP API.
+//
+// Parameters:
+// - ctx: the request context carrying the incoming metadata.
+// - create: whether to create a new session for a request without a token.
+//
+// Returns:
+// - uint64: the user ID.
+// - error: a codes.Unauthenticated status if the token is missing, tampered or expired.
+func (app *App) userIDFromMetadata(ctx context.Context, create bool) (uint64, error) {
+	if userID, ok := userIDFromContext(ctx); ok {
+		return userID, nil
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if (!ok || len(md.Get("token")) == 0) && create {
+		session, userID := app.Session.AddUserSession()
+		if err := grpc.SetHeader(ctx, metadata.Pairs("token", session)); err != nil {
+			return 0, status.Error(codes.Internal, err.Error())
+		}
+		return userID, nil
+	}
+	if !ok || len(md.Get("token")) == 0 {
+		return 0, status.Error(codes.Unauthenticated, "token is missing")
+	}
+	userID, err := app.Session.GetUserSessionID(md.Get("token")[0])
+	if err != nil {
+		return 0, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return userID, nil
+}
+
+// GetURLStats retrieves the click statistics of a short URL owned by the user of the request.
+//
+// The user is identified by the "token" metadata of the request.
+// It returns codes.NotFound if the short URL does not exist or is owned by another user.
+func (app *App) GetURLStats(ctx context.Context, req *pb.GetURLStatsRequest) (*pb.GetURLStatsResponse, error) {
+	logger := logger.Get()
+
+	userID, err := app.userIDFromMetadata(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	id := strings.TrimPrefix(req.ShortUrl, app.Config.GetBaseAddr())
+	id = strings.Trim(id, "/")
+	stats, err := app.storage.GetURLStats(ctx, userID, id)
+	if err != nil {
+		if code, ok := storageErrorCode(err); ok {
+			return nil, status.Error(code, err.Error())
+		}
+		if errors.Is(err, storage.ErrURLNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		logger.Error("gRPC server GetURLStats: cannot get URL stats", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	daily := make([]*pb.GetURLStatsResponse_DailyClicks, len(stats.Daily))
+	for i, day := range stats.Daily {
+		daily[i] = &pb.GetURLStatsResponse_DailyClicks{
+			Date:   day.Date,
+			Clicks: uint32(day.Clicks),
+		}
+	}
+
+	return &pb.GetURLStatsResponse{
+		ShortUrl:       stats.ShortURL,
+		Clicks:         uint32(stats.Clicks),
+		UniqueVisitors: uint32(stats.UniqueVisitors),
+		Daily:          daily,
+	}, nil
+}
+
+// GetUserURLs retrieves all URLs of the user of the request.
+//
+// The user is identified by the "token" or "authorization" metadata of the request.
+// It returns codes.Unauthenticated without a valid identity.
+func (app *App) GetUserURLs(ctx context.Context, _ *emptypb.Empty) (*pb.GetUserURLsResponse, error) {
+	logger := logger.Get()
+
+	userID, err := app.userIDFromMetadata(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := app.storage.GetAllURLs(ctx, userID, app.Config.GetBaseAddr())
+	if err != nil {
+		if code, ok := storageErrorCode(err); ok {
+			return nil, status.Error(code, err.Error())
+		}
+		logger.Error("gRPC server GetUserURLs: cannot get user URLs", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resURLs := make([]*pb.GetUserURLsResponse_URL, len(urls))
+	for i, url := range urls {
+		resURLs[i] = &pb.GetUserURLsResponse_URL{
+			ShortUrl:    url.Result,
+			OriginalUrl: url.URL,
+		}
+	}
+
+	return &pb.GetUserURLsResponse{
+		Urls: resURLs,
+	}, nil
+}
+
+// DeleteUserURLs queues the deletion of the URLs of the user of the request.
+//
+// The short URLs can be passed as full URLs or as their IDs. The deletion is asynchronous
+// like the one of the HTTP API, URLs owned by other users are ignored.
+// It returns codes.Unauthenticated without a valid identity, codes.Unavailable on shutdown
+// and codes.Internal if the deletion cannot be journaled.
+func (app *App) DeleteUserURLs(ctx context.Context, req *pb.DeleteUserURLsRequest) (*pb.DeleteUserURLsResponse, error) {
+	userID, err := app.userIDFromMetadata(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(req.ShortUrls))
+	for _, url := range req.ShortUrls {
+		id := strings.TrimPrefix(url, app.Config.GetBaseAddr())
+		ids = append(ids, strings.Trim(id, "/"))
+	}
+	err = app.queueDeletion(userID, ids)
+	if errors.Is(err, ErrShuttingDown) {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		logger.Get().Error("gRPC server DeleteUserURLs: cannot queue deletion", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.DeleteUserURLsResponse{
+		Accepted: uint32(len(req.ShortUrls)),
 	}, nil
 }
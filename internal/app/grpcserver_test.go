@@ -0,0 +1,411 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/stsg/shorty/api/v1"
+	pbv2 "github.com/stsg/shorty/api/v2"
+	"github.com/stsg/shorty/internal/config"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+// newTestGRPCConn serves the gRPC APIs of a memory storage app over an in-memory listener.
+func newTestGRPCConn(t *testing.T) (*grpc.ClientConn, *App) {
+	t.Helper()
+
+	mStorage, _ := storage.NewMapStorage()
+	app := NewApp(config.NewConfig(), mStorage)
+
+	listener := bufconn.Listen(1024 * 1024)
+	go app.GRPCServer.grpcServer.Serve(listener)
+	t.Cleanup(app.GRPCServer.grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, &app
+}
+
+// newTestGRPCClient returns a v1 client of a memory storage app served over an in-memory listener.
+func newTestGRPCClient(t *testing.T) (pb.ShortenerServiceClient, *App) {
+	t.Helper()
+
+	conn, app := newTestGRPCConn(t)
+	return pb.NewShortenerServiceClient(conn), app
+}
+
+func TestGRPC_UserURLs(t *testing.T) {
+	client, _ := newTestGRPCClient(t)
+	ctx := context.Background()
+
+	// A request without identity creates a user and returns its token
+	var header metadata.MD
+	created, err := client.ShortRequest(ctx, &pb.ShortRequestRequest{Url: "https://example.com/grpc"}, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if created.Error != "rpc error: code = OK desc = " {
+		t.Errorf("Expected the OK status in the error field, but got %q", created.Error)
+	}
+	if len(header.Get("token")) != 1 {
+		t.Fatalf("Expected a token in the response header, but got %v", header)
+	}
+	userCtx := metadata.AppendToOutgoingContext(ctx, "token", header.Get("token")[0])
+
+	// The user keeps its identity across calls
+	_, err = client.ShortRequest(userCtx, &pb.ShortRequestRequest{Url: "https://example.com/grpc2", Alias: "grpc-two"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found, err := client.ShortID(ctx, &pb.ShortIDRequest{Url: "/grpc-two"})
+	if err != nil || found.Result != "https://example.com/grpc2" || found.Error != created.Error {
+		t.Errorf("Expected the long URL with the OK status, but got %v, %v", found, err)
+	}
+	res, err := client.GetUserURLs(userCtx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(res.Urls) != 2 {
+		t.Errorf("Expected 2 URLs, but got %v", res.Urls)
+	}
+
+	_, err = client.DeleteUserURLs(userCtx, &pb.DeleteUserURLsRequest{ShortUrls: []string{"grpc-two"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	deleted := false
+	for i := 0; i < 100 && !deleted; i++ {
+		res, _ = client.GetUserURLs(userCtx, &emptypb.Empty{})
+		deleted = len(res.Urls) == 1
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !deleted {
+		t.Errorf("Expected the URL to be deleted, but got %v", res.Urls)
+	}
+
+	for _, md := range []metadata.MD{nil, metadata.Pairs("token", "tampered")} {
+		_, err = client.GetUserURLs(metadata.NewOutgoingContext(ctx, md), &emptypb.Empty{})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Expected Unauthenticated, but got %v", err)
+		}
+	}
+}
+
+func TestGRPCV2_Statuses(t *testing.T) {
+	conn, _ := newTestGRPCConn(t)
+	client := pbv2.NewShortenerServiceClient(conn)
+	v1Client := pb.NewShortenerServiceClient(conn)
+	ctx := context.Background()
+
+	var header metadata.MD
+	res, err := client.ShortRequest(ctx, &pbv2.ShortRequestRequest{Url: "https://example.com/v2"}, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	userCtx := metadata.AppendToOutgoingContext(ctx, "token", header.Get("token")[0])
+
+	// A URL already shortened by the user is AlreadyExists carrying the existing short URL
+	_, err = client.ShortRequest(userCtx, &pbv2.ShortRequestRequest{Url: "https://example.com/v2"})
+	st := status.Convert(err)
+	if st.Code() != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists, but got %v", err)
+	}
+	var info *errdetails.ErrorInfo
+	for _, detail := range st.Details() {
+		if d, ok := detail.(*errdetails.ErrorInfo); ok {
+			info = d
+		}
+	}
+	if info == nil || info.Reason != "URL_ALREADY_SHORTENED" || info.Metadata["short_url"] != res.ShortUrl {
+		t.Errorf("Expected ErrorInfo with short URL %s, but got %v", res.ShortUrl, st.Details())
+	}
+
+	_, err = client.ShortRequest(ctx, &pbv2.ShortRequestRequest{Url: "https://example.com/bad", Alias: "a b"})
+	st = status.Convert(err)
+	if st.Code() != codes.InvalidArgument || len(st.Details()) != 1 {
+		t.Errorf("Expected InvalidArgument with a BadRequest detail, but got %v", st.Details())
+	}
+	if _, err = client.ShortID(ctx, &pbv2.ShortIDRequest{ShortUrl: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, but got %v", err)
+	}
+
+	batch, err := client.ShortRequestBatch(userCtx, &pbv2.ShortRequestBatchRequest{
+		Items: []*pbv2.ShortRequestBatchRequest_ShortRequestBatchItem{
+			{CorrelationId: "1", OriginalUrl: "https://example.com/v2"},
+			{CorrelationId: "2", OriginalUrl: "https://example.com/v2/new"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if codes.Code(batch.Items[0].Code) != codes.AlreadyExists || codes.Code(batch.Items[1].Code) != codes.OK ||
+		batch.Items[1].ShortUrl == "" {
+		t.Errorf("Expected the first item to exist and the second to be created, but got %v", batch.Items)
+	}
+	if info := itemErrorInfo(batch.Items[0].Details); info == nil || info.Reason != "URL_ALREADY_SHORTENED" ||
+		info.Metadata["short_url"] != res.ShortUrl {
+		t.Errorf("Expected the item ErrorInfo with short URL %s, but got %v", res.ShortUrl, batch.Items[0].Details)
+	}
+
+	// v1 is served side by side
+	v1Res, err := v1Client.ShortRequest(userCtx, &pb.ShortRequestRequest{Url: "https://example.com/v2"})
+	if err != nil || v1Res.Result != res.ShortUrl || v1Res.Error == "" {
+		t.Errorf("Expected v1 to report the existing URL in the error field, but got %v, %v", v1Res, err)
+	}
+}
+
+// itemErrorInfo returns the ErrorInfo of the details of a batch item, nil if there is none.
+func itemErrorInfo(details []*anypb.Any) *errdetails.ErrorInfo {
+	info := &errdetails.ErrorInfo{}
+	for _, detail := range details {
+		if detail.UnmarshalTo(info) == nil {
+			return info
+		}
+	}
+	return nil
+}
+
+func TestGRPCV2_ShortenStream(t *testing.T) {
+	conn, _ := newTestGRPCConn(t)
+	client := pbv2.NewShortenerServiceClient(conn)
+	ctx := context.Background()
+
+	stream, err := client.ShortenStream(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// A client waiting for every result is not stalled by the batching
+	err = stream.Send(&pbv2.ShortenStreamRequest{CorrelationId: "first", OriginalUrl: "https://example.com/stream"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	first, err := stream.Recv()
+	if err != nil || first.CorrelationId != "first" || codes.Code(first.Code) != codes.OK || first.ShortUrl == "" {
+		t.Fatalf("Expected the first item to be saved, but got %v, %v", first, err)
+	}
+
+	// The rest is pushed without waiting, including a duplicate
+	const items = 250
+	go func() {
+		for i := 0; i < items; i++ {
+			stream.Send(&pbv2.ShortenStreamRequest{
+				CorrelationId: strconv.Itoa(i),
+				OriginalUrl:   "https://example.com/stream/" + strconv.Itoa(i),
+			})
+		}
+		stream.Send(&pbv2.ShortenStreamRequest{CorrelationId: "duplicate", OriginalUrl: "https://example.com/stream"})
+		stream.CloseSend()
+	}()
+
+	results := make(map[string]*pbv2.ShortenStreamResponse)
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		results[res.CorrelationId] = res
+	}
+	if len(results) != items+1 {
+		t.Errorf("Expected %d results, but got %d", items+1, len(results))
+	}
+	if codes.Code(results["duplicate"].Code) != codes.AlreadyExists || results["duplicate"].ShortUrl != "" {
+		t.Errorf("Expected the duplicate to fail with AlreadyExists, but got %v", results["duplicate"])
+	}
+	if info := itemErrorInfo(results["duplicate"].Details); info == nil || info.Reason != "URL_ALREADY_SHORTENED" ||
+		info.Metadata["short_url"] != first.ShortUrl {
+		t.Errorf("Expected the item ErrorInfo with short URL %s, but got %v", first.ShortUrl, results["duplicate"].Details)
+	}
+	if codes.Code(results["0"].Code) != codes.OK || results["0"].ShortUrl == "" {
+		t.Errorf("Expected the item to be saved, but got %v", results["0"])
+	}
+}
+
+func TestGRPCV2_ShortenUpload(t *testing.T) {
+	conn, _ := newTestGRPCConn(t)
+	client := pbv2.NewShortenerServiceClient(conn)
+
+	stream, err := client.ShortenUpload(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 150; i++ {
+		// Every tenth URL is a duplicate of the previous one
+		n := i
+		if i%10 == 9 {
+			n = i - 1
+		}
+		err = stream.Send(&pbv2.ShortenUploadRequest{OriginalUrl: "https://example.com/upload/" + strconv.Itoa(n)})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil || res.Shortened != 135 || res.Failed != 15 {
+		t.Errorf("Expected 135 shortened and 15 failed items, but got %v, %v", res, err)
+	}
+}
+
+// writeTestCert issues a certificate for the template signed by the parent, or self-signed if parent is nil,
+// and writes it with its key as PEM files to the directory.
+func writeTestCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestGRPC_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"bufnet"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "importer"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	certs, err := newCertReloader(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tlsConfig, err := grpcTLSConfig(certs.GetCertificate, filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mStorage, _ := storage.NewMapStorage()
+	app := NewApp(config.NewConfig(), mStorage)
+	listener := bufconn.Listen(1024 * 1024)
+	go app.GRPCServer.grpcServer.Serve(tls.NewListener(listener, tlsConfig))
+	t.Cleanup(app.GRPCServer.grpcServer.Stop)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	getStats := func(clientTLS *tls.Config) error {
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)),
+		)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = pb.NewShortenerServiceClient(conn).GetStats(context.Background(), &emptypb.Empty{})
+		return err
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := getStats(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}); err != nil {
+		t.Errorf("Expected a client with a certificate to be served, but got %v", err)
+	}
+	if err := getStats(&tls.Config{RootCAs: roots}); err == nil {
+		t.Errorf("Expected a client without a certificate to be rejected")
+	}
+}
+
+func TestGRPC_SinglePort(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	app := NewApp(config.NewConfig(), mStorage)
+	router := chi.NewRouter()
+	router.Get("/ping", app.HandlePing)
+	srv := httptest.NewServer(app.grpcMux(router))
+	t.Cleanup(srv.Close)
+	t.Cleanup(app.GRPCServer.grpcServer.Stop)
+
+	// HTTP/1.1 reaches the router
+	res, err := http.Get(srv.URL + "/ping")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", res.StatusCode)
+	}
+
+	// gRPC over h2c reaches the gRPC server on the same port
+	conn, err := grpc.NewClient(strings.TrimPrefix(srv.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	_, err = pbv2.NewShortenerServiceClient(conn).ShortRequest(context.Background(), &pbv2.ShortRequestRequest{Url: "https://example.com/h2c"})
+	if err != nil {
+		t.Errorf("Expected gRPC to be served, but got %v", err)
+	}
+}
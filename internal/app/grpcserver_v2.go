@@ -0,0 +1,505 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/stsg/shorty/api/v1"
+	pbv2 "github.com/stsg/shorty/api/v2"
+	"github.com/stsg/shorty/internal/logger"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+// errorDomain is the domain of the errdetails.ErrorInfo details of the v2 API.
+const errorDomain = "shorty"
+
+// streamBatchSize is the maximum number of streamed items saved with a single storage batch.
+const streamBatchSize = 100
+
+// GRPCServerV2 implements the v2 gRPC ShortenerService on top of the App.
+//
+// Unlike v1 it returns failures as gRPC statuses with errdetails instead of error fields of the responses.
+// It is registered with the gRPC server of the App by NewApp side by side with v1.
+type GRPCServerV2 struct {
+	pbv2.UnimplementedShortenerServiceServer
+	app *App
+}
+
+// storageErrorStatusV2 returns the gRPC status of a storage error for the v2 API.
+//
+// Parameters:
+// - err: the error returned by the storage or by the request validation.
+// - shortURL: the full short URL of the request, reported for the errors about an existing short URL.
+// - field: the request field reported for the validation errors.
+//
+// Returns:
+// - *status.Status: the status with errdetails, codes.Internal for an unexpected error.
+func storageErrorStatusV2(err error, shortURL, field string) *status.Status {
+	if code, ok := storageErrorCode(err); ok {
+		return status.New(code, err.Error())
+	}
+
+	var st *status.Status
+	var detail *errdetails.ErrorInfo
+	switch {
+	case errors.Is(err, storage.ErrUniqueViolation):
+		st = status.New(codes.AlreadyExists, err.Error())
+		detail = &errdetails.ErrorInfo{Reason: "URL_ALREADY_SHORTENED", Metadata: map[string]string{"short_url": shortURL}}
+	case errors.Is(err, storage.ErrAliasTaken):
+		st = status.New(codes.AlreadyExists, err.Error())
+		detail = &errdetails.ErrorInfo{Reason: "ALIAS_TAKEN", Metadata: map[string]string{"short_url": shortURL}}
+	case errors.Is(err, storage.ErrAliasInvalid), errors.Is(err, storage.ErrAliasReserved),
+		errors.Is(err, storage.ErrExpirationInvalid):
+		st = status.New(codes.InvalidArgument, err.Error())
+		if withDetails, detailErr := st.WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: field, Description: err.Error()}},
+		}); detailErr == nil {
+			st = withDetails
+		}
+		return st
+	case errors.Is(err, storage.ErrURLNotFound):
+		st = status.New(codes.NotFound, err.Error())
+		detail = &errdetails.ErrorInfo{Reason: "URL_NOT_FOUND"}
+	case errors.Is(err, storage.ErrURLDeleted):
+		st = status.New(codes.NotFound, err.Error())
+		detail = &errdetails.ErrorInfo{Reason: "URL_DELETED"}
+	case errors.Is(err, storage.ErrURLExpired):
+		st = status.New(codes.NotFound, err.Error())
+		detail = &errdetails.ErrorInfo{Reason: "URL_EXPIRED"}
+	default:
+		return status.New(codes.Internal, err.Error())
+	}
+
+	detail.Domain = errorDomain
+	if withDetails, detailErr := st.WithDetails(detail); detailErr == nil {
+		st = withDetails
+	}
+	return st
+}
+
+// expirationField returns the name of the expiration field set in the request for the validation errors.
+func expirationField(hasExpiresAt bool) string {
+	if hasExpiresAt {
+		return "expires_at"
+	}
+	return "ttl"
+}
+
+// ShortRequest handles the request to save a URL and generates a short URL.
+//
+// An already shortened URL or a taken alias is reported as codes.AlreadyExists
+// with the existing short URL in the "short_url" metadata of the errdetails.ErrorInfo detail.
+func (s *GRPCServerV2) ShortRequest(ctx context.Context, req *pbv2.ShortRequestRequest) (*pbv2.ShortRequestResponse, error) {
+	app := s.app
+
+	var shortURL string
+
+	reqExpiresAt, reqTTL := expirationFromProto(req.ExpiresAt, req.Ttl)
+	expiresAt, err := storage.ExpirationTime(reqExpiresAt, reqTTL, time.Now())
+	if err != nil {
+		return nil, storageErrorStatusV2(err, "", expirationField(req.ExpiresAt != nil)).Err()
+	}
+
+	userID, err := app.userIDFromMetadata(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if req.Alias != "" {
+		err = storage.ValidateAlias(req.Alias)
+		if err != nil {
+			return nil, storageErrorStatusV2(err, "", "alias").Err()
+		}
+		shortURL, err = app.storage.SaveAlias(ctx, userID, req.Alias, req.Url, expiresAt)
+	} else {
+		shortURL, err = app.storage.GetShortURL(ctx, userID, req.Url, expiresAt)
+	}
+	result := app.Config.GetBaseAddr() + "/" + shortURL
+	if err != nil {
+		st := storageErrorStatusV2(err, result, "")
+		if st.Code() == codes.Internal {
+			logger.Get().Error("gRPC server v2 ShortRequest: cannot get short URL", zap.Error(err))
+		}
+		return nil, st.Err()
+	}
+
+	return &pbv2.ShortRequestResponse{
+		ShortUrl: result,
+	}, nil
+}
+
+// ShortID retrieves the long URL associated with the given short URL or its ID.
+//
+// A missing, deleted or expired short URL is reported as codes.NotFound.
+func (s *GRPCServerV2) ShortID(ctx context.Context, req *pbv2.ShortIDRequest) (*pbv2.ShortIDResponse, error) {
+	app := s.app
+
+	id := strings.TrimPrefix(req.ShortUrl, app.Config.GetBaseAddr())
+	id = strings.Trim(id, "/")
+	longURL, err := app.storage.GetRealURL(ctx, id)
+	if err != nil {
+		st := storageErrorStatusV2(err, "", "")
+		if st.Code() == codes.Internal {
+			logger.Get().Error("gRPC server v2 ShortID: cannot get long URL", zap.Error(err))
+		}
+		return nil, st.Err()
+	}
+
+	return &pbv2.ShortIDResponse{
+		OriginalUrl: longURL,
+	}, nil
+}
+
+// ShortRequestBatch handles the request to save a batch of URLs and generates short URLs.
+//
+// The failures of single items are reported by the code and message of the items,
+// a failure of the whole batch is reported as the status of the call.
+func (s *GRPCServerV2) ShortRequestBatch(ctx context.Context, req *pbv2.ShortRequestBatchRequest) (*pbv2.ShortRequestBatchResponse, error) {
+	app := s.app
+
+	userID, err := app.userIDFromMetadata(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rqJSON := make([]storage.ReqJSONBatch, len(req.Items))
+	for i, item := range req.Items {
+		expiresAt, ttl := expirationFromProto(item.ExpiresAt, item.Ttl)
+		rqJSON[i] = storage.ReqJSONBatch{
+			ID:        item.CorrelationId,
+			URL:       item.OriginalUrl,
+			Alias:     item.Alias,
+			ExpiresAt: expiresAt,
+			TTL:       ttl,
+		}
+	}
+
+	rwJSON, err := app.storage.GetShortURLBatch(ctx, userID, app.Config.GetBaseAddr(), rqJSON)
+	if err != nil {
+		st := storageErrorStatusV2(err, "", "")
+		if st.Code() == codes.Internal {
+			logger.Get().Error("gRPC server v2 ShortRequestBatch: cannot get short URL batch", zap.Error(err))
+		}
+		return nil, st.Err()
+	}
+
+	resItems := make([]*pbv2.ShortRequestBatchResponse_ShortRequestBatchItem, len(rwJSON))
+	for i, item := range rwJSON {
+		shortURL, st := batchItemResult(item)
+		resItems[i] = &pbv2.ShortRequestBatchResponse_ShortRequestBatchItem{
+			CorrelationId: item.ID,
+			ShortUrl:      shortURL,
+			Code:          int32(st.Code()),
+			Message:       st.Message(),
+			Details:       st.Proto().GetDetails(),
+		}
+	}
+
+	return &pbv2.ShortRequestBatchResponse{
+		Items: resItems,
+	}, nil
+}
+
+// batchItemResult returns the result of a batch item in the form of the v2 API.
+//
+// Returns:
+// - string: the short URL, empty if the item failed.
+// - *status.Status: the status of the item with its code, message and details, codes.OK if the item succeeded.
+func batchItemResult(item storage.ResJSONBatch) (string, *status.Status) {
+	if item.Err == nil {
+		return item.Result, status.New(codes.OK, "")
+	}
+	return "", storageErrorStatusV2(item.Err, item.Existing, "")
+}
+
+// ShortenStream creates short URLs of the streamed items and streams their results back.
+//
+// The items are received in the background into a buffer of streamBatchSize items,
+// a full buffer stops the receiving, so the gRPC flow control slows the client down to the pace of the storage.
+// The buffered items are saved with a single storage batch as soon as at least one item is available,
+// so a client waiting for the result of an item before sending the next one is never stalled.
+// The failures of single items are reported by the code, message and details of their results,
+// a storage failure ends the stream with its status.
+func (s *GRPCServerV2) ShortenStream(stream pbv2.ShortenerService_ShortenStreamServer) error {
+	app := s.app
+	ctx := stream.Context()
+
+	userID, err := app.userIDFromMetadata(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	items := make(chan *pbv2.ShortenStreamRequest, streamBatchSize)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(items)
+		for {
+			item, err := stream.Recv()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					recvErr <- err
+				}
+				return
+			}
+			select {
+			case items <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		batch, ok := nextStreamBatch(items)
+		if !ok {
+			break
+		}
+		rqJSON := make([]storage.ReqJSONBatch, len(batch))
+		for i, item := range batch {
+			expiresAt, ttl := expirationFromProto(item.ExpiresAt, item.Ttl)
+			rqJSON[i] = storage.ReqJSONBatch{
+				ID:        item.CorrelationId,
+				URL:       item.OriginalUrl,
+				Alias:     item.Alias,
+				ExpiresAt: expiresAt,
+				TTL:       ttl,
+			}
+		}
+
+		rwJSON, err := app.storage.GetShortURLBatch(ctx, userID, app.Config.GetBaseAddr(), rqJSON)
+		if err != nil {
+			st := storageErrorStatusV2(err, "", "")
+			if st.Code() == codes.Internal {
+				logger.Get().Error("gRPC server v2 ShortenStream: cannot get short URL batch", zap.Error(err))
+			}
+			return st.Err()
+		}
+		for _, item := range rwJSON {
+			shortURL, st := batchItemResult(item)
+			err := stream.Send(&pbv2.ShortenStreamResponse{
+				CorrelationId: item.ID,
+				ShortUrl:      shortURL,
+				Code:          int32(st.Code()),
+				Message:       st.Message(),
+				Details:       st.Proto().GetDetails(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	select {
+	case err := <-recvErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// nextStreamBatch returns the items available in the channel, up to streamBatchSize.
+//
+// It waits for the first item only, the rest of the batch is taken without waiting.
+//
+// Returns:
+// - []*pbv2.ShortenStreamRequest: the batch of items.
+// - bool: false if the channel is closed and drained.
+func nextStreamBatch(items <-chan *pbv2.ShortenStreamRequest) ([]*pbv2.ShortenStreamRequest, bool) {
+	item, ok := <-items
+	if !ok {
+		return nil, false
+	}
+	batch := []*pbv2.ShortenStreamRequest{item}
+	for len(batch) < streamBatchSize {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				return batch, true
+			}
+			batch = append(batch, item)
+		default:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+// ShortenUpload creates short URLs of the streamed items and returns the number of saved and failed items.
+//
+// The items are saved with storage batches of streamBatchSize items while receiving,
+// the client is slowed down by the gRPC flow control while a batch is saved.
+// A storage failure ends the stream with its status, the batches saved before are kept.
+func (s *GRPCServerV2) ShortenUpload(stream pbv2.ShortenerService_ShortenUploadServer) error {
+	app := s.app
+	ctx := stream.Context()
+
+	userID, err := app.userIDFromMetadata(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	var res pbv2.ShortenUploadResponse
+	rqJSON := make([]storage.ReqJSONBatch, 0, streamBatchSize)
+	flush := func() error {
+		if len(rqJSON) == 0 {
+			return nil
+		}
+		rwJSON, err := app.storage.GetShortURLBatch(ctx, userID, app.Config.GetBaseAddr(), rqJSON)
+		if err != nil {
+			st := storageErrorStatusV2(err, "", "")
+			if st.Code() == codes.Internal {
+				logger.Get().Error("gRPC server v2 ShortenUpload: cannot get short URL batch", zap.Error(err))
+			}
+			return st.Err()
+		}
+		for _, item := range rwJSON {
+			if item.Err != nil {
+				res.Failed++
+			} else {
+				res.Shortened++
+			}
+		}
+		rqJSON = rqJSON[:0]
+		return nil
+	}
+
+	for {
+		item, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		expiresAt, ttl := expirationFromProto(item.ExpiresAt, item.Ttl)
+		rqJSON = append(rqJSON, storage.ReqJSONBatch{
+			URL:       item.OriginalUrl,
+			Alias:     item.Alias,
+			ExpiresAt: expiresAt,
+			TTL:       ttl,
+		})
+		if len(rqJSON) == streamBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&res)
+}
+
+// GetStats retrieves the number of URLs and users and the number of the queued deletions.
+func (s *GRPCServerV2) GetStats(ctx context.Context, _ *emptypb.Empty) (*pbv2.GetStatsResponse, error) {
+	stats, err := s.app.storage.GetStats(ctx)
+	if err != nil {
+		st := storageErrorStatusV2(err, "", "")
+		if st.Code() == codes.Internal {
+			logger.Get().Error("gRPC server v2 GetStats: cannot get stats", zap.Error(err))
+		}
+		return nil, st.Err()
+	}
+
+	return &pbv2.GetStatsResponse{
+		Urls:             uint32(stats.URLCount),
+		Users:            uint32(stats.UserCount),
+		PendingDeletions: uint32(s.app.deletions.depth()),
+	}, nil
+}
+
+// GetURLStats retrieves the click statistics of a short URL owned by the user of the request.
+//
+// It returns codes.NotFound if the short URL does not exist or is owned by another user.
+func (s *GRPCServerV2) GetURLStats(ctx context.Context, req *pbv2.GetURLStatsRequest) (*pbv2.GetURLStatsResponse, error) {
+	app := s.app
+
+	userID, err := app.userIDFromMetadata(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	id := strings.TrimPrefix(req.ShortUrl, app.Config.GetBaseAddr())
+	id = strings.Trim(id, "/")
+	stats, err := app.storage.GetURLStats(ctx, userID, id)
+	if err != nil {
+		st := storageErrorStatusV2(err, "", "")
+		if st.Code() == codes.Internal {
+			logger.Get().Error("gRPC server v2 GetURLStats: cannot get URL stats", zap.Error(err))
+		}
+		return nil, st.Err()
+	}
+
+	daily := make([]*pbv2.GetURLStatsResponse_DailyClicks, len(stats.Daily))
+	for i, day := range stats.Daily {
+		daily[i] = &pbv2.GetURLStatsResponse_DailyClicks{
+			Date:   day.Date,
+			Clicks: uint32(day.Clicks),
+		}
+	}
+
+	return &pbv2.GetURLStatsResponse{
+		ShortUrl:       stats.ShortURL,
+		Clicks:         uint32(stats.Clicks),
+		UniqueVisitors: uint32(stats.UniqueVisitors),
+		Daily:          daily,
+	}, nil
+}
+
+// GetUserURLs retrieves all URLs of the user of the request.
+//
+// It returns codes.Unauthenticated without a valid identity.
+func (s *GRPCServerV2) GetUserURLs(ctx context.Context, _ *emptypb.Empty) (*pbv2.GetUserURLsResponse, error) {
+	app := s.app
+
+	userID, err := app.userIDFromMetadata(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := app.storage.GetAllURLs(ctx, userID, app.Config.GetBaseAddr())
+	if err != nil {
+		st := storageErrorStatusV2(err, "", "")
+		if st.Code() == codes.Internal {
+			logger.Get().Error("gRPC server v2 GetUserURLs: cannot get user URLs", zap.Error(err))
+		}
+		return nil, st.Err()
+	}
+
+	resURLs := make([]*pbv2.GetUserURLsResponse_URL, len(urls))
+	for i, url := range urls {
+		resURLs[i] = &pbv2.GetUserURLsResponse_URL{
+			ShortUrl:    url.Result,
+			OriginalUrl: url.URL,
+		}
+	}
+
+	return &pbv2.GetUserURLsResponse{
+		Urls: resURLs,
+	}, nil
+}
+
+// DeleteUserURLs queues the deletion of the URLs of the user of the request.
+//
+// The deletion is asynchronous, URLs owned by other users are ignored.
+// It returns codes.Unauthenticated without a valid identity, codes.Unavailable on shutdown
+// and codes.Internal if the deletion cannot be journaled.
+func (s *GRPCServerV2) DeleteUserURLs(ctx context.Context, req *pbv2.DeleteUserURLsRequest) (*pbv2.DeleteUserURLsResponse, error) {
+	res, err := s.app.DeleteUserURLs(ctx, &pb.DeleteUserURLsRequest{ShortUrls: req.ShortUrls})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pbv2.DeleteUserURLsResponse{
+		Accepted: res.Accepted,
+	}, nil
+}
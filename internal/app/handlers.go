@@ -4,12 +4,78 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/stsg/shorty/internal/logger"
 	"github.com/stsg/shorty/internal/storage"
 )
 
+// StatusClientClosedRequest is the non-standard status code reported when the client went away
+// before the storage finished its work.
+const StatusClientClosedRequest = 499
+
+// storageErrorStatus returns the HTTP status code for storage errors caused by a done request context.
+//
+// Parameters:
+// - err: the error returned by the storage.
+//
+// Returns:
+// - int: StatusClientClosedRequest for a canceled request, http.StatusGatewayTimeout for an expired deadline.
+// - bool: false if err is not a context related storage error.
+func storageErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, storage.ErrRequestCanceled):
+		return StatusClientClosedRequest, true
+	case errors.Is(err, storage.ErrDeadlineExceeded):
+		return http.StatusGatewayTimeout, true
+	}
+	return 0, false
+}
+
+// sessionUserID returns the user ID of the API key resolved by APIKeyAuth
+// or of the session token cookie of the request.
+//
+// Without a cookie a new session is created and set on the response if create is true,
+// otherwise the request is rejected. A tampered or expired token is always rejected.
+//
+// Parameters:
+// - rw: the response writer, http.StatusUnauthorized is written to it when the request is rejected.
+// - req: the request.
+// - create: whether to create a new session for a request without a cookie.
+//
+// Returns:
+// - uint64: the user ID.
+// - bool: false if the request was rejected.
+func (app *App) sessionUserID(rw http.ResponseWriter, req *http.Request, create bool) (uint64, bool) {
+	if userID, ok := userIDFromContext(req.Context()); ok {
+		return userID, true
+	}
+	userIDToken, err := req.Cookie("token")
+	if err != nil && create {
+		session, userID := app.Session.AddUserSession()
+		app.SetSession(rw, session)
+		return userID, true
+	}
+	if err == nil {
+		var userID uint64
+		userID, err = app.Session.GetUserSessionID(userIDToken.Value)
+		if err == nil {
+			return userID, true
+		}
+	}
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusUnauthorized)
+	rw.Write([]byte(err.Error()))
+	return 0, false
+}
+
 // HandlePing handles the ping request.
 //
 // It takes in the http.ResponseWriter and *http.Request as parameters.
@@ -17,7 +83,13 @@ import (
 func (app *App) HandlePing(rw http.ResponseWriter, req *http.Request) {
 	ping := strings.TrimPrefix(req.URL.Path, "/")
 	ping = strings.TrimSuffix(ping, "/")
-	if !app.storage.IsReady() {
+	if app.isDraining() {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte(ErrShuttingDown.Error()))
+		return
+	}
+	if !app.storage.IsReady(req.Context()) {
 		rw.Header().Set("Content-Type", "text/plain")
 		rw.WriteHeader(http.StatusInternalServerError)
 		http.Error(rw, "storage not ready", http.StatusInternalServerError)
@@ -38,8 +110,14 @@ func (app *App) HandlePing(rw http.ResponseWriter, req *http.Request) {
 func (app *App) HandleShortID(rw http.ResponseWriter, req *http.Request) {
 	id := strings.TrimPrefix(req.URL.Path, "/")
 	id = strings.TrimSuffix(id, "/")
-	longURL, err := app.storage.GetRealURL(id)
-	if errors.Is(err, storage.ErrURLDeleted) {
+	longURL, err := app.storage.GetRealURL(req.Context(), id)
+	if code, ok := storageErrorStatus(err); ok {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(code)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, storage.ErrURLDeleted) || errors.Is(err, storage.ErrURLExpired) {
 		rw.Header().Set("Content-Type", "text/plain")
 		rw.WriteHeader(http.StatusGone)
 		http.Error(rw, err.Error(), http.StatusGone)
@@ -52,18 +130,58 @@ func (app *App) HandleShortID(rw http.ResponseWriter, req *http.Request) {
 		return
 
 	}
+	app.recordClick(req, id)
 	rw.Header().Set("Location", longURL)
 	rw.WriteHeader(http.StatusTemporaryRedirect)
 	rw.Write([]byte(longURL))
 }
 
+// recordClick queues a click on the short URL for asynchronous saving.
+//
+// The click is dropped if the queue is full so that a slow storage never delays the redirect,
+// or if the queue is already closed on shutdown.
+func (app *App) recordClick(req *http.Request, shortURL string) {
+	click := storage.Click{
+		ShortURL:  shortURL,
+		Time:      time.Now().UTC(),
+		Referrer:  req.Referer(),
+		UserAgent: req.UserAgent(),
+		IPPrefix:  ipPrefix(req.RemoteAddr),
+	}
+	app.queues.mu.RLock()
+	defer app.queues.mu.RUnlock()
+	if app.queues.closed {
+		return
+	}
+	select {
+	case app.clickChan <- click:
+	default:
+		logger.Get().Warn("click queue is full, click dropped", zap.String("short_url", shortURL))
+	}
+}
+
+// ipPrefix returns the network of the client address: /24 for IPv4 and /48 for IPv6.
+//
+// An empty string is returned if the address cannot be parsed.
+func ipPrefix(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
 // HandleShortRequest handles the short URL request and generates a short URL for the given long URL.
 //
 // The parameters are rw for http.ResponseWriter and req for http.Request. It does not return anything.
 func (app *App) HandleShortRequest(rw http.ResponseWriter, req *http.Request) {
-	var userID uint64
-	var session string
-
 	url, err := io.ReadAll(req.Body)
 	if err != nil {
 		rw.Header().Set("Content-Type", "text/plain")
@@ -80,17 +198,19 @@ func (app *App) HandleShortRequest(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	userIDToken, err := req.Cookie("token")
-	if err != nil {
-		session, userID = app.Session.AddUserSession()
-		app.SetSession(rw, session)
-	} else {
-		userID = app.Session.GetUserSessionID(userIDToken.Value)
+	userID, ok := app.sessionUserID(rw, req, true)
+	if !ok {
+		return
 	}
 
-	shortURL, err := app.storage.GetShortURL(userID, longURL)
+	shortURL, err := app.storage.GetShortURL(req.Context(), userID, longURL, time.Time{})
 	if err != nil {
 		rw.Header().Set("Content-Type", "text/plain")
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+			rw.Write([]byte(err.Error()))
+			return
+		}
 		if errors.Is(err, storage.ErrUniqueViolation) {
 			rw.WriteHeader(http.StatusConflict)
 			rw.Write([]byte(app.Config.GetBaseAddr() + "/" + shortURL))
@@ -107,14 +227,16 @@ func (app *App) HandleShortRequest(rw http.ResponseWriter, req *http.Request) {
 
 // HandleShortRequestJSON handles short request JSON and generates a short URL.
 //
+// If the request has an alias, it is used as the short URL instead of a generated one.
+// The optional expires_at or ttl (in seconds) limit the lifetime of the short URL.
+// A taken alias is reported with http.StatusConflict and the short URL already using it.
+//
 // Parameters:
 // - rw: http.ResponseWriter for writing response.
 // - req: *http.Request for incoming request.
 func (app *App) HandleShortRequestJSON(rw http.ResponseWriter, req *http.Request) {
 	var rqJSON storage.ReqJSON
 	var rwJSON storage.ResJSON
-	var userID uint64
-	var session string
 
 	url, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -132,19 +254,43 @@ func (app *App) HandleShortRequestJSON(rw http.ResponseWriter, req *http.Request
 		return
 	}
 
-	userIDToken, err := req.Cookie("token")
-	if err == nil {
-		userID = app.Session.GetUserSessionID(userIDToken.Value)
-	} else {
-		session, userID = app.Session.AddUserSession()
-		app.SetSession(rw, session)
+	userID, ok := app.sessionUserID(rw, req, true)
+	if !ok {
+		return
+	}
+
+	expiresAt, err := storage.ExpirationTime(rqJSON.ExpiresAt, rqJSON.TTL, time.Now())
+	if err != nil {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusBadRequest)
+		body, _ := json.Marshal(map[string]string{"error": err.Error()})
+		rw.Write([]byte(body))
+		return
 	}
 
-	rwJSON.Result, err = app.storage.GetShortURL(userID, rqJSON.URL)
+	if rqJSON.Alias != "" {
+		err = storage.ValidateAlias(rqJSON.Alias)
+		if err != nil {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusBadRequest)
+			body, _ := json.Marshal(map[string]string{"error": err.Error()})
+			rw.Write([]byte(body))
+			return
+		}
+		rwJSON.Result, err = app.storage.SaveAlias(req.Context(), userID, rqJSON.Alias, rqJSON.URL, expiresAt)
+	} else {
+		rwJSON.Result, err = app.storage.GetShortURL(req.Context(), userID, rqJSON.URL, expiresAt)
+	}
 	rwJSON.Result = app.Config.GetBaseAddr() + "/" + rwJSON.Result
 	if err != nil {
 		rw.Header().Set("Content-Type", "application/json")
-		if errors.Is(err, storage.ErrUniqueViolation) {
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+			body, _ := json.Marshal(map[string]string{"error": err.Error()})
+			rw.Write([]byte(body))
+			return
+		}
+		if errors.Is(err, storage.ErrUniqueViolation) || errors.Is(err, storage.ErrAliasTaken) {
 			rw.WriteHeader(http.StatusConflict)
 			body, _ := json.Marshal(rwJSON)
 			rw.Write([]byte(body))
@@ -170,8 +316,6 @@ func (app *App) HandleShortRequestJSON(rw http.ResponseWriter, req *http.Request
 //	req *http.Request - the http request containing the JSON batch.
 func (app *App) HandleShortRequestJSONBatch(rw http.ResponseWriter, req *http.Request) {
 	var rqJSON []storage.ReqJSONBatch
-	var userID uint64
-	var session string
 
 	url, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -189,18 +333,19 @@ func (app *App) HandleShortRequestJSONBatch(rw http.ResponseWriter, req *http.Re
 		return
 	}
 
-	userIDToken, err := req.Cookie("token")
-	if err == nil {
-		userID = app.Session.GetUserSessionID(userIDToken.Value)
-	} else {
-		session, userID = app.Session.AddUserSession()
-		app.SetSession(rw, session)
+	userID, ok := app.sessionUserID(rw, req, true)
+	if !ok {
+		return
 	}
 
-	rwJSON, err := app.storage.GetShortURLBatch(userID, app.Config.GetBaseAddr(), rqJSON)
+	rwJSON, err := app.storage.GetShortURLBatch(req.Context(), userID, app.Config.GetBaseAddr(), rqJSON)
 	if err != nil {
 		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusBadRequest)
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+		} else {
+			rw.WriteHeader(http.StatusBadRequest)
+		}
 		body, _ := json.Marshal(map[string]string{"error": err.Error()})
 		rw.Write([]byte(body))
 		return
@@ -216,22 +361,19 @@ func (app *App) HandleShortRequestJSONBatch(rw http.ResponseWriter, req *http.Re
 // It takes in the http.ResponseWriter and http.Request as parameters.
 // It does not return any value.
 func (app *App) HandleGetAllURLs(rw http.ResponseWriter, req *http.Request) {
-	var resJSON []storage.ResJSONURL
-	var userID uint64
-
-	userIDToken, err := req.Cookie("token")
-	if err == nil {
-		userID = app.Session.GetUserSessionID(userIDToken.Value)
-	} else {
-		rw.Header().Set("Content-Type", "text/plain")
-		rw.WriteHeader(http.StatusUnauthorized)
-		http.Error(rw, err.Error(), http.StatusGone)
+	userID, ok := app.sessionUserID(rw, req, false)
+	if !ok {
 		return
 	}
 
-	resJSON, err = app.storage.GetAllURLs(userID, app.Config.GetBaseAddr())
+	resJSON, err := app.storage.GetAllURLs(req.Context(), userID, app.Config.GetBaseAddr())
 	if err != nil {
 		rw.Header().Set("Content-Type", "text/plain")
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+			rw.Write([]byte(err.Error()))
+			return
+		}
 		rw.WriteHeader(http.StatusInternalServerError)
 		http.Error(rw, err.Error(), http.StatusGone)
 		return
@@ -248,6 +390,37 @@ func (app *App) HandleGetAllURLs(rw http.ResponseWriter, req *http.Request) {
 	rw.Write([]byte(body))
 }
 
+// HandleURLStats handles the GET request to retrieve the click stats of a user's short URL.
+//
+// It takes in the http.ResponseWriter and http.Request as parameters.
+// It responds with http.StatusUnauthorized without a session and http.StatusNotFound
+// if the short URL does not exist or is owned by another user.
+func (app *App) HandleURLStats(rw http.ResponseWriter, req *http.Request) {
+	userID, ok := app.sessionUserID(rw, req, false)
+	if !ok {
+		return
+	}
+
+	resJSON, err := app.storage.GetURLStats(req.Context(), userID, chi.URLParam(req, "id"))
+	if err != nil {
+		rw.Header().Set("Content-Type", "application/json")
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+		} else if errors.Is(err, storage.ErrURLNotFound) {
+			rw.WriteHeader(http.StatusNotFound)
+		} else {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+		body, _ := json.Marshal(map[string]string{"error": err.Error()})
+		rw.Write([]byte(body))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.MarshalIndent(resJSON, "", "    ")
+	rw.Write([]byte(body))
+}
+
 // HandleDeleteURLs handles the deletion of URLs.
 //
 // It takes in an http.ResponseWriter and an http.Request as parameters.
@@ -255,7 +428,6 @@ func (app *App) HandleGetAllURLs(rw http.ResponseWriter, req *http.Request) {
 // If there is an error reading the request body, it sets the response header to "text/plain" and writes the error message with a status code of http.StatusInternal
 func (app *App) HandleDeleteURLs(rw http.ResponseWriter, req *http.Request) {
 	var delURLs []string
-	var userID uint64
 
 	urls, err := io.ReadAll(req.Body)
 	if err != nil {
@@ -272,23 +444,22 @@ func (app *App) HandleDeleteURLs(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	userIDToken, err := req.Cookie("token")
-	if err != nil {
-		rw.Header().Set("Content-Type", "text/plain")
-		rw.WriteHeader(http.StatusUnauthorized)
-		http.Error(rw, err.Error(), http.StatusGone)
+	userID, ok := app.sessionUserID(rw, req, false)
+	if !ok {
 		return
-
 	}
-	userID = app.Session.GetUserSessionID(userIDToken.Value)
-
-	for _, url := range delURLs {
-		go func(url string, userID uint64) {
-			app.delChan <- map[string]uint64{
-				url: userID,
-			}
-		}(url, userID)
 
+	err = app.queueDeletion(userID, delURLs)
+	if err != nil {
+		rw.Header().Set("Content-Type", "text/plain")
+		if errors.Is(err, ErrShuttingDown) {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			logger.Get().Error("cannot queue deletion", zap.Error(err))
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+		rw.Write([]byte(err.Error()))
+		return
 	}
 
 	rw.Header().Set("Content-Type", "text/plain")
@@ -298,7 +469,7 @@ func (app *App) HandleDeleteURLs(rw http.ResponseWriter, req *http.Request) {
 
 // HandleInternalStats handles the internal stats request.
 //
-// It retrieves the statistics from the storage and sends them as a JSON response.
+// It retrieves the statistics from the storage, adds the number of the queued deletions and sends them as a JSON response.
 // If there is an error retrieving the statistics, it sends a JSON response with the error message.
 //
 // Parameters:
@@ -307,16 +478,171 @@ func (app *App) HandleDeleteURLs(rw http.ResponseWriter, req *http.Request) {
 //
 // Return type: None.
 func (app *App) HandleInternalStats(rw http.ResponseWriter, req *http.Request) {
-	resJSON, err := app.storage.GetStats()
+	resJSON, err := app.storage.GetStats(req.Context())
 	if err != nil {
 		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusBadRequest)
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+		} else {
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+		body, _ := json.Marshal(map[string]string{"error": err.Error()})
+		rw.Write([]byte(body))
+		return
+	}
+	resJSON.PendingDeletions = app.deletions.depth()
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.MarshalIndent(resJSON, "", "    ")
+	rw.Write([]byte(body))
+}
+
+// HandleCreateAPIKey handles the POST request to create an API key for the user.
+//
+// The request body may hold the name of the key. The key itself is only returned in this response,
+// the storage keeps its hash. A request without a session creates a new user, just like shortening does.
+//
+// Parameters:
+// - rw: http.ResponseWriter for writing response.
+// - req: *http.Request for incoming request.
+func (app *App) HandleCreateAPIKey(rw http.ResponseWriter, req *http.Request) {
+	var rqJSON storage.ReqJSONAPIKey
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &rqJSON)
+		if err != nil {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusBadRequest)
+			body, _ := json.Marshal(map[string]string{"error": err.Error()})
+			rw.Write([]byte(body))
+			return
+		}
+	}
+
+	userID, ok := app.sessionUserID(rw, req, true)
+	if !ok {
+		return
+	}
+
+	key, err := GenerateAPIKey()
+	if err != nil {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	apiKey := storage.APIKey{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Hash:      HashAPIKey(key),
+		Name:      rqJSON.Name,
+		CreatedAt: time.Now().UTC(),
+	}
+	err = app.storage.SaveAPIKey(req.Context(), apiKey)
+	if err != nil {
+		rw.Header().Set("Content-Type", "application/json")
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+		} else {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+		body, _ := json.Marshal(map[string]string{"error": err.Error()})
+		rw.Write([]byte(body))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	body, _ = json.Marshal(storage.ResJSONAPIKey{
+		ID:        apiKey.ID,
+		Name:      apiKey.Name,
+		Key:       key,
+		CreatedAt: apiKey.CreatedAt,
+	})
+	rw.Write([]byte(body))
+}
+
+// HandleGetAPIKeys handles the GET request to list the API keys of the user.
+//
+// The keys themselves are never returned, only their IDs, names, creation and last use times.
+//
+// Parameters:
+// - rw: http.ResponseWriter for writing response.
+// - req: *http.Request for incoming request.
+func (app *App) HandleGetAPIKeys(rw http.ResponseWriter, req *http.Request) {
+	userID, ok := app.sessionUserID(rw, req, false)
+	if !ok {
+		return
+	}
+
+	keys, err := app.storage.GetAPIKeys(req.Context(), userID)
+	if err != nil {
+		rw.Header().Set("Content-Type", "application/json")
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+		} else {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
 		body, _ := json.Marshal(map[string]string{"error": err.Error()})
 		rw.Write([]byte(body))
 		return
 	}
+	if len(keys) == 0 {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusNoContent)
+		rw.Write([]byte("no content for this user"))
+		return
+	}
+
+	resJSON := make([]storage.ResJSONAPIKey, 0, len(keys))
+	for _, key := range keys {
+		resJSON = append(resJSON, storage.ResJSONAPIKey{
+			ID:         key.ID,
+			Name:       key.Name,
+			CreatedAt:  key.CreatedAt,
+			LastUsedAt: key.LastUsedAt,
+		})
+	}
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
 	body, _ := json.MarshalIndent(resJSON, "", "    ")
 	rw.Write([]byte(body))
 }
+
+// HandleRevokeAPIKey handles the DELETE request to revoke an API key of the user.
+//
+// It responds with http.StatusNoContent when the key is revoked and http.StatusNotFound
+// if the key does not exist or is owned by another user.
+//
+// Parameters:
+// - rw: http.ResponseWriter for writing response.
+// - req: *http.Request for incoming request.
+func (app *App) HandleRevokeAPIKey(rw http.ResponseWriter, req *http.Request) {
+	userID, ok := app.sessionUserID(rw, req, false)
+	if !ok {
+		return
+	}
+
+	err := app.storage.RevokeAPIKey(req.Context(), userID, chi.URLParam(req, "id"))
+	if err != nil {
+		rw.Header().Set("Content-Type", "application/json")
+		if code, ok := storageErrorStatus(err); ok {
+			rw.WriteHeader(code)
+		} else if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			rw.WriteHeader(http.StatusNotFound)
+		} else {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+		body, _ := json.Marshal(map[string]string{"error": err.Error()})
+		rw.Write([]byte(body))
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "github.com/stsg/shorty/api/v1"
+	pbv2 "github.com/stsg/shorty/api/v2"
+	mylogger "github.com/stsg/shorty/internal/logger"
+)
+
+// healthCheckInterval is the interval between the storage readiness checks reported by the gRPC health service.
+const healthCheckInterval = 5 * time.Second
+
+// healthServices are the names the serving status is reported for, the empty name stands for the whole server.
+var healthServices = []string{
+	"",
+	pb.ShortenerService_ServiceDesc.ServiceName,
+	pbv2.ShortenerService_ServiceDesc.ServiceName,
+}
+
+// enableHealth registers the grpc.health.v1.Health service with the gRPC server of the App
+// and reports the current readiness of the storage.
+func (app *App) enableHealth() {
+	app.GRPCServer.health = health.NewServer()
+	healthpb.RegisterHealthServer(app.GRPCServer.grpcServer, app.GRPCServer.health)
+	app.updateHealth(context.Background())
+}
+
+// updateHealth reports SERVING if the storage is ready and NOT_SERVING otherwise.
+//
+// After the health service is shut down the status stays NOT_SERVING whatever the storage readiness is.
+//
+// Returns:
+// - bool: the readiness of the storage.
+func (app *App) updateHealth(ctx context.Context) bool {
+	ready := app.storage.IsReady(ctx)
+	if app.GRPCServer.health == nil {
+		return ready
+	}
+
+	status := healthpb.HealthCheckResponse_SERVING
+	if !ready {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	for _, service := range healthServices {
+		app.GRPCServer.health.SetServingStatus(service, status)
+	}
+	return ready
+}
+
+// watchHealth periodically updates the serving status by the storage readiness until the context is done.
+//
+// Parameters:
+// - ctx: the context that stops the watcher.
+// - interval: the interval between checks.
+func (app *App) watchHealth(ctx context.Context, interval time.Duration) {
+	logger := mylogger.Get()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ready := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, interval)
+			isReady := app.updateHealth(checkCtx)
+			cancel()
+			if isReady != ready {
+				logger.Info("storage readiness changed", zap.Bool("ready", isReady))
+				ready = isReady
+			}
+		}
+	}
+}
+
+// shutdownHealth reports NOT_SERVING for all the services, so the clients stop sending new requests
+// while the server shuts down.
+func (app *App) shutdownHealth() {
+	if app.GRPCServer.health != nil {
+		app.GRPCServer.health.Shutdown()
+	}
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+
+	pbv2 "github.com/stsg/shorty/api/v2"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+// readyStorage is a memory storage with a switchable readiness.
+type readyStorage struct {
+	*storage.MapStorage
+	ready bool
+}
+
+func (s *readyStorage) IsReady(ctx context.Context) bool {
+	return s.ready
+}
+
+func TestGRPC_Health(t *testing.T) {
+	conn, app := newTestGRPCConn(t)
+	client := healthpb.NewHealthClient(conn)
+	ctx := context.Background()
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return res.Status
+	}
+
+	if status := check(pbv2.ShortenerService_ServiceDesc.ServiceName); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING, but got %v", status)
+	}
+
+	// The storage readiness is reported
+	mStorage, _ := storage.NewMapStorage()
+	rStorage := &readyStorage{MapStorage: mStorage}
+	app.storage = rStorage
+	app.updateHealth(ctx)
+	if status := check(""); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected NOT_SERVING for a storage that is not ready, but got %v", status)
+	}
+	rStorage.ready = true
+	app.updateHealth(ctx)
+	if status := check(""); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING for a ready storage, but got %v", status)
+	}
+
+	// NOT_SERVING is kept during the shutdown
+	app.shutdownHealth()
+	app.updateHealth(ctx)
+	if status := check(""); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected NOT_SERVING during the shutdown, but got %v", status)
+	}
+}
+
+func TestGRPC_Reflection(t *testing.T) {
+	listServices := func() error {
+		conn, _ := newTestGRPCConn(t)
+		stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+
+	// Reflection is disabled by default
+	if err := listServices(); err == nil {
+		t.Errorf("Expected reflection to be disabled")
+	}
+
+	t.Setenv("GRPC_REFLECTION", "true")
+	if err := listServices(); err != nil {
+		t.Errorf("Expected reflection to be enabled, but got %v", err)
+	}
+}
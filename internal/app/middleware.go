@@ -3,17 +3,22 @@ package app
 import (
 	"compress/gzip"
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	grpcmiddleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/stsg/shorty/internal/logger"
+	"github.com/stsg/shorty/internal/storage"
 )
 
 // Decompress returns a middleware that decompresses request bodies if they are gzipped.
@@ -90,6 +95,106 @@ func (app *App) TrustedSubnets() func(http.Handler) http.Handler {
 	}
 }
 
+// APIKeyAuth returns a middleware that authenticates requests with an "Authorization: Bearer" API key.
+//
+// A request without the Authorization header is passed on unchanged to be authenticated by the session cookie.
+// For a valid key the user ID of the key is put in the request context and the last use time of the key is updated.
+// A malformed header or an unknown key is rejected with http.StatusUnauthorized.
+func (app *App) APIKeyAuth() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			authorization := req.Header.Get("Authorization")
+			if authorization == "" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+
+			key, ok := bearerToken(authorization)
+			if !ok {
+				rw.Header().Set("Content-Type", "text/plain")
+				rw.WriteHeader(http.StatusUnauthorized)
+				rw.Write([]byte("need authorization in a form Bearer <key>"))
+				return
+			}
+			userID, err := app.storage.UseAPIKey(req.Context(), HashAPIKey(key), time.Now().UTC())
+			if err != nil {
+				rw.Header().Set("Content-Type", "text/plain")
+				if code, ok := storageErrorStatus(err); ok {
+					rw.WriteHeader(code)
+				} else if errors.Is(err, storage.ErrAPIKeyNotFound) {
+					rw.WriteHeader(http.StatusUnauthorized)
+				} else {
+					logger.Get().Error("cannot check API key", zap.Error(err))
+					rw.WriteHeader(http.StatusInternalServerError)
+				}
+				rw.Write([]byte(err.Error()))
+				return
+			}
+
+			next.ServeHTTP(rw, req.WithContext(withUserID(req.Context(), userID)))
+		})
+	}
+}
+
+// APIKeyInterceptor authenticates gRPC requests with an API key passed in the "authorization" metadata
+// as "Bearer <key>".
+//
+// A request without the metadata is passed on unchanged to be authenticated by the session token.
+// For a valid key the user ID of the key is put in the request context and the last use time of the key is updated.
+// A malformed metadata or an unknown key is rejected with codes.Unauthenticated.
+func (app *App) APIKeyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := app.apiKeyContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// APIKeyStreamInterceptor authenticates gRPC streams with an API key passed in the "authorization" metadata
+// the same way as APIKeyInterceptor does for unary requests.
+func (app *App) APIKeyStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := app.apiKeyContext(ss.Context())
+	if err != nil {
+		return err
+	}
+	wrapped := grpcmiddleware.WrapServerStream(ss)
+	wrapped.WrappedContext = ctx
+	return handler(srv, wrapped)
+}
+
+// apiKeyContext returns the context with the user ID of the API key passed in the "authorization" metadata.
+//
+// Parameters:
+// - ctx: the request context carrying the incoming metadata.
+//
+// Returns:
+// - context.Context: the context with the user ID, ctx itself if the metadata is not passed.
+// - error: a gRPC status error if the metadata is malformed, the key is unknown or cannot be checked.
+func (app *App) apiKeyContext(ctx context.Context) (context.Context, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get("authorization")) == 0 {
+		return ctx, nil
+	}
+
+	key, ok := bearerToken(md.Get("authorization")[0])
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "need authorization in a form Bearer <key>")
+	}
+	userID, err := app.storage.UseAPIKey(ctx, HashAPIKey(key), time.Now().UTC())
+	if err != nil {
+		if code, ok := storageErrorCode(err); ok {
+			return nil, status.Error(code, err.Error())
+		}
+		if errors.Is(err, storage.ErrAPIKeyNotFound) {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		logger.Get().Error("cannot check API key", zap.Error(err))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return withUserID(ctx, userID), nil
+}
+
 // GRPCRequestLogger logs the incoming gRPC request and its status code.
 //
 // It takes the context, request, server info, and the handler as input parameters.
@@ -110,3 +215,21 @@ func GRPCRequestLogger(ctx context.Context, req interface{}, info *grpc.UnarySer
 
 	return resp, err
 }
+
+// GRPCStreamRequestLogger logs the incoming gRPC stream and its status code.
+//
+// Unlike GRPCRequestLogger it does not limit the duration of the call, streams last as long as the client needs.
+func GRPCStreamRequestLogger(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	logger := logger.Get()
+
+	logger.Info("grpc stream", zap.String("method", info.FullMethod))
+	err := handler(srv, ss)
+	status, _ := status.FromError(err)
+
+	logger.Info("got incoming gRPC stream",
+		zap.String("method", info.FullMethod),
+		zap.String("status code", status.Code().String()),
+	)
+
+	return err
+}
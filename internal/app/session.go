@@ -0,0 +1,161 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	mylogger "github.com/stsg/shorty/internal/logger"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+// defaultSessionTTL is the lifetime of the session tokens if none is configured.
+const defaultSessionTTL = 24 * time.Hour
+
+// sessionTokenVersion is the prefix of the session tokens, it is covered by the signature.
+const sessionTokenVersion = "v1"
+
+// ErrTokenInvalid error is returned when a session token is malformed or its signature does not match.
+var ErrTokenInvalid = errors.New("invalid session token")
+
+// ErrTokenExpired error is returned when a session token is past its expiration time.
+var ErrTokenExpired = errors.New("session token expired")
+
+// Session is a struct that holds user session data.
+//
+// A session is a signed token carrying the user ID and the expiration time,
+// so no session state is kept and the sessions survive a restart.
+// The user IDs are random, so the IDs carried by the tokens issued before a restart are not handed out again.
+// The token is "v1.<payload>.<signature>" where the payload is base64url-encoded JSON
+// and the signature is base64url-encoded HMAC-SHA256 of "v1.<payload>".
+// New tokens are signed with the first key, all the keys are accepted on verification.
+type Session struct {
+	storage storage.Storage
+	keys    [][]byte
+	ttl     time.Duration
+}
+
+// sessionClaims is the payload of a session token.
+type sessionClaims struct {
+	UserID    uint64 `json:"uid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// NewSession creates a new session with the given storage.
+//
+// It creates and returns a new Session object with the provided storage and the signing keys.
+// If no keys are given a random key is generated, the tokens are then only valid until a restart.
+//
+// Parameters:
+// - storage: The storage to be used for the session.
+// - keys: The signing keys, the first one signs new tokens.
+// - ttl: The lifetime of the tokens, defaultSessionTTL if zero.
+//
+// Returns:
+// - *Session: A pointer to the newly created session.
+func NewSession(storage storage.Storage, keys [][]byte, ttl time.Duration) *Session {
+	if len(keys) == 0 {
+		mylogger.Get().Warn("no session keys configured, sessions will not survive a restart")
+		key := make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil
+		}
+		keys = [][]byte{key}
+	}
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+
+	return &Session{
+		storage: storage,
+		keys:    keys,
+		ttl:     ttl,
+	}
+}
+
+// GetUserSessionID returns the user ID carried by the given session token.
+//
+// Parameters:
+// - sessionID: The session token.
+//
+// Returns:
+// - uint64: The user session ID.
+// - error: ErrTokenInvalid if the token is malformed or not signed by any of the keys,
+// ErrTokenExpired if the token is past its expiration time.
+func (s *Session) GetUserSessionID(sessionID string) (uint64, error) {
+	var claims sessionClaims
+
+	version, rest, _ := strings.Cut(sessionID, ".")
+	payload, signature, found := strings.Cut(rest, ".")
+	if version != sessionTokenVersion || !found {
+		return 0, ErrTokenInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return 0, ErrTokenInvalid
+	}
+	valid := false
+	for _, key := range s.keys {
+		if hmac.Equal(mac, sign(key, version+"."+payload)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return 0, ErrTokenInvalid
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return 0, ErrTokenInvalid
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return 0, ErrTokenInvalid
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return 0, ErrTokenExpired
+	}
+	return claims.UserID, nil
+}
+
+// AddUserSession creates a new user and a session token signed with the first key.
+//
+// No parameters.
+// Returns a string representing the session token and a uint64 representing the new user ID.
+func (s *Session) AddUserSession() (session string, userID uint64) {
+	userID = newUserID()
+	return s.newToken(userID, time.Now().Add(s.ttl)), userID
+}
+
+// newUserID returns a random user ID in [1, 2^63), so it fits in the bigint user_id columns of the DB storage.
+func newUserID() uint64 {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if userID := binary.BigEndian.Uint64(b[:]) >> 1; userID != 0 {
+			return userID
+		}
+	}
+}
+
+// newToken returns a token for the user that expires at the given time.
+func (s *Session) newToken(userID uint64, expiresAt time.Time) string {
+	data, _ := json.Marshal(sessionClaims{UserID: userID, ExpiresAt: expiresAt.Unix()})
+	unsigned := sessionTokenVersion + "." + base64.RawURLEncoding.EncodeToString(data)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sign(s.keys[0], unsigned))
+}
+
+// sign returns HMAC-SHA256 of the data with the key.
+func sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
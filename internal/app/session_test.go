@@ -0,0 +1,127 @@
+package app
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stsg/shorty/internal/config"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+var (
+	oldSessionKey = []byte("old-session-key-0123456789abcdef")
+	newSessionKey = []byte("new-session-key-0123456789abcdef")
+)
+
+func TestSession_Concurrent(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	session := NewSession(mStorage, nil, 0)
+
+	var wg sync.WaitGroup
+	sessions := make([]string, 100)
+	userIDs := make([]uint64, 100)
+	for i := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sessions[i], userIDs[i] = session.AddUserSession()
+			if got, err := session.GetUserSessionID(sessions[i]); err != nil || got != userIDs[i] {
+				t.Errorf("Expected user ID %d, but got %d, %v", userIDs[i], got, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every session gets its own user ID
+	seen := make(map[uint64]bool)
+	for _, userID := range userIDs {
+		if seen[userID] {
+			t.Errorf("Duplicate user ID %d", userID)
+		}
+		seen[userID] = true
+	}
+}
+
+func TestSession_GetUserSessionID(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	session := NewSession(mStorage, [][]byte{oldSessionKey}, time.Hour)
+	token, userID := session.AddUserSession()
+
+	// The token survives a restart with the same key
+	restarted := NewSession(mStorage, [][]byte{oldSessionKey}, time.Hour)
+	if got, err := restarted.GetUserSessionID(token); err != nil || got != userID {
+		t.Errorf("Expected user ID %d, but got %d, %v", userID, got, err)
+	}
+
+	// A new user after the restart does not get the ID of the user without URLs
+	if _, restartedUserID := restarted.AddUserSession(); restartedUserID == userID || restartedUserID > math.MaxInt64 {
+		t.Errorf("Expected a new user ID that fits in bigint, but got %d", restartedUserID)
+	}
+
+	// The old key is still accepted after the rotation, new tokens are signed with the new key
+	rotated := NewSession(mStorage, [][]byte{newSessionKey, oldSessionKey}, time.Hour)
+	if got, err := rotated.GetUserSessionID(token); err != nil || got != userID {
+		t.Errorf("Expected user ID %d after rotation, but got %d, %v", userID, got, err)
+	}
+	newToken, newUserID := rotated.AddUserSession()
+	if _, err := session.GetUserSessionID(newToken); err != ErrTokenInvalid {
+		t.Errorf("Expected ErrTokenInvalid for a token signed with the new key, but got %v", err)
+	}
+	if got, err := rotated.GetUserSessionID(newToken); err != nil || got != newUserID {
+		t.Errorf("Expected user ID %d, but got %d, %v", newUserID, got, err)
+	}
+
+	// A token signed with a dropped key is rejected
+	dropped := NewSession(mStorage, [][]byte{newSessionKey}, time.Hour)
+	if _, err := dropped.GetUserSessionID(token); err != ErrTokenInvalid {
+		t.Errorf("Expected ErrTokenInvalid, but got %v", err)
+	}
+
+	expired := session.newToken(userID, time.Now().Add(-time.Second))
+	if _, err := session.GetUserSessionID(expired); err != ErrTokenExpired {
+		t.Errorf("Expected ErrTokenExpired, but got %v", err)
+	}
+
+	// Changing the payload breaks the signature
+	parts := strings.Split(token, ".")
+	forged := strings.Split(session.newToken(userID+1, time.Now().Add(time.Hour)), ".")
+	tampered := []string{
+		"",
+		"uuid-like-token",
+		parts[0] + "." + forged[1] + "." + parts[2],
+		"v2." + parts[1] + "." + parts[2],
+		parts[0] + "." + parts[1] + ".",
+	}
+	for _, token := range tampered {
+		if _, err := session.GetUserSessionID(token); err != ErrTokenInvalid {
+			t.Errorf("Expected ErrTokenInvalid for %q, but got %v", token, err)
+		}
+	}
+}
+
+func TestHandleGetAllURLs_InvalidToken(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	app := App{
+		Config:  config.Config{},
+		storage: mStorage,
+		Session: NewSession(mStorage, [][]byte{oldSessionKey}, time.Hour),
+	}
+	expired := app.Session.newToken(1, time.Now().Add(-time.Second))
+
+	for _, token := range []string{"", "tampered", expired} {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		}
+		rw := httptest.NewRecorder()
+		app.HandleGetAllURLs(rw, req)
+		if rw.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %d for token %q, but got %d", http.StatusUnauthorized, token, rw.Code)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	mylogger "github.com/stsg/shorty/internal/logger"
+)
+
+// ErrShuttingDown is returned when work is queued after the App started to shut down.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// workQueues tracks the background work of the App: the deletions and the clicks queued by the handlers
+// and the workers saving them to the storage.
+//
+// On shutdown the queues are closed once no handler is adding to them anymore
+// and the workers save everything queued before they exit, so no accepted work is lost.
+type workQueues struct {
+	mu       sync.RWMutex
+	closed   bool
+	workers  sync.WaitGroup
+	draining atomic.Bool
+}
+
+// startWorker runs the worker consuming a queue in a goroutine that is waited for on shutdown.
+//
+// Parameters:
+// - worker: the function that returns when its queue is closed and drained.
+func (app *App) startWorker(worker func()) {
+	app.queues.workers.Add(1)
+	go func() {
+		defer app.queues.workers.Done()
+		worker()
+	}()
+}
+
+// queueDeletion queues the asynchronous deletion of the URLs of the user.
+//
+// Parameters:
+// - userID: the user the URLs are deleted for, the URLs owned by other users are ignored.
+// - shortURLs: the IDs of the short URLs.
+//
+// Returns:
+// - error: ErrShuttingDown if the queues are already closed or an error if the deletion cannot be journaled,
+// the deletion is not accepted then.
+func (app *App) queueDeletion(userID uint64, shortURLs []string) error {
+	app.queues.mu.RLock()
+	defer app.queues.mu.RUnlock()
+	if app.queues.closed {
+		return ErrShuttingDown
+	}
+
+	return app.deletions.add(userID, shortURLs)
+}
+
+// drainQueues closes the queues once the handlers stopped adding to them
+// and waits until the workers save the queued work to the storage.
+//
+// The work queued after it is rejected with ErrShuttingDown.
+func (app *App) drainQueues() {
+	app.queues.mu.Lock()
+	if app.queues.closed {
+		app.queues.mu.Unlock()
+		return
+	}
+	app.queues.closed = true
+	app.queues.mu.Unlock()
+
+	app.deletions.close()
+	close(app.clickChan)
+	app.queues.workers.Wait()
+}
+
+// isDraining reports whether the App is shutting down, it is not ready for new requests then.
+func (app *App) isDraining() bool {
+	return app.queues != nil && app.queues.draining.Load()
+}
+
+// shutdown stops the App gracefully.
+//
+// It reports the App is not ready first, so load balancers and gRPC clients stop sending new requests,
+// then it lets the in-flight HTTP requests and RPCs finish within the grace period and closes
+// the ones left after it. At last the queued deletions and clicks are saved and the storage is closed.
+//
+// Parameters:
+// - srv: the HTTP server.
+// - challengeSrv: the ACME HTTP-01 challenge server, nil if it is not run.
+// - timeout: the grace period.
+//
+// Returns an error if the storage cannot be closed.
+func (app *App) shutdown(srv, challengeSrv *http.Server, timeout time.Duration) error {
+	logger := mylogger.Get()
+
+	app.queues.draining.Store(true)
+	app.shutdownHealth()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range []*http.Server{srv, challengeSrv} {
+		if s == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			err := s.Shutdown(ctx)
+			if err != nil {
+				logger.Warn("in-flight requests are not finished, closing them", zap.String("address", s.Addr), zap.Error(err))
+				s.Close()
+			}
+		}(s)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		app.stopGRPC(ctx)
+	}()
+	wg.Wait()
+
+	logger.Info("saving queued deletions and clicks")
+	app.drainQueues()
+
+	logger.Info("closing storage")
+	return app.storage.Close()
+}
+
+// stopGRPC lets the in-flight RPCs finish until the context is done and closes the ones left after it.
+//
+// The connection of the REST/JSON gateway is closed once the server is stopped.
+//
+// Parameters:
+// - ctx: the context of the grace period.
+func (app *App) stopGRPC(ctx context.Context) {
+	if app.GRPCServer.gateway != nil {
+		defer app.GRPCServer.gateway.Close()
+	}
+	if app.Config.GetSinglePort() {
+		// gRPC requests served by the HTTP server cannot be drained, they are closed with it
+		app.GRPCServer.grpcServer.Stop()
+		return
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		app.GRPCServer.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		mylogger.Get().Warn("in-flight RPCs are not finished, closing them")
+		app.GRPCServer.grpcServer.Stop()
+		<-stopped
+	}
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stsg/shorty/internal/config"
+	"github.com/stsg/shorty/internal/storage"
+)
+
+// closeStorage is a memory storage that records it is closed.
+type closeStorage struct {
+	*storage.MapStorage
+	closed bool
+}
+
+func (s *closeStorage) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	mStorage, _ := storage.NewMapStorage()
+	cStorage := &closeStorage{MapStorage: mStorage}
+	app := NewApp(config.Config{}, cStorage)
+
+	const userID = 1
+	ctx := context.Background()
+	var shortURLs []string
+	for i := 0; i < 1000; i++ {
+		shortURL := fmt.Sprintf("drain%d", i)
+		cStorage.Save(ctx, userID, shortURL, "https://example.com/"+shortURL, time.Time{})
+		shortURLs = append(shortURLs, shortURL)
+	}
+
+	// An in-flight request queues the deletions after the shutdown begins
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		if err := app.queueDeletion(userID, shortURLs); err != nil {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: time.Second}
+	go srv.Serve(listener)
+
+	resCode := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			resCode <- 0
+			return
+		}
+		res.Body.Close()
+		resCode <- res.StatusCode
+	}()
+	<-started
+
+	err = app.shutdown(srv, nil, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if code := <-resCode; code != http.StatusAccepted {
+		t.Errorf("Expected the in-flight request to finish with %d, but got %d", http.StatusAccepted, code)
+	}
+
+	// The queued deletions are saved before the storage is closed
+	for _, shortURL := range shortURLs {
+		if _, err := cStorage.GetRealURL(ctx, shortURL); err == nil {
+			t.Fatalf("Expected %s to be deleted", shortURL)
+		}
+	}
+	if !cStorage.closed {
+		t.Errorf("Expected the storage to be closed")
+	}
+
+	// The App is not ready and rejects the new work
+	rw := httptest.NewRecorder()
+	app.HandlePing(rw, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d, but got %d", http.StatusServiceUnavailable, rw.Code)
+	}
+	if err := app.queueDeletion(userID, shortURLs); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Expected ErrShuttingDown, but got %v", err)
+	}
+}
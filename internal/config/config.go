@@ -10,6 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/stsg/shorty/internal/logger"
@@ -23,6 +24,48 @@ const defaultFileStorage string = "/tmp/short-url-db.json"
 // should be in form "host=localhost port=5432 user=postgres dbname=postgres password=postgres sslmode=disable"
 const defaultDBStorage string = ""
 const defaultConfigFile string = ""
+const defaultReaperInterval string = "1m"
+const defaultSessionTTL string = "24h"
+const defaultShutdownTimeout string = "30s"
+const defaultGRPCAddr string = ":63067"
+const defaultSelfSignedCert string = "./data/cert/cert.pem"
+const defaultSelfSignedKey string = "./data/cert/key.pem"
+const defaultACMEDirectory string = "https://acme-v02.api.letsencrypt.org/directory"
+const defaultACMECacheDir string = "./data/acme"
+const defaultACMEHTTPAddr string = ":80"
+const defaultDedupScope string = DedupUser
+const defaultDeleteBatchSize int = 500
+const defaultCodeGenerator string = CodeRandom
+const defaultCodeLength int = 6
+const defaultCodeGrowthThreshold float64 = 0.1
+const defaultDeleteFlushInterval string = "1s"
+
+// Dedup scopes, the scope a long URL is shortened once in.
+//
+// In the DedupGlobal scope a long URL shortened by any user is not shortened again,
+// the existing short URL is returned instead. In the DedupUser scope every user gets
+// a short URL of their own. In the DedupNone scope a new short URL is created every time.
+const (
+	DedupGlobal = "global"
+	DedupUser   = "user"
+	DedupNone   = "none"
+)
+
+// Code generators, the strategies the short URLs of the new long URLs are generated with.
+//
+// CodeRandom generates cryptographically random short URLs. CodeSequential encodes a counter in base62,
+// CodeHashids scrambles the counter with a salt, so the short URLs do not reveal the sequence. CodeHash
+// derives the short URL from the hash of the long URL, so a long URL gets the same short URL everywhere,
+// it needs the DedupGlobal scope, where a long URL is shortened once.
+const (
+	CodeRandom     = "random"
+	CodeSequential = "sequential"
+	CodeHashids    = "hashids"
+	CodeHash       = "hash"
+)
+
+// MinSessionKeyLength is the minimal length of a session signing key in bytes.
+const MinSessionKeyLength = 32
 
 // Options class definition defines a struct holds Options
 // with four fields: RunAddrOpt, BaseAddrOpt, FileStorageOpt, and DBStorageOpt.
@@ -30,13 +73,44 @@ const defaultConfigFile string = ""
 // which specifies the name of the environment variable
 // that should be used to set the value of that field.
 type Options struct {
-	RunAddrOpt     string `env:"SERVER_ADDRESS" json:"server_address,omitempty"`
-	BaseAddrOpt    string `env:"BASE_URL" json:"base_url,omitempty"`
-	FileStorageOpt string `env:"FILE_STORAGE_PATH" json:"file_storage_path,omitempty"`
-	DBStorageOpt   string `env:"DATABASE_DSN" json:"database_dsn,omitempty"`
-	EnableHTTPS    bool   `env:"ENABLE_HTPPS" json:"enable_https,omitempty"`
-	TrustedSubnet  string `env:"TRUSTED_SUBNET" json:"trusted_subnet,omitempty"`
-	ConfigFile     string `env:"CONFIG"`
+	RunAddrOpt      string  `env:"SERVER_ADDRESS" json:"server_address,omitempty"`
+	BaseAddrOpt     string  `env:"BASE_URL" json:"base_url,omitempty"`
+	FileStorageOpt  string  `env:"FILE_STORAGE_PATH" json:"file_storage_path,omitempty"`
+	DBStorageOpt    string  `env:"DATABASE_DSN" json:"database_dsn,omitempty"`
+	StorageOpt      string  `env:"STORAGE" json:"storage,omitempty"`
+	SkipMigrations  bool    `env:"SKIP_MIGRATIONS" json:"skip_migrations,omitempty"`
+	DedupScope      string  `env:"DEDUP_SCOPE" json:"dedup_scope,omitempty"`
+	CodeGenerator   string  `env:"CODE_GENERATOR" json:"code_generator,omitempty"`
+	CodeLength      int     `env:"CODE_LENGTH" json:"code_length,omitempty"`
+	CodeGrowth      float64 `env:"CODE_GROWTH_THRESHOLD" json:"code_growth_threshold,omitempty"`
+	CodeSalt        string  `env:"CODE_SALT" json:"code_salt,omitempty"`
+	EnableHTTPS     bool    `env:"ENABLE_HTPPS" json:"enable_https,omitempty"`
+	TrustedSubnet   string  `env:"TRUSTED_SUBNET" json:"trusted_subnet,omitempty"`
+	ReaperInterval  string  `env:"REAPER_INTERVAL" json:"reaper_interval,omitempty"`
+	SessionKeys     string  `env:"SESSION_KEYS" json:"session_keys,omitempty"`
+	SessionTTL      string  `env:"SESSION_TTL" json:"session_ttl,omitempty"`
+	ShutdownTimeout string  `env:"SHUTDOWN_TIMEOUT" json:"shutdown_timeout,omitempty"`
+	DeleteBatchSize int     `env:"DELETE_BATCH_SIZE" json:"delete_batch_size,omitempty"`
+	DeleteFlush     string  `env:"DELETE_FLUSH_INTERVAL" json:"delete_flush_interval,omitempty"`
+	DeleteJournal   string  `env:"DELETE_JOURNAL" json:"delete_journal,omitempty"`
+	GRPCHealth      bool    `env:"GRPC_HEALTH" json:"grpc_health,omitempty"`
+	GRPCReflection  bool    `env:"GRPC_REFLECTION" json:"grpc_reflection,omitempty"`
+	GRPCAddrOpt     string  `env:"GRPC_ADDRESS" json:"grpc_address,omitempty"`
+	DisableGRPC     bool    `env:"DISABLE_GRPC" json:"disable_grpc,omitempty"`
+	GRPCClientCA    string  `env:"GRPC_CLIENT_CA" json:"grpc_client_ca,omitempty"`
+	SinglePort      bool    `env:"SINGLE_PORT" json:"single_port,omitempty"`
+	TLSCert         string  `env:"TLS_CERT" json:"tls_cert,omitempty"`
+	TLSKey          string  `env:"TLS_KEY" json:"tls_key,omitempty"`
+	TLSSelfSigned   bool    `env:"TLS_SELF_SIGNED" json:"tls_self_signed,omitempty"`
+	ACME            bool    `env:"ACME" json:"acme,omitempty"`
+	ACMEDomains     string  `env:"ACME_DOMAINS" json:"acme_domains,omitempty"`
+	ACMEEmail       string  `env:"ACME_EMAIL" json:"acme_email,omitempty"`
+	ACMEDirectory   string  `env:"ACME_DIRECTORY" json:"acme_directory,omitempty"`
+	ACMECA          string  `env:"ACME_CA" json:"acme_ca,omitempty"`
+	ACMECacheDir    string  `env:"ACME_CACHE_DIR" json:"acme_cache_dir,omitempty"`
+	ACMEHTTPAddr    string  `env:"ACME_HTTP_ADDRESS" json:"acme_http_address,omitempty"`
+	ACMETLSALPN     bool    `env:"ACME_TLS_ALPN" json:"acme_tls_alpn,omitempty"`
+	ConfigFile      string  `env:"CONFIG"`
 }
 
 var opt Options
@@ -47,16 +121,57 @@ type NetAddress struct {
 	port int
 }
 
+// ACMEConfig is a struct that holds the configuration of the certificates provisioning via ACME
+type ACMEConfig struct {
+	// Domains are the host names the certificates are obtained for.
+	Domains []string
+	// Email is the contact of the ACME account, it may be empty.
+	Email string
+	// DirectoryURL is the directory of the ACME server.
+	DirectoryURL string
+	// CA is the path to the PEM bundle of the CAs the ACME server is verified with, empty for the system roots.
+	CA string
+	// CacheDir is the directory the account key and the certificates are kept in.
+	CacheDir string
+	// HTTPAddr is the address the HTTP-01 challenges are served on, empty if they are not accepted.
+	HTTPAddr string
+	// TLSALPN is whether the TLS-ALPN-01 challenges are accepted on the run address.
+	TLSALPN bool
+}
+
 // Config is a struct that holds Application configuration
 type Config struct {
-	baseAddr      *url.URL
-	storageType   string
-	fileStorage   string
-	dbStorage     string
-	runAddr       NetAddress
-	enableHTTPS   bool
-	trustedSubnet *net.IPNet
-	configFile    string
+	baseAddr        *url.URL
+	storageType     string
+	fileStorage     string
+	dbStorage       string
+	boltStorage     string
+	skipMigrations  bool
+	dedupScope      string
+	codeGenerator   string
+	codeLength      int
+	codeGrowth      float64
+	codeSalt        string
+	runAddr         NetAddress
+	enableHTTPS     bool
+	trustedSubnet   *net.IPNet
+	reaperInterval  time.Duration
+	sessionKeys     [][]byte
+	sessionTTL      time.Duration
+	shutdownTimeout time.Duration
+	deleteBatchSize int
+	deleteFlush     time.Duration
+	deleteJournal   string
+	grpcHealth      bool
+	grpcReflection  bool
+	grpcAddr        string
+	grpcClientCA    string
+	singlePort      bool
+	tlsCert         string
+	tlsKey          string
+	tlsSelfSigned   bool
+	acme            *ACMEConfig
+	configFile      string
 }
 
 // GetRunAddr returns the run address of the Config object.
@@ -102,6 +217,63 @@ func (conf Config) GetDBStorage() string {
 	return conf.dbStorage
 }
 
+// GetBoltStorage returns the bbolt database path from the Config struct.
+//
+// No parameters.
+// Returns a string.
+func (conf Config) GetBoltStorage() string {
+	return conf.boltStorage
+}
+
+// GetSkipMigrations returns whether the DB storage is not migrated to the latest version on start.
+//
+// No parameters.
+// Returns a boolean value.
+func (conf Config) GetSkipMigrations() bool {
+	return conf.skipMigrations
+}
+
+// GetDedupScope returns the scope a long URL is shortened once in: DedupGlobal, DedupUser or DedupNone.
+//
+// No parameters.
+// Returns a string.
+func (conf Config) GetDedupScope() string {
+	return conf.dedupScope
+}
+
+// GetCodeGenerator returns the strategy the short URLs are generated with.
+//
+// No parameters.
+// Returns one of CodeRandom, CodeSequential, CodeHashids and CodeHash.
+func (conf Config) GetCodeGenerator() string {
+	return conf.codeGenerator
+}
+
+// GetCodeLength returns the initial length of the generated short URLs.
+//
+// No parameters.
+// Returns an int.
+func (conf Config) GetCodeLength() int {
+	return conf.codeLength
+}
+
+// GetCodeGrowthThreshold returns the rate of the generated short URLs found taken
+// above which the generated short URLs get longer.
+//
+// No parameters.
+// Returns a float64 in (0, 1].
+func (conf Config) GetCodeGrowthThreshold() float64 {
+	return conf.codeGrowth
+}
+
+// GetCodeSalt returns the salt the short URLs of the CodeHashids generator are scrambled with.
+//
+// No parameters.
+// Returns a string.
+func (conf Config) GetCodeSalt() string {
+	return conf.codeSalt
+}
+
 // GetEnableHTTPS returns the value of the enableHTTPS field from the Config struct.
 //
 // No parameters.
@@ -133,6 +305,144 @@ func (conf Config) IsTrusted(ip string) bool {
 	return conf.trustedSubnet.Contains(ipAddr)
 }
 
+// GetReaperInterval returns the interval between expired URLs cleanups from the Config struct.
+//
+// No parameters.
+// Returns a time.Duration, zero if the cleanup is disabled.
+func (conf Config) GetReaperInterval() time.Duration {
+	return conf.reaperInterval
+}
+
+// GetSessionKeys returns the session signing keys from the Config struct.
+//
+// The first key signs new session tokens, all the keys are accepted when tokens are verified,
+// so a key can be rotated by putting the new key first and keeping the old one until its tokens expire.
+//
+// No parameters.
+// Returns a slice of keys, empty if no keys are configured.
+func (conf Config) GetSessionKeys() [][]byte {
+	return conf.sessionKeys
+}
+
+// GetSessionTTL returns the lifetime of the session tokens from the Config struct.
+//
+// No parameters.
+// Returns a time.Duration.
+func (conf Config) GetSessionTTL() time.Duration {
+	return conf.sessionTTL
+}
+
+// GetShutdownTimeout returns the grace period the in-flight requests are finished within on shutdown.
+//
+// No parameters.
+// Returns a time.Duration.
+func (conf Config) GetShutdownTimeout() time.Duration {
+	return conf.shutdownTimeout
+}
+
+// GetDeleteBatchSize returns the maximal number of the queued deletions saved to the storage at once.
+//
+// No parameters.
+// Returns an int.
+func (conf Config) GetDeleteBatchSize() int {
+	return conf.deleteBatchSize
+}
+
+// GetDeleteFlushInterval returns the interval the queued deletions are saved to the storage at,
+// a full batch is saved without waiting for it.
+//
+// No parameters.
+// Returns a time.Duration.
+func (conf Config) GetDeleteFlushInterval() time.Duration {
+	return conf.deleteFlush
+}
+
+// GetDeleteJournal returns the path to the file the queued deletions are kept in until they are saved,
+// so that they survive a restart.
+//
+// No parameters.
+// Returns a string, empty if the queued deletions are kept in memory only.
+func (conf Config) GetDeleteJournal() string {
+	return conf.deleteJournal
+}
+
+// GetGRPCHealth returns whether the gRPC server serves the grpc.health.v1.Health service.
+//
+// No parameters.
+// Returns a boolean value.
+func (conf Config) GetGRPCHealth() bool {
+	return conf.grpcHealth
+}
+
+// GetGRPCReflection returns whether the gRPC server serves the server reflection service.
+//
+// No parameters.
+// Returns a boolean value.
+func (conf Config) GetGRPCReflection() bool {
+	return conf.grpcReflection
+}
+
+// GetGRPCAddr returns the address the gRPC server listens on from the Config struct.
+//
+// No parameters.
+// Returns a string in the form "host:port", empty if the gRPC server is disabled.
+func (conf Config) GetGRPCAddr() string {
+	return conf.grpcAddr
+}
+
+// GetGRPCClientCA returns the path to the PEM bundle of the CAs the gRPC clients certificates are verified with.
+//
+// If it is set, the gRPC server requires mutual TLS.
+//
+// No parameters.
+// Returns a string, empty if client certificates are not required.
+func (conf Config) GetGRPCClientCA() string {
+	return conf.grpcClientCA
+}
+
+// GetSinglePort returns whether HTTP and gRPC are served together on the run address.
+//
+// No parameters.
+// Returns a boolean value.
+func (conf Config) GetSinglePort() bool {
+	return conf.singlePort
+}
+
+// GetTLSCert returns the path to the PEM certificate chain of the HTTPS and gRPC servers.
+//
+// No parameters.
+// Returns a string, empty if HTTPS is disabled.
+func (conf Config) GetTLSCert() string {
+	return conf.tlsCert
+}
+
+// GetTLSKey returns the path to the PEM private key of the HTTPS and gRPC servers.
+//
+// No parameters.
+// Returns a string, empty if HTTPS is disabled.
+func (conf Config) GetTLSKey() string {
+	return conf.tlsKey
+}
+
+// GetTLSSelfSigned returns whether a self-signed certificate is generated into the TLS certificate
+// and key files on start.
+//
+// It is meant for development only, the certificate is not trusted by clients.
+//
+// No parameters.
+// Returns a boolean value.
+func (conf Config) GetTLSSelfSigned() bool {
+	return conf.tlsSelfSigned
+}
+
+// GetACME returns the configuration of the certificates provisioning via ACME.
+//
+// No parameters.
+// Returns a *ACMEConfig, nil if ACME is disabled and the TLS certificate files are used.
+func (conf Config) GetACME() *ACMEConfig {
+	return conf.acme
+}
+
 // GetConfigFile returns the config file path from the Config struct.
 //
 // No parameters.
@@ -148,14 +458,46 @@ func (conf Config) GetConfigFile() string {
 // - baseAddr: a URL object representing the shortener address.
 // - fileStorage: the path to the file storage.
 // - dbStorage: the DSN of the database.
-// - storageType: the type of storage being used, either "file" or "db".
+// - storageType: the type of storage being used, either "file", "db" or "bolt", empty for the memory storage.
 //
 // The function parses the following command line flags:
 // - "-a": the address and port to run the server.
 // - "-b": the shortener address.
 // - "-f": the file storage path.
 // - "-d": the database DSN.
-// - "-s": enable HTTPS.
+// - "-storage": the storage in a form type:path (memory, file:path, db:dsn or bolt:path),
+// it overrides "-f" and "-d".
+// - "-s": enable HTTPS, it needs "-tls-cert" and "-tls-key" or "-tls-self-signed".
+// - "-tls-cert": the PEM certificate chain of the HTTPS and gRPC servers,
+// it is reloaded when the file changes or on SIGHUP.
+// - "-tls-key": the PEM private key of the certificate.
+// - "-tls-self-signed": generate a self-signed certificate for the configured host names on start,
+// for development only, the certificate and the key are written to "-tls-cert" and "-tls-key"
+// or to ./data/cert if they are not set.
+// - "-acme": obtain and renew the HTTPS and gRPC certificates via ACME instead of "-tls-cert",
+// it needs "-s".
+// - "-acme-domains": the comma-separated host names to obtain the certificates for,
+// the host name of "-b" by default.
+// - "-acme-email": the contact of the ACME account.
+// - "-acme-directory": the directory URL of the ACME server, Let's Encrypt by default.
+// - "-acme-ca": the PEM bundle of the CAs to verify the ACME server with, e.g. of a local Pebble.
+// - "-acme-cache": the directory to keep the account key and the certificates in.
+// - "-acme-http": the address to serve the HTTP-01 challenges on, empty to accept TLS-ALPN-01 only.
+// - "-acme-tls-alpn": accept the TLS-ALPN-01 challenges on the "-a" address.
+// - "-r": the interval between expired URLs cleanups, 0 disables the cleanup.
+// - "-k": the comma-separated session signing keys of at least MinSessionKeyLength bytes,
+// the first one signs new tokens.
+// - "-session-ttl": the lifetime of the session tokens.
+// - "-shutdown-timeout": the grace period the in-flight requests are finished within on shutdown,
+// the queued deletions and clicks are saved after it.
+// - "-grpc-health": serve the gRPC health checking service, enabled by default.
+// - "-grpc-reflection": serve the gRPC server reflection service.
+// - "-g": the address and port to run the gRPC server, it uses TLS with the HTTPS certificate if "-s" is set.
+// - "-disable-grpc": do not run the gRPC server.
+// - "-grpc-client-ca": the PEM bundle of the CAs to verify the gRPC client certificates with,
+// it enables mutual TLS and needs "-s".
+// - "-single-port": serve gRPC on the "-a" address together with HTTP instead of the "-g" address,
+// it cannot be used with "-grpc-client-ca".
 //
 // If any of the flags are missing or have invalid values, the function panics.
 //
@@ -233,10 +575,105 @@ func NewConfig() Config {
 	} else {
 		res.dbStorage = "/dev/null"
 	}
+	res.skipMigrations = opt.SkipMigrations
+
+	if opt.StorageOpt != "" {
+		kind, path, _ := strings.Cut(opt.StorageOpt, ":")
+		switch kind {
+		case "memory":
+			res.storageType = ""
+		case "file":
+			res.storageType = "file"
+			res.fileStorage = path
+		case "db":
+			res.storageType = "db"
+			res.dbStorage = path
+		case "bolt":
+			res.storageType = "bolt"
+			res.boltStorage = path
+		default:
+			panic(errors.New("unknown storage type"))
+		}
+		if kind != "memory" && path == "" {
+			panic(errors.New("need storage in a form type:path"))
+		}
+	}
+
+	switch opt.DedupScope {
+	case DedupGlobal, DedupUser, DedupNone:
+	default:
+		panic(errors.New("unknown dedup scope"))
+	}
+	res.dedupScope = opt.DedupScope
+
+	switch opt.CodeGenerator {
+	case CodeRandom, CodeSequential, CodeHashids:
+	case CodeHash:
+		if res.dedupScope != DedupGlobal {
+			// another shortening of a long URL would take the next hash of it and count as a collision
+			panic(errors.New("hash code generator needs the global dedup scope"))
+		}
+	default:
+		panic(errors.New("unknown code generator"))
+	}
+	res.codeGenerator = opt.CodeGenerator
+	if opt.CodeLength < 1 {
+		panic(errors.New("code length should be positive"))
+	}
+	res.codeLength = opt.CodeLength
+	if opt.CodeGrowth <= 0 || opt.CodeGrowth > 1 {
+		panic(errors.New("code growth threshold should be in (0, 1]"))
+	}
+	res.codeGrowth = opt.CodeGrowth
+	res.codeSalt = opt.CodeSalt
 
 	if opt.EnableHTTPS {
 		res.enableHTTPS = true
 	}
+	if (opt.TLSCert == "") != (opt.TLSKey == "") {
+		panic(errors.New("need both TLS certificate and key"))
+	}
+	if opt.TLSCert != "" || opt.TLSSelfSigned {
+		if !res.enableHTTPS {
+			panic(errors.New("TLS certificate needs HTTPS enabled"))
+		}
+		res.tlsCert = opt.TLSCert
+		res.tlsKey = opt.TLSKey
+		res.tlsSelfSigned = opt.TLSSelfSigned
+		if res.tlsSelfSigned && res.tlsCert == "" {
+			res.tlsCert = defaultSelfSignedCert
+			res.tlsKey = defaultSelfSignedKey
+		}
+	} else if res.enableHTTPS && !opt.ACME {
+		panic(errors.New("HTTPS needs TLS certificate and key or self-signed mode"))
+	}
+	if opt.ACME {
+		if !res.enableHTTPS {
+			panic(errors.New("ACME needs HTTPS enabled"))
+		}
+		if res.tlsCert != "" {
+			panic(errors.New("ACME cannot be used with TLS certificate"))
+		}
+		if opt.ACMEHTTPAddr == "" && !opt.ACMETLSALPN {
+			panic(errors.New("ACME needs HTTP-01 address or TLS-ALPN-01"))
+		}
+		res.acme = &ACMEConfig{
+			Email:        opt.ACMEEmail,
+			DirectoryURL: opt.ACMEDirectory,
+			CA:           opt.ACMECA,
+			CacheDir:     opt.ACMECacheDir,
+			HTTPAddr:     opt.ACMEHTTPAddr,
+			TLSALPN:      opt.ACMETLSALPN,
+		}
+		for _, domain := range strings.Split(opt.ACMEDomains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				res.acme.Domains = append(res.acme.Domains, domain)
+			}
+		}
+		if len(res.acme.Domains) == 0 {
+			res.acme.Domains = []string{res.baseAddr.Hostname()}
+		}
+	}
 
 	if opt.TrustedSubnet != "" {
 		_, res.trustedSubnet, err = net.ParseCIDR(opt.TrustedSubnet)
@@ -245,6 +682,68 @@ func NewConfig() Config {
 		}
 	}
 
+	if opt.ReaperInterval != "" {
+		res.reaperInterval, err = time.ParseDuration(opt.ReaperInterval)
+		if err != nil || res.reaperInterval < 0 {
+			panic(errors.New("cannot parse reaper interval"))
+		}
+	}
+
+	if opt.SessionKeys != "" {
+		for _, key := range strings.Split(opt.SessionKeys, ",") {
+			if len(key) < MinSessionKeyLength {
+				panic(errors.New("session key should be at least 32 bytes"))
+			}
+			res.sessionKeys = append(res.sessionKeys, []byte(key))
+		}
+	}
+
+	if opt.SessionTTL != "" {
+		res.sessionTTL, err = time.ParseDuration(opt.SessionTTL)
+		if err != nil || res.sessionTTL <= 0 {
+			panic(errors.New("cannot parse session TTL"))
+		}
+	}
+
+	if opt.ShutdownTimeout != "" {
+		res.shutdownTimeout, err = time.ParseDuration(opt.ShutdownTimeout)
+		if err != nil || res.shutdownTimeout < 0 {
+			panic(errors.New("cannot parse shutdown timeout"))
+		}
+	}
+
+	if opt.DeleteBatchSize < 1 {
+		panic(errors.New("delete batch size should be positive"))
+	}
+	res.deleteBatchSize = opt.DeleteBatchSize
+	res.deleteFlush, err = time.ParseDuration(opt.DeleteFlush)
+	if err != nil || res.deleteFlush <= 0 {
+		panic(errors.New("cannot parse delete flush interval"))
+	}
+	res.deleteJournal = opt.DeleteJournal
+
+	res.grpcHealth = opt.GRPCHealth
+	res.grpcReflection = opt.GRPCReflection
+
+	if !opt.DisableGRPC {
+		if _, _, err := net.SplitHostPort(opt.GRPCAddrOpt); err != nil {
+			panic(errors.New("need gRPC address in a form host:port"))
+		}
+		res.grpcAddr = opt.GRPCAddrOpt
+	}
+	if opt.GRPCClientCA != "" {
+		if !res.enableHTTPS {
+			panic(errors.New("gRPC client CA needs HTTPS enabled"))
+		}
+		res.grpcClientCA = opt.GRPCClientCA
+	}
+	if opt.SinglePort {
+		if res.grpcClientCA != "" {
+			panic(errors.New("gRPC client CA needs a separate gRPC port"))
+		}
+		res.singlePort = true
+	}
+
 	return res
 }
 
@@ -257,7 +756,38 @@ func init() {
 	flag.StringVar(&opt.BaseAddrOpt, "b", defaultBaseAddr, "shortener address")
 	flag.StringVar(&opt.FileStorageOpt, "f", defaultFileStorage, "file storage path")
 	flag.StringVar(&opt.DBStorageOpt, "d", defaultDBStorage, "database DSN")
+	flag.StringVar(&opt.StorageOpt, "storage", "", "storage in a form type:path (memory, file:path, db:dsn, bolt:path)")
+	flag.StringVar(&opt.DedupScope, "dedup-scope", defaultDedupScope, "scope a long URL is shortened once in (global, user, none)")
+	flag.StringVar(&opt.CodeGenerator, "code-generator", defaultCodeGenerator, "short URL generator (random, sequential, hashids, hash)")
+	flag.IntVar(&opt.CodeLength, "code-length", defaultCodeLength, "initial length of generated short URLs")
+	flag.Float64Var(&opt.CodeGrowth, "code-growth-threshold", defaultCodeGrowthThreshold, "rate of taken generated short URLs to make them longer at")
+	flag.StringVar(&opt.CodeSalt, "code-salt", "", "salt to scramble short URLs of hashids generator with")
+	flag.BoolVar(&opt.SkipMigrations, "skip-migrations", false, "do not migrate database on start, use migrate command instead")
 	flag.BoolVar(&opt.EnableHTTPS, "s", false, "enable HTTPS")
+	flag.StringVar(&opt.TLSCert, "tls-cert", "", "PEM certificate chain for HTTPS and gRPC, reloaded on change or SIGHUP")
+	flag.StringVar(&opt.TLSKey, "tls-key", "", "PEM private key of TLS certificate")
+	flag.BoolVar(&opt.TLSSelfSigned, "tls-self-signed", false, "generate self-signed TLS certificate on start, for development only")
+	flag.BoolVar(&opt.ACME, "acme", false, "obtain TLS certificates via ACME")
+	flag.StringVar(&opt.ACMEDomains, "acme-domains", "", "comma-separated host names to obtain ACME certificates for, host name of base address by default")
+	flag.StringVar(&opt.ACMEEmail, "acme-email", "", "ACME account contact email")
+	flag.StringVar(&opt.ACMEDirectory, "acme-directory", defaultACMEDirectory, "ACME server directory URL")
+	flag.StringVar(&opt.ACMECA, "acme-ca", "", "PEM bundle of CAs to verify ACME server, system roots by default")
+	flag.StringVar(&opt.ACMECacheDir, "acme-cache", defaultACMECacheDir, "directory to keep ACME account key and certificates in")
+	flag.StringVar(&opt.ACMEHTTPAddr, "acme-http", defaultACMEHTTPAddr, "address to serve ACME HTTP-01 challenges on, empty to disable them")
+	flag.BoolVar(&opt.ACMETLSALPN, "acme-tls-alpn", false, "accept ACME TLS-ALPN-01 challenges on server address")
 	flag.StringVar(&opt.TrustedSubnet, "t", "", "trusted subnet")
+	flag.StringVar(&opt.ReaperInterval, "r", defaultReaperInterval, "expired URLs cleanup interval, 0 disables the cleanup")
+	flag.StringVar(&opt.SessionKeys, "k", "", "comma-separated session signing keys, the first one signs new tokens")
+	flag.StringVar(&opt.SessionTTL, "session-ttl", defaultSessionTTL, "session token lifetime")
+	flag.StringVar(&opt.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "grace period for in-flight requests on shutdown")
+	flag.IntVar(&opt.DeleteBatchSize, "delete-batch-size", defaultDeleteBatchSize, "maximal number of queued deletions saved at once")
+	flag.StringVar(&opt.DeleteFlush, "delete-flush-interval", defaultDeleteFlushInterval, "interval to save queued deletions at")
+	flag.StringVar(&opt.DeleteJournal, "delete-journal", "", "file to keep queued deletions in until they are saved, empty to keep them in memory only")
+	flag.BoolVar(&opt.GRPCHealth, "grpc-health", true, "serve gRPC health checking service")
+	flag.BoolVar(&opt.GRPCReflection, "grpc-reflection", false, "serve gRPC server reflection service")
+	flag.StringVar(&opt.GRPCAddrOpt, "g", defaultGRPCAddr, "address and port to run gRPC server")
+	flag.BoolVar(&opt.DisableGRPC, "disable-grpc", false, "do not run gRPC server")
+	flag.StringVar(&opt.GRPCClientCA, "grpc-client-ca", "", "PEM bundle of CAs to verify gRPC client certificates, enables mutual TLS")
+	flag.BoolVar(&opt.SinglePort, "single-port", false, "serve gRPC on HTTP address and port")
 	flag.StringVar(&opt.ConfigFile, "c", defaultConfigFile, "config file path")
 }
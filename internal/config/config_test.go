@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -45,11 +46,22 @@ func TestNewConfig_SpecifiedValues(t *testing.T) {
 	opt.DBStorageOpt = "host=localhost port=5432 user=postgres dbname=postgres password=postgres sslmode=disable"
 
 	config := &Config{
-		runAddr:     NetAddress{"localhost", 9090},
-		baseAddr:    &url.URL{Scheme: "http", Host: "example.com:8080"},
-		storageType: "db",
-		fileStorage: "/tmp/random.json",
-		dbStorage:   "host=localhost port=5432 user=postgres dbname=postgres password=postgres sslmode=disable",
+		runAddr:         NetAddress{"localhost", 9090},
+		baseAddr:        &url.URL{Scheme: "http", Host: "example.com:8080"},
+		storageType:     "db",
+		fileStorage:     "/tmp/random.json",
+		dbStorage:       "host=localhost port=5432 user=postgres dbname=postgres password=postgres sslmode=disable",
+		reaperInterval:  time.Minute,
+		sessionTTL:      24 * time.Hour,
+		shutdownTimeout: 30 * time.Second,
+		deleteBatchSize: 500,
+		deleteFlush:     time.Second,
+		dedupScope:      DedupUser,
+		codeGenerator:   CodeRandom,
+		codeLength:      6,
+		codeGrowth:      0.1,
+		grpcHealth:      true,
+		grpcAddr:        ":63067",
 	}
 	assert.Equal(t, *config, NewConfig())
 }
@@ -74,3 +86,259 @@ func TestNewConfig_EnvironmentParsingError1(t *testing.T) {
 		},
 	)
 }
+
+// Sets the gRPC server address, disables the gRPC server and needs HTTPS and a separate port for mutual TLS.
+func TestNewConfig_GRPC(t *testing.T) {
+	t.Setenv("SERVER_ADDRESS", "localhost:8080")
+
+	t.Setenv("GRPC_ADDRESS", "localhost:9090")
+	assert.Equal(t, "localhost:9090", NewConfig().GetGRPCAddr())
+
+	t.Setenv("GRPC_ADDRESS", "invalid")
+	assert.PanicsWithError(t, "need gRPC address in a form host:port",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("DISABLE_GRPC", "true")
+	assert.Equal(t, "", NewConfig().GetGRPCAddr())
+
+	t.Setenv("GRPC_CLIENT_CA", "/tmp/ca.pem")
+	assert.PanicsWithError(t, "gRPC client CA needs HTTPS enabled",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("ENABLE_HTPPS", "true")
+	t.Setenv("TLS_SELF_SIGNED", "true")
+	t.Setenv("SINGLE_PORT", "true")
+	assert.PanicsWithError(t, "gRPC client CA needs a separate gRPC port",
+		func() {
+			NewConfig()
+		},
+	)
+}
+
+// Needs a certificate and a key or the self-signed mode for HTTPS and HTTPS for them.
+func TestNewConfig_TLS(t *testing.T) {
+	t.Setenv("SERVER_ADDRESS", "localhost:8080")
+	opt.GRPCClientCA = ""
+	opt.SinglePort = false
+	opt.EnableHTTPS = false
+	opt.TLSSelfSigned = false
+
+	t.Setenv("TLS_CERT", "/etc/shorty/cert.pem")
+	assert.PanicsWithError(t, "need both TLS certificate and key",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("TLS_KEY", "/etc/shorty/key.pem")
+	assert.PanicsWithError(t, "TLS certificate needs HTTPS enabled",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("ENABLE_HTPPS", "true")
+	config := NewConfig()
+	assert.Equal(t, "/etc/shorty/cert.pem", config.GetTLSCert())
+	assert.Equal(t, "/etc/shorty/key.pem", config.GetTLSKey())
+	assert.False(t, config.GetTLSSelfSigned())
+
+	opt.TLSCert = ""
+	opt.TLSKey = ""
+	t.Setenv("TLS_CERT", "")
+	t.Setenv("TLS_KEY", "")
+	assert.PanicsWithError(t, "HTTPS needs TLS certificate and key or self-signed mode",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("TLS_SELF_SIGNED", "true")
+	config = NewConfig()
+	assert.Equal(t, defaultSelfSignedCert, config.GetTLSCert())
+	assert.Equal(t, defaultSelfSignedKey, config.GetTLSKey())
+	assert.True(t, config.GetTLSSelfSigned())
+}
+
+// Obtains the certificates via ACME for the base address host name by default.
+func TestNewConfig_ACME(t *testing.T) {
+	t.Setenv("SERVER_ADDRESS", "localhost:8080")
+	t.Setenv("BASE_URL", "https://short.example")
+	opt.GRPCClientCA = ""
+	opt.SinglePort = false
+	opt.EnableHTTPS = false
+	opt.TLSSelfSigned = false
+	opt.TLSCert = ""
+	opt.TLSKey = ""
+
+	t.Setenv("ACME", "true")
+	assert.PanicsWithError(t, "ACME needs HTTPS enabled",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("ENABLE_HTPPS", "true")
+	assert.Equal(t, &ACMEConfig{
+		Domains:      []string{"short.example"},
+		DirectoryURL: defaultACMEDirectory,
+		CacheDir:     defaultACMECacheDir,
+		HTTPAddr:     defaultACMEHTTPAddr,
+	}, NewConfig().GetACME())
+
+	t.Setenv("ACME_DOMAINS", "a.example, b.example")
+	opt.ACMEHTTPAddr = ""
+	t.Setenv("ACME_TLS_ALPN", "true")
+	acme := NewConfig().GetACME()
+	assert.Equal(t, []string{"a.example", "b.example"}, acme.Domains)
+	assert.Equal(t, "", acme.HTTPAddr)
+	assert.True(t, acme.TLSALPN)
+
+	t.Setenv("ACME_TLS_ALPN", "false")
+	assert.PanicsWithError(t, "ACME needs HTTP-01 address or TLS-ALPN-01",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("TLS_SELF_SIGNED", "true")
+	assert.PanicsWithError(t, "ACME cannot be used with TLS certificate",
+		func() {
+			NewConfig()
+		},
+	)
+}
+
+// Shortens a long URL once per user by default, the none scope cannot be used with the DB storage.
+func TestNewConfig_DedupScope(t *testing.T) {
+	t.Setenv("SERVER_ADDRESS", "localhost:8080")
+	opt.EnableHTTPS = false
+	opt.TLSSelfSigned = false
+	opt.TLSCert = ""
+	opt.TLSKey = ""
+	opt.ACME = false
+	opt.DBStorageOpt = ""
+	opt.StorageOpt = ""
+	defer func() { opt.DedupScope = defaultDedupScope }()
+
+	assert.Equal(t, DedupUser, NewConfig().GetDedupScope())
+
+	t.Setenv("DEDUP_SCOPE", "everyone")
+	assert.PanicsWithError(t, "unknown dedup scope",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("DEDUP_SCOPE", DedupNone)
+	assert.Equal(t, DedupNone, NewConfig().GetDedupScope())
+
+	t.Setenv("STORAGE", "db:host=localhost")
+	assert.Equal(t, DedupNone, NewConfig().GetDedupScope())
+	opt.StorageOpt = ""
+}
+
+// Sets the batches and the journal of the queued deletions, the batch size and the flush interval should be positive.
+func TestNewConfig_DeleteQueue(t *testing.T) {
+	t.Setenv("SERVER_ADDRESS", "localhost:8080")
+	opt.EnableHTTPS = false
+	opt.TLSSelfSigned = false
+	opt.TLSCert = ""
+	opt.TLSKey = ""
+	opt.ACME = false
+	defer func() {
+		opt.DeleteBatchSize = defaultDeleteBatchSize
+		opt.DeleteFlush = defaultDeleteFlushInterval
+		opt.DeleteJournal = ""
+	}()
+
+	t.Setenv("DELETE_BATCH_SIZE", "100")
+	t.Setenv("DELETE_FLUSH_INTERVAL", "250ms")
+	t.Setenv("DELETE_JOURNAL", "/tmp/deletions.log")
+	conf := NewConfig()
+	assert.Equal(t, 100, conf.GetDeleteBatchSize())
+	assert.Equal(t, 250*time.Millisecond, conf.GetDeleteFlushInterval())
+	assert.Equal(t, "/tmp/deletions.log", conf.GetDeleteJournal())
+
+	t.Setenv("DELETE_BATCH_SIZE", "0")
+	assert.PanicsWithError(t, "delete batch size should be positive",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("DELETE_BATCH_SIZE", "100")
+	t.Setenv("DELETE_FLUSH_INTERVAL", "0s")
+	assert.PanicsWithError(t, "cannot parse delete flush interval",
+		func() {
+			NewConfig()
+		},
+	)
+}
+
+// Selects the code generator, the code length should be positive and the growth threshold in (0, 1].
+func TestNewConfig_CodeGenerator(t *testing.T) {
+	t.Setenv("SERVER_ADDRESS", "localhost:8080")
+	opt.EnableHTTPS = false
+	opt.TLSSelfSigned = false
+	opt.TLSCert = ""
+	opt.TLSKey = ""
+	opt.ACME = false
+	defer func() {
+		opt.CodeGenerator = defaultCodeGenerator
+		opt.CodeLength = defaultCodeLength
+		opt.CodeGrowth = defaultCodeGrowthThreshold
+		opt.CodeSalt = ""
+	}()
+
+	t.Setenv("CODE_GENERATOR", CodeHashids)
+	t.Setenv("CODE_LENGTH", "8")
+	t.Setenv("CODE_GROWTH_THRESHOLD", "0.25")
+	t.Setenv("CODE_SALT", "pepper")
+	conf := NewConfig()
+	assert.Equal(t, CodeHashids, conf.GetCodeGenerator())
+	assert.Equal(t, 8, conf.GetCodeLength())
+	assert.Equal(t, 0.25, conf.GetCodeGrowthThreshold())
+	assert.Equal(t, "pepper", conf.GetCodeSalt())
+
+	t.Setenv("CODE_GENERATOR", "uuid")
+	assert.PanicsWithError(t, "unknown code generator",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("CODE_GENERATOR", CodeSequential)
+	t.Setenv("CODE_LENGTH", "0")
+	assert.PanicsWithError(t, "code length should be positive",
+		func() {
+			NewConfig()
+		},
+	)
+
+	t.Setenv("CODE_LENGTH", "6")
+	t.Setenv("CODE_GROWTH_THRESHOLD", "1.5")
+	assert.PanicsWithError(t, "code growth threshold should be in (0, 1]",
+		func() {
+			NewConfig()
+		},
+	)
+
+	// The hash generator gives a long URL the same short URL only if it is shortened once
+	t.Setenv("CODE_GROWTH_THRESHOLD", "0.1")
+	t.Setenv("CODE_GENERATOR", CodeHash)
+	assert.PanicsWithError(t, "hash code generator needs the global dedup scope",
+		func() {
+			NewConfig()
+		},
+	)
+	defer func() { opt.DedupScope = defaultDedupScope }()
+	t.Setenv("DEDUP_SCOPE", DedupGlobal)
+	assert.Equal(t, CodeHash, NewConfig().GetCodeGenerator())
+}
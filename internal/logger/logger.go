@@ -9,6 +9,7 @@ import (
 	"os"
 	"runtime/debug"
 	"sync"
+	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
@@ -100,14 +101,6 @@ func Get() *zap.Logger {
 	once.Do(func() {
 		stdout := zapcore.AddSync(os.Stdout)
 
-		file := zapcore.AddSync(&lumberjack.Logger{
-			Filename:   "logs/app.log",
-			MaxSize:    5,
-			MaxBackups: 10,
-			MaxAge:     14,
-			Compress:   true,
-		})
-
 		level := zap.InfoLevel
 		levelEnv := os.Getenv("LOG_LEVEL")
 		if levelEnv != "" {
@@ -147,18 +140,27 @@ func Get() *zap.Logger {
 
 		// log to multiple destinations (console and file)
 		// extra fields are added to the JSON output alone
-		core := zapcore.NewTee(
-			zapcore.NewCore(consoleEncoder, stdout, logLevel),
-			zapcore.NewCore(fileEncoder, file, logLevel).
+		// the tests log to the console alone, so they do not leave log files in the packages
+		cores := []zapcore.Core{zapcore.NewCore(consoleEncoder, stdout, logLevel)}
+		if !testing.Testing() {
+			file := zapcore.AddSync(&lumberjack.Logger{
+				Filename:   "logs/app.log",
+				MaxSize:    5,
+				MaxBackups: 10,
+				MaxAge:     14,
+				Compress:   true,
+			})
+			cores = append(cores, zapcore.NewCore(fileEncoder, file, logLevel).
 				With(
 					[]zapcore.Field{
 						zap.String("git_revision", gitRevision),
 						zap.String("go_version", buildInfo.GoVersion),
 					},
 				),
-		)
+			)
+		}
 
-		logger = zap.New(core)
+		logger = zap.New(zapcore.NewTee(cores...))
 	})
 
 	return logger
@@ -0,0 +1,768 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/stsg/shorty/internal/config"
+)
+
+// Bolt bucket names.
+//
+// urls holds the URL records by short URL, long, owned and users are the indexes
+// by long URL, by long URL of a user and by user ID, clicks holds the redirects by short URL,
+// apikeys holds the API keys by hash.
+var (
+	boltURLs    = []byte("urls")
+	boltLong    = []byte("long")
+	boltOwned   = []byte("owned")
+	boltUsers   = []byte("users")
+	boltClicks  = []byte("clicks")
+	boltAPIKeys = []byte("apikeys")
+)
+
+// BoltStorage is a struct that holds embedded bbolt storage data.
+//
+// Every record is stored in the urls bucket as JSON in the same form as FileStorage lines.
+// Lookups by long URL and user ID go through the index buckets, so all of them are O(log n).
+//
+// A long URL is shortened once in the dedup scope, the per-user scope unless it is set by NewBoltStorage.
+// The short URLs are generated by gen, random ones of DefaultCodeLength unless it is set by NewBoltStorage.
+type BoltStorage struct {
+	db    *bolt.DB
+	dedup string
+	gen   CodeGenerator
+	Path  string
+}
+
+// NewBoltStorage opens or creates the bbolt database and its buckets.
+//
+// It takes a config.Config object as a parameter and returns a pointer to a BoltStorage object and an error.
+func NewBoltStorage(config config.Config) (*BoltStorage, error) {
+	bs, err := openBoltStorage(config.GetBoltStorage())
+	if err != nil {
+		return nil, err
+	}
+	bs.dedup = config.GetDedupScope()
+	bs.gen, err = newConfigCodeGenerator(config, func() (int, error) { return bs.GetLastID(context.Background()) })
+	if err != nil {
+		bs.Close()
+		return nil, err
+	}
+	return bs, nil
+}
+
+// openBoltStorage opens the bbolt database at the path and creates the buckets.
+//
+// The owned index is built from the records when it is missing in a database created by an older version.
+func openBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltURLs, boltLong, boltUsers, boltClicks, boltAPIKeys} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(boltOwned) != nil {
+			return nil
+		}
+		owned, err := tx.CreateBucket(boltOwned)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltURLs).ForEach(func(_, v []byte) error {
+			var record fileMap
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.Deleted {
+				return nil
+			}
+			return owned.Put(userKey(record.UserID, record.LongURL), []byte(record.ShortURL))
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{db: db, gen: NewRandomGenerator(DefaultCodeLength, DefaultCodeGrowthThreshold), Path: path}, nil
+}
+
+// Close closes the bbolt database.
+//
+// It returns an error if there was a problem closing the database.
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// userKey returns the key of the users index: the big-endian user ID followed by the short URL.
+//
+// The owned index uses the same form with the long URL instead of the short URL.
+func userKey(userID uint64, url string) []byte {
+	key := make([]byte, 8, 8+len(url))
+	binary.BigEndian.PutUint64(key, userID)
+	return append(key, url...)
+}
+
+// clickKey returns the key of a click: the short URL, a zero byte and the big-endian sequence.
+func clickKey(shortURL string, seq uint64) []byte {
+	key := make([]byte, 0, len(shortURL)+9)
+	key = append(key, shortURL...)
+	key = append(key, 0)
+	return binary.BigEndian.AppendUint64(key, seq)
+}
+
+// lookup returns the short URL the long URL is already shortened to in the dedup scope in the transaction.
+//
+// The index entries of the deleted records are ignored, so a deleted long URL can be shortened again.
+func (s *BoltStorage) lookup(tx *bolt.Tx, userID uint64, longURL string) (string, bool) {
+	var shortURL []byte
+	switch s.dedup {
+	case config.DedupGlobal:
+		shortURL = tx.Bucket(boltLong).Get([]byte(longURL))
+	case config.DedupNone:
+		return "", false
+	default:
+		shortURL = tx.Bucket(boltOwned).Get(userKey(userID, longURL))
+	}
+	if shortURL == nil {
+		return "", false
+	}
+	record, err := getRecord(tx, string(shortURL))
+	if err != nil || record.Deleted {
+		return "", false
+	}
+	return record.ShortURL, true
+}
+
+// getRecord reads the record of the short URL in the transaction.
+//
+// It returns ErrURLNotFound if the short URL does not exist.
+func getRecord(tx *bolt.Tx, shortURL string) (fileMap, error) {
+	var record fileMap
+
+	data := tx.Bucket(boltURLs).Get([]byte(shortURL))
+	if data == nil {
+		return record, ErrURLNotFound
+	}
+	err := json.Unmarshal(data, &record)
+	return record, err
+}
+
+// putRecord writes the record to the urls bucket in the transaction.
+func putRecord(tx *bolt.Tx, record fileMap) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltURLs).Put([]byte(record.ShortURL), data)
+}
+
+// insert saves a new record with all its indexes in the transaction.
+//
+// It returns ErrUniqueViolation if the short URL already exists.
+func (s *BoltStorage) insert(tx *bolt.Tx, userID uint64, shortURL string, longURL string, expiresAt time.Time) error {
+	urls := tx.Bucket(boltURLs)
+	if urls.Get([]byte(shortURL)) != nil {
+		return ErrUniqueViolation
+	}
+	seq, err := urls.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	record := fileMap{
+		UUID:     strconv.FormatUint(seq, 10),
+		ShortURL: shortURL,
+		LongURL:  longURL,
+		UserID:   userID,
+	}
+	if !expiresAt.IsZero() {
+		record.ExpiresAt = &expiresAt
+	}
+	if err := putRecord(tx, record); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltLong).Put([]byte(longURL), []byte(shortURL)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltOwned).Put(userKey(userID, longURL), []byte(shortURL)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltUsers).Put(userKey(userID, shortURL), nil)
+}
+
+// Save saves the given short URL and long URL for the specified user ID.
+//
+// Parameters:
+// - ctx: The request context.
+// - userID: The ID of the user.
+// - shortURL: The shortened URL.
+// - longURL: The original URL.
+// - expiresAt: The expiration time, zero for a URL that never expires.
+//
+// Returns:
+// - error: ErrUniqueViolation if the short URL already exists, or an error if the save operation fails.
+func (s *BoltStorage) Save(ctx context.Context, userID uint64, shortURL string, longURL string, expiresAt time.Time) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.insert(tx, userID, shortURL, longURL, expiresAt)
+	})
+}
+
+// GetRealURL retrieves the corresponding long URL for a given short URL from the BoltStorage.
+//
+// Parameters:
+// - ctx: the request context.
+// - shortURL: the short URL for which the corresponding long URL needs to be retrieved.
+//
+// Returns:
+// - string: the long URL corresponding to the short URL.
+// - error: ErrURLNotFound, ErrURLDeleted or ErrURLExpired if the URL cannot be used.
+func (s *BoltStorage) GetRealURL(ctx context.Context, shortURL string) (string, error) {
+	var record fileMap
+
+	if err := checkContext(ctx); err != nil {
+		return "", err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getRecord(tx, shortURL)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if record.Deleted {
+		return "", ErrURLDeleted
+	}
+	if isExpired(record.expiresAt(), time.Now()) {
+		return "", ErrURLExpired
+	}
+	return record.LongURL, nil
+}
+
+// GetShortURLBatch retrieves the short URLs for a batch of long URLs.
+//
+// The whole batch is saved in a single transaction, an item that cannot be shortened
+// is reported by its Err and does not fail the batch.
+//
+// Parameters:
+// - ctx: The request context.
+// - userID: The ID of the user.
+// - bAddr: The base address for the short URLs.
+// - longURLs: The list of long URLs to be converted to short URLs.
+//
+// Returns:
+// - rwJSON: The list of short URLs corresponding to the long URLs.
+// - error: An error if there was a problem retrieving the short URLs.
+func (s *BoltStorage) GetShortURLBatch(ctx context.Context, userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error) {
+	var rwJSON []ResJSONBatch
+
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		rwJSON = make([]ResJSONBatch, 0, len(longURLs))
+		for _, rqElemJSON := range longURLs {
+			shortURL, err := s.batchShortURL(tx, userID, rqElemJSON, now)
+			if err != nil && !isItemError(err) {
+				return err
+			}
+			rwElemJSON := ResJSONBatch{
+				ID:     rqElemJSON.ID,
+				Result: bAddr + "/" + shortURL,
+			}
+			if err != nil {
+				rwElemJSON.fail(err)
+			}
+			rwJSON = append(rwJSON, rwElemJSON)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rwJSON, nil
+}
+
+// batchShortURL saves a batch item in the transaction.
+//
+// Returns:
+// - string: the saved short URL, or the existing short URL if the long URL is already shortened.
+// - error: the validation error of the item, ErrUniqueViolation, ErrAliasTaken or an error of the transaction.
+func (s *BoltStorage) batchShortURL(tx *bolt.Tx, userID uint64, item ReqJSONBatch, now time.Time) (string, error) {
+	expiresAt, err := ExpirationTime(item.ExpiresAt, item.TTL, now)
+	if err != nil {
+		return "", err
+	}
+	if item.Alias == "" {
+		return s.getShortURL(tx, userID, item.URL, expiresAt)
+	}
+	if err := ValidateAlias(item.Alias); err != nil {
+		return "", err
+	}
+	return s.saveAlias(tx, userID, item.Alias, item.URL, expiresAt)
+}
+
+// getShortURL returns the existing short URL of the long URL or saves it under a new one in the transaction.
+//
+// It returns ErrUniqueViolation with the existing short URL if the long URL is already shortened in the dedup scope.
+func (s *BoltStorage) getShortURL(tx *bolt.Tx, userID uint64, longURL string, expiresAt time.Time) (string, error) {
+	if existing, exist := s.lookup(tx, userID, longURL); exist {
+		return existing, ErrUniqueViolation
+	}
+	return newShortURL(s.gen, longURL, func(shortURL string) error {
+		return s.insert(tx, userID, shortURL, longURL, expiresAt)
+	})
+}
+
+// saveAlias saves the long URL under the alias in the transaction.
+//
+// It returns ErrUniqueViolation with the existing short URL if the long URL is already shortened in the dedup scope
+// and ErrAliasTaken if the alias is used by another URL.
+func (s *BoltStorage) saveAlias(tx *bolt.Tx, userID uint64, alias string, longURL string, expiresAt time.Time) (string, error) {
+	if existing, exist := s.lookup(tx, userID, longURL); exist {
+		return existing, ErrUniqueViolation
+	}
+	err := s.insert(tx, userID, alias, longURL, expiresAt)
+	if errors.Is(err, ErrUniqueViolation) {
+		return alias, ErrAliasTaken
+	}
+	return alias, err
+}
+
+// GetShortURL retrieves or generates a short URL for the given long URL and user ID.
+//
+// The lookup and the save are done in a single transaction.
+//
+// ctx context.Context, userID uint64, longURL string, expiresAt time.Time
+// string, error
+func (s *BoltStorage) GetShortURL(ctx context.Context, userID uint64, longURL string, expiresAt time.Time) (string, error) {
+	var shortURL string
+
+	if err := checkContext(ctx); err != nil {
+		return "", err
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		shortURL, err = s.getShortURL(tx, userID, longURL, expiresAt)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrUniqueViolation) {
+		return "", err
+	}
+	return shortURL, err
+}
+
+// SaveAlias saves the long URL under a user-chosen alias.
+//
+// Parameters:
+// - ctx: The request context.
+// - userID: The ID of the user.
+// - alias: The alias to be used as the short URL, it should be validated with ValidateAlias.
+// - longURL: The long URL to be saved.
+// - expiresAt: The expiration time, zero for a URL that never expires.
+//
+// Returns:
+// - string: The saved alias, or the existing short URL if the long URL is already shortened.
+// - error: ErrUniqueViolation if the long URL is already shortened, ErrAliasTaken if the alias is used by another URL.
+func (s *BoltStorage) SaveAlias(ctx context.Context, userID uint64, alias string, longURL string, expiresAt time.Time) (string, error) {
+	var shortURL string
+
+	if err := checkContext(ctx); err != nil {
+		return "", err
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		shortURL, err = s.saveAlias(tx, userID, alias, longURL, expiresAt)
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrUniqueViolation) && !errors.Is(err, ErrAliasTaken) {
+		return "", err
+	}
+	return shortURL, err
+}
+
+// IsShortURLExist checks if a short URL exists in the BoltStorage.
+//
+// Parameters:
+// - ctx: the request context.
+// - shortURL: the short URL to check for existence.
+//
+// Returns:
+// - bool: true if the short URL exists, false otherwise.
+func (s *BoltStorage) IsShortURLExist(ctx context.Context, shortURL string) bool {
+	exist := false
+	s.db.View(func(tx *bolt.Tx) error {
+		exist = tx.Bucket(boltURLs).Get([]byte(shortURL)) != nil
+		return nil
+	})
+	return exist
+}
+
+// IsRealURLExist checks if a given longURL exists in the BoltStorage.
+//
+// ctx context.Context, longURL string
+// bool
+func (s *BoltStorage) IsRealURLExist(ctx context.Context, longURL string) bool {
+	exist := false
+	s.db.View(func(tx *bolt.Tx) error {
+		exist = tx.Bucket(boltLong).Get([]byte(longURL)) != nil
+		return nil
+	})
+	return exist
+}
+
+// IsReady checks if the BoltStorage is ready.
+//
+// It returns true if the database file is open.
+func (s *BoltStorage) IsReady(ctx context.Context) bool {
+	if checkContext(ctx) != nil {
+		return false
+	}
+	return s.db.View(func(tx *bolt.Tx) error { return nil }) == nil
+}
+
+// GetAllURLs retrieves all URLs associated with a specific userID from the BoltStorage.
+//
+// The deleted URLs are skipped.
+//
+// ctx: the request context
+// userID: the ID of the user
+// bAddr: base address for constructing the complete URL
+// Returns a slice of ResJSONURL containing the retrieved URLs and an error if any
+func (s *BoltStorage) GetAllURLs(ctx context.Context, userID uint64, bAddr string) ([]ResJSONURL, error) {
+	var rwJSON []ResJSONURL
+
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	prefix := userKey(userID, "")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltUsers).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			record, err := getRecord(tx, string(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if record.Deleted {
+				continue
+			}
+			rwJSON = append(rwJSON, ResJSONURL{
+				URL:    record.LongURL,
+				Result: bAddr + "/" + record.ShortURL,
+			})
+		}
+		return nil
+	})
+	return rwJSON, err
+}
+
+// GetLastID returns the last ID used for the URL records.
+//
+// It returns the sequence of the urls bucket and an error if the context is done.
+func (s *BoltStorage) GetLastID(ctx context.Context) (int, error) {
+	var lastID uint64
+
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		lastID = tx.Bucket(boltURLs).Sequence()
+		return nil
+	})
+	return int(lastID), err
+}
+
+// DeleteURLs deletes multiple URLs for a given user.
+//
+// ctx: The request context.
+// userID: The ID of the user.
+// delURLs: An array of URLs to be deleted.
+// error: An error if the deletion fails.
+func (s *BoltStorage) DeleteURLs(ctx context.Context, userID uint64, delURLs []string) error {
+	delURL := make(map[string]uint64, len(delURLs))
+	for _, url := range delURLs {
+		delURL[url] = userID
+	}
+	return s.DeleteURL(ctx, delURL)
+}
+
+// DeleteURL marks URLs as deleted in the BoltStorage.
+//
+// delURL is a map of URLs to be deleted and their corresponding user IDs,
+// URLs owned by other users are skipped. All URLs are updated in a single transaction.
+// It returns an error if there was an issue deleting the URLs, ErrStorageClosed if the storage is closed.
+func (s *BoltStorage) DeleteURL(ctx context.Context, delURL map[string]uint64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for sURL, userID := range delURL {
+			record, err := getRecord(tx, sURL)
+			if errors.Is(err, ErrURLNotFound) || record.UserID != userID || record.Deleted {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			record.Deleted = true
+			if err := putRecord(tx, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return closedError(err)
+}
+
+// GetStats retrieves the statistics of URLs and users from the BoltStorage.
+//
+// It takes the request context.
+// Returns ResJSONStats and an error.
+func (s *BoltStorage) GetStats(ctx context.Context) (ResJSONStats, error) {
+	var stats ResJSONStats
+
+	if err := checkContext(ctx); err != nil {
+		return stats, err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stats.URLCount = tx.Bucket(boltURLs).Stats().KeyN
+
+		var lastUser []byte
+		c := tx.Bucket(boltUsers).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !bytes.Equal(k[:8], lastUser) {
+				stats.UserCount++
+				lastUser = append(lastUser[:0], k[:8]...)
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// DeleteExpired marks the URLs that are expired at now as deleted in the BoltStorage.
+//
+// ctx: the request context.
+// now: the time to compare expiration times with.
+// It returns the number of deleted URLs and an error if any.
+func (s *BoltStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	count := 0
+
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var expired []fileMap
+		err := tx.Bucket(boltURLs).ForEach(func(_, v []byte) error {
+			var record fileMap
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if !record.Deleted && isExpired(record.expiresAt(), now) {
+				expired = append(expired, record)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range expired {
+			record.Deleted = true
+			if err := putRecord(tx, record); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return count, err
+}
+
+// SaveClicks saves the redirects of short URLs in the clicks bucket.
+//
+// ctx: the request context.
+// clicks: the redirects to be saved.
+// It returns an error if the clicks cannot be saved.
+func (s *BoltStorage) SaveClicks(ctx context.Context, clicks []Click) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltClicks)
+		for _, click := range clicks {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(click)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(clickKey(click.ShortURL, seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetURLStats retrieves the click stats of a short URL owned by the given user from the BoltStorage.
+//
+// ctx: the request context.
+// userID: the ID of the user.
+// shortURL: the short URL.
+// It returns the total clicks, unique visitors and a per-day histogram,
+// or ErrURLNotFound if the short URL does not exist or is owned by another user.
+func (s *BoltStorage) GetURLStats(ctx context.Context, userID uint64, shortURL string) (ResJSONURLStats, error) {
+	var clicks []Click
+
+	if err := checkContext(ctx); err != nil {
+		return ResJSONURLStats{}, err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, shortURL)
+		if err != nil {
+			return err
+		}
+		if record.UserID != userID {
+			return ErrURLNotFound
+		}
+
+		prefix := append([]byte(shortURL), 0)
+		c := tx.Bucket(boltClicks).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var click Click
+			if err := json.Unmarshal(v, &click); err != nil {
+				return err
+			}
+			clicks = append(clicks, click)
+		}
+		return nil
+	})
+	if err != nil {
+		return ResJSONURLStats{}, err
+	}
+	return clickStats(shortURL, clicks), nil
+}
+
+// SaveAPIKey saves a new API key in the apikeys bucket.
+//
+// ctx: the request context.
+// key: the API key with the hash of the key.
+// It returns an error if the key cannot be saved.
+func (s *BoltStorage) SaveAPIKey(ctx context.Context, key APIKey) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeys).Put([]byte(key.Hash), data)
+	})
+}
+
+// GetAPIKeys retrieves all API keys of the given user.
+//
+// ctx: the request context.
+// userID: the ID of the user.
+// It returns the API keys of the user sorted by creation time and an error if the keys cannot be read.
+func (s *BoltStorage) GetAPIKeys(ctx context.Context, userID uint64) ([]APIKey, error) {
+	var keys []APIKey
+
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeys).ForEach(func(_, data []byte) error {
+			var key APIKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return err
+			}
+			if key.UserID == userID {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	sortAPIKeys(keys)
+	return keys, err
+}
+
+// RevokeAPIKey deletes the API key with the given ID owned by the given user.
+//
+// ctx: the request context.
+// userID: the ID of the user.
+// id: the ID of the API key.
+// It returns ErrAPIKeyNotFound if the key does not exist or is owned by another user.
+func (s *BoltStorage) RevokeAPIKey(ctx context.Context, userID uint64, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltAPIKeys).Cursor()
+		for hash, data := cursor.First(); hash != nil; hash, data = cursor.Next() {
+			var key APIKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return err
+			}
+			if key.ID == id && key.UserID == userID {
+				return cursor.Delete()
+			}
+		}
+		return ErrAPIKeyNotFound
+	})
+}
+
+// UseAPIKey resolves the API key hash to its user and sets the last use time of the key.
+//
+// ctx: the request context.
+// hash: the hash of the API key.
+// now: the time of the use.
+// It returns the ID of the user owning the key, ErrAPIKeyNotFound if the key does not exist.
+func (s *BoltStorage) UseAPIKey(ctx context.Context, hash string, now time.Time) (uint64, error) {
+	var key APIKey
+
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAPIKeys)
+		data := bucket.Get([]byte(hash))
+		if data == nil {
+			return ErrAPIKeyNotFound
+		}
+		if err := json.Unmarshal(data, &key); err != nil {
+			return err
+		}
+		key.LastUsedAt = &now
+		data, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(hash), data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return key.UserID, nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStorage_Reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shorty.db")
+
+	bStorage, err := openBoltStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	shortURL, err := bStorage.GetShortURL(ctx, 1, "https://example.com", time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = bStorage.SaveAlias(ctx, 2, "spring-sale", "https://example.com/spring", time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := bStorage.DeleteURLs(ctx, 2, []string{"spring-sale"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bStorage.Close()
+	if err := bStorage.DeleteURLs(ctx, 1, []string{shortURL}); !errors.Is(err, ErrStorageClosed) {
+		t.Errorf("Expected ErrStorageClosed, but got %v", err)
+	}
+
+	// Everything survives a reopen
+	bStorage, err = openBoltStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer bStorage.Close()
+
+	existing, err := bStorage.GetShortURL(ctx, 1, "https://example.com", time.Time{})
+	if !errors.Is(err, ErrUniqueViolation) || existing != shortURL {
+		t.Errorf("Expected %s and ErrUniqueViolation, but got %s, %v", shortURL, existing, err)
+	}
+	longURL, err := bStorage.GetRealURL(ctx, shortURL)
+	if err != nil || longURL != "https://example.com" {
+		t.Errorf("Expected short URL to resolve, but got %q, %v", longURL, err)
+	}
+	_, err = bStorage.GetRealURL(ctx, "spring-sale")
+	if !errors.Is(err, ErrURLDeleted) {
+		t.Errorf("Expected ErrURLDeleted, but got %v", err)
+	}
+
+	urls, err := bStorage.GetAllURLs(ctx, 1, "http://localhost")
+	if err != nil || len(urls) != 1 || urls[0].Result != "http://localhost/"+shortURL {
+		t.Errorf("Expected the user URL, but got %v, %v", urls, err)
+	}
+	stats, err := bStorage.GetStats(ctx)
+	if err != nil || stats.URLCount != 2 || stats.UserCount != 2 {
+		t.Errorf("Expected 2 URLs of 2 users, but got %v, %v", stats, err)
+	}
+	lastID, err := bStorage.GetLastID(ctx)
+	if err != nil || lastID != 2 {
+		t.Errorf("Expected last ID 2, but got %d, %v", lastID, err)
+	}
+}
+
+func TestBoltStorage_GetURLStats(t *testing.T) {
+	ctx := context.Background()
+	bStorage, err := openBoltStorage(filepath.Join(t.TempDir(), "shorty.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer bStorage.Close()
+
+	_ = bStorage.Save(ctx, 1, "abc", "https://example.com/abc", time.Time{})
+	_ = bStorage.Save(ctx, 1, "abcd", "https://example.com/abcd", time.Time{})
+	_ = bStorage.SaveClicks(ctx, []Click{
+		{ShortURL: "abc", Time: time.Now(), IPPrefix: "10.0.0.0/24"},
+		{ShortURL: "abcd", Time: time.Now(), IPPrefix: "10.0.0.0/24"},
+	})
+
+	// Clicks of "abcd" are not counted for "abc"
+	stats, err := bStorage.GetURLStats(ctx, 1, "abc")
+	if err != nil || stats.Clicks != 1 {
+		t.Errorf("Expected 1 click, but got %v, %v", stats, err)
+	}
+}
+
+func TestBoltStorage_APIKeys(t *testing.T) {
+	ctx := context.Background()
+	bStorage, err := openBoltStorage(filepath.Join(t.TempDir(), "shorty.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer bStorage.Close()
+
+	now := time.Now().UTC()
+	_ = bStorage.SaveAPIKey(ctx, APIKey{ID: "key1", UserID: 1, Hash: "hash1", CreatedAt: now})
+	userID, err := bStorage.UseAPIKey(ctx, "hash1", now)
+	if err != nil || userID != 1 {
+		t.Errorf("Expected user 1, but got %d, %v", userID, err)
+	}
+	keys, _ := bStorage.GetAPIKeys(ctx, 1)
+	if len(keys) != 1 || keys[0].LastUsedAt == nil {
+		t.Errorf("Expected used key1, but got %v", keys)
+	}
+	if err := bStorage.RevokeAPIKey(ctx, 2, "key1"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound, but got %v", err)
+	}
+	_ = bStorage.RevokeAPIKey(ctx, 1, "key1")
+	if _, err := bStorage.UseAPIKey(ctx, "hash1", now); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound, but got %v", err)
+	}
+}
+
+func TestBoltStorage_DedupScope(t *testing.T) {
+	for _, scope := range dedupScopes {
+		t.Run(scope, func(t *testing.T) {
+			bStorage, err := openBoltStorage(filepath.Join(t.TempDir(), "shorty.db"))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer bStorage.Close()
+			bStorage.dedup = scope
+			checkDedupScope(t, bStorage, scope)
+		})
+	}
+}
+
+func TestBoltStorage_OwnedIndex(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shorty.db")
+
+	bStorage, err := openBoltStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	shortURL, err := bStorage.GetShortURL(ctx, 1, "https://example.com", time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// A database of an older version has no owned index
+	err = bStorage.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(boltOwned)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bStorage.Close()
+
+	bStorage, err = openBoltStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer bStorage.Close()
+	existing, err := bStorage.GetShortURL(ctx, 1, "https://example.com", time.Time{})
+	if !errors.Is(err, ErrUniqueViolation) || existing != shortURL {
+		t.Errorf("Expected %s and ErrUniqueViolation, but got %s, %v", shortURL, existing, err)
+	}
+}
+
+func TestBoltStorage_GetShortURLBatch(t *testing.T) {
+	bStorage, err := openBoltStorage(filepath.Join(t.TempDir(), "shorty.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer bStorage.Close()
+	checkGetShortURLBatch(t, bStorage)
+}
@@ -0,0 +1,348 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"math/bits"
+	mrand "math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/stsg/shorty/internal/config"
+	mylogger "github.com/stsg/shorty/internal/logger"
+)
+
+// codeAlphabet is the alphabet of the generated short URLs.
+const codeAlphabet = "1234567890ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// DefaultCodeLength is the initial length of the short URLs generated for a storage without a configured generator.
+const DefaultCodeLength = 6
+
+// DefaultCodeGrowthThreshold is the rate of the taken candidates above which the short URLs of a storage
+// without a configured generator get longer.
+const DefaultCodeGrowthThreshold = 0.1
+
+// maxCodeLength is the length the generated short URLs do not grow beyond.
+const maxCodeLength = 32
+
+// maxHashidsLength is the length the short URLs of a HashidsGenerator do not grow beyond,
+// the codes of the length are scrambled in uint64 as 62^10 fits in it and 62^11 does not.
+const maxHashidsLength = 10
+
+// codeWindow is the number of the candidates the rate of the taken ones is measured over.
+const codeWindow = 100
+
+// maxCodeAttempts limits the candidates generated for a long URL.
+const maxCodeAttempts = 32
+
+// ErrNoFreeShortURL is returned when all the candidates generated for a long URL are taken.
+var ErrNoFreeShortURL = errors.New("cannot generate a free short URL")
+
+// ErrUnknownCodeGenerator is returned for an unknown code generator strategy.
+var ErrUnknownCodeGenerator = errors.New("unknown code generator")
+
+// CodeGenerator generates the short URLs of the new long URLs.
+//
+// The storages check the candidates and ask for the next one while they are taken, the length of the generated
+// short URLs grows by one once the rate of the taken candidates exceeds the growth threshold of the generator.
+type CodeGenerator interface {
+	// Generate returns a candidate short URL of the long URL, attempt is the number of the candidates
+	// of the long URL found taken before, so that a deterministic generator can return another one.
+	Generate(longURL string, attempt int) string
+	// Report records whether a generated candidate was found taken.
+	Report(taken bool)
+	// Length returns the length of the generated short URLs.
+	Length() int
+}
+
+// NewCodeGenerator returns the generator of the strategy.
+//
+// Parameters:
+// - strategy: one of config.CodeRandom, config.CodeSequential, config.CodeHashids and config.CodeHash,
+// empty for config.CodeRandom.
+// - length: the initial length of the short URLs, DefaultCodeLength if it is not positive.
+// - threshold: the growth threshold, DefaultCodeGrowthThreshold if it is not positive.
+// - salt: the salt of the config.CodeHashids strategy.
+// - start: the first value of the counter of the config.CodeSequential and config.CodeHashids strategies.
+//
+// Returns:
+// - CodeGenerator: the generator.
+// - error: ErrUnknownCodeGenerator for an unknown strategy.
+func NewCodeGenerator(strategy string, length int, threshold float64, salt string, start uint64) (CodeGenerator, error) {
+	if length < 1 {
+		length = DefaultCodeLength
+	}
+	if threshold <= 0 {
+		threshold = DefaultCodeGrowthThreshold
+	}
+
+	switch strategy {
+	case config.CodeRandom, "":
+		return NewRandomGenerator(length, threshold), nil
+	case config.CodeSequential:
+		return NewSequentialGenerator(length, threshold, start), nil
+	case config.CodeHashids:
+		return NewHashidsGenerator(length, threshold, salt, start), nil
+	case config.CodeHash:
+		return NewHashGenerator(length, threshold), nil
+	}
+	return nil, ErrUnknownCodeGenerator
+}
+
+// newConfigCodeGenerator returns the generator configured by the config.
+//
+// lastID returns the number of the saved URLs the counter of a sequential generator starts from,
+// it is only called for such a generator.
+func newConfigCodeGenerator(conf config.Config, lastID func() (int, error)) (CodeGenerator, error) {
+	var start uint64
+
+	switch conf.GetCodeGenerator() {
+	case config.CodeSequential, config.CodeHashids:
+		id, err := lastID()
+		if err != nil {
+			return nil, err
+		}
+		start = uint64(id)
+	}
+	return NewCodeGenerator(conf.GetCodeGenerator(), conf.GetCodeLength(), conf.GetCodeGrowthThreshold(), conf.GetCodeSalt(), start)
+}
+
+// newShortURL generates the short URL of the long URL with the generator and saves it.
+//
+// save returns ErrUniqueViolation if the short URL is taken, then the next candidate is tried.
+// It returns ErrNoFreeShortURL after maxCodeAttempts taken candidates.
+func newShortURL(gen CodeGenerator, longURL string, save func(shortURL string) error) (string, error) {
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		shortURL := gen.Generate(longURL, attempt)
+		err := save(shortURL)
+		taken := errors.Is(err, ErrUniqueViolation)
+		if err == nil || taken {
+			gen.Report(taken)
+		}
+		if !taken {
+			return shortURL, err
+		}
+	}
+	return "", ErrNoFreeShortURL
+}
+
+// freeShortURL generates a short URL of the long URL with the generator that is not taken.
+//
+// It returns ErrNoFreeShortURL after maxCodeAttempts taken candidates.
+func freeShortURL(gen CodeGenerator, longURL string, taken func(shortURL string) bool) (string, error) {
+	return newShortURL(gen, longURL, func(shortURL string) error {
+		if taken(shortURL) {
+			return ErrUniqueViolation
+		}
+		return nil
+	})
+}
+
+// codeLength is the length of the short URLs of a generator, it is embedded by the generators.
+//
+// The length grows by one once more than the threshold of the candidates of a window of codeWindow ones are taken,
+// up to maxLength.
+type codeLength struct {
+	mu         sync.Mutex
+	length     int
+	maxLength  int
+	threshold  float64
+	candidates int
+	taken      int
+}
+
+// newCodeLength returns the length of the short URLs starting at length and growing at the threshold up to maxLength.
+func newCodeLength(length int, threshold float64, maxLength int) codeLength {
+	return codeLength{length: min(length, maxLength), maxLength: maxLength, threshold: threshold}
+}
+
+// Length returns the length of the generated short URLs.
+func (l *codeLength) Length() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.length
+}
+
+// Report records whether a generated candidate was found taken and grows the length of the short URLs
+// once too many candidates of the window are.
+func (l *codeLength) Report(taken bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.candidates++
+	if taken {
+		l.taken++
+	}
+	if float64(l.taken) > l.threshold*codeWindow && l.length < l.maxLength {
+		l.length++
+		mylogger.Get().Warn("too many generated short URLs are taken, generating longer ones",
+			zap.Int("taken", l.taken), zap.Int("candidates", l.candidates), zap.Int("length", l.length))
+		l.candidates, l.taken = 0, 0
+	}
+	if l.candidates >= codeWindow {
+		l.candidates, l.taken = 0, 0
+	}
+}
+
+// RandomGenerator generates cryptographically random short URLs.
+type RandomGenerator struct {
+	codeLength
+}
+
+// NewRandomGenerator returns a RandomGenerator of the short URLs of the initial length growing at the threshold.
+func NewRandomGenerator(length int, threshold float64) *RandomGenerator {
+	return &RandomGenerator{codeLength: newCodeLength(length, threshold, maxCodeLength)}
+}
+
+// Generate returns a random short URL, the long URL and the attempt are not used.
+func (g *RandomGenerator) Generate(_ string, _ int) string {
+	// 248 is the largest multiple of the alphabet size in a byte, the larger bytes are skipped to keep the codes uniform
+	const limit = 248
+
+	code := make([]byte, 0, g.Length())
+	buf := make([]byte, cap(code))
+	for len(code) < cap(code) {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		for _, b := range buf {
+			if b < limit && len(code) < cap(code) {
+				code = append(code, codeAlphabet[int(b)%len(codeAlphabet)])
+			}
+		}
+	}
+	return string(code)
+}
+
+// SequentialGenerator generates the short URLs from a counter encoded in base62 and padded to the length.
+//
+// The short URLs are unique and short, but they reveal the number of the shortened URLs.
+type SequentialGenerator struct {
+	codeLength
+	next atomic.Uint64
+}
+
+// NewSequentialGenerator returns a SequentialGenerator of the short URLs of the initial length growing
+// at the threshold, the counter starts at start.
+func NewSequentialGenerator(length int, threshold float64, start uint64) *SequentialGenerator {
+	g := &SequentialGenerator{codeLength: newCodeLength(length, threshold, maxCodeLength)}
+	g.next.Store(start)
+	return g
+}
+
+// Generate returns the short URL of the next value of the counter, the long URL and the attempt are not used.
+func (g *SequentialGenerator) Generate(_ string, _ int) string {
+	return encodeCode(g.next.Add(1)-1, g.Length(), codeAlphabet)
+}
+
+// HashidsGenerator generates the short URLs from a counter like the hashids do: the value of the counter
+// is scrambled by a bijection of the codes of the length and encoded with an alphabet shuffled by the salt.
+//
+// The short URLs are unique until the codes of the length run out, the taken ones make them longer then,
+// and they do not reveal the sequence to anyone not knowing the salt. They are maxHashidsLength long at most.
+type HashidsGenerator struct {
+	codeLength
+	next     atomic.Uint64
+	alphabet string
+	seed     [32]byte
+}
+
+// NewHashidsGenerator returns a HashidsGenerator of the short URLs of the initial length growing
+// at the threshold and scrambled with the salt, the counter starts at start.
+// A length above maxHashidsLength is cut to it.
+func NewHashidsGenerator(length int, threshold float64, salt string, start uint64) *HashidsGenerator {
+	g := &HashidsGenerator{
+		codeLength: newCodeLength(length, threshold, maxHashidsLength),
+		seed:       sha256.Sum256([]byte(salt)),
+	}
+	g.next.Store(start)
+
+	alphabet := []byte(codeAlphabet)
+	shuffle := mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(g.seed[24:]))))
+	shuffle.Shuffle(len(alphabet), func(i, j int) {
+		alphabet[i], alphabet[j] = alphabet[j], alphabet[i]
+	})
+	g.alphabet = string(alphabet)
+	return g
+}
+
+// Generate returns the scrambled short URL of the next value of the counter, the long URL and the attempt are not used.
+func (g *HashidsGenerator) Generate(_ string, _ int) string {
+	length := g.Length()
+
+	// The value is scrambled by x*mult+offset modulo the number of the codes, mult is coprime with it
+	space := uint64(1)
+	for i := 0; i < length; i++ {
+		space *= uint64(len(codeAlphabet))
+	}
+	mult := binary.BigEndian.Uint64(g.seed[:8])%space | 1
+	for mult%31 == 0 {
+		mult += 2
+	}
+	offset := binary.BigEndian.Uint64(g.seed[8:16]) % space
+
+	hi, lo := bits.Mul64(g.next.Add(1)-1, mult)
+	_, scrambled := bits.Div64(hi%space, lo, space)
+	scrambled = (scrambled + offset) % space
+	return encodeCode(scrambled, length, g.alphabet)
+}
+
+// HashGenerator generates the short URLs from the SHA-256 hash of the long URL,
+// so a long URL gets the same short URL on every instance and storage.
+//
+// The next candidates of a taken short URL hash the attempt with the long URL. The generator is meant
+// for the global dedup scope, where a long URL is shortened once, in the other scopes a long URL shortened again
+// would take the next candidate and count as a collision.
+type HashGenerator struct {
+	codeLength
+}
+
+// NewHashGenerator returns a HashGenerator of the short URLs of the initial length growing at the threshold.
+func NewHashGenerator(length int, threshold float64) *HashGenerator {
+	return &HashGenerator{codeLength: newCodeLength(length, threshold, maxCodeLength)}
+}
+
+// Generate returns the short URL of the hash of the long URL and the attempt.
+func (g *HashGenerator) Generate(longURL string, attempt int) string {
+	data := longURL
+	if attempt > 0 {
+		data += "#" + strconv.Itoa(attempt)
+	}
+	sum := sha256.Sum256([]byte(data))
+
+	// A hash has 43 base62 digits, which is more than maxCodeLength
+	n := new(big.Int).SetBytes(sum[:])
+	base := big.NewInt(int64(len(codeAlphabet)))
+	digit := new(big.Int)
+	code := make([]byte, g.Length())
+	for i := range code {
+		n.DivMod(n, base, digit)
+		code[i] = codeAlphabet[digit.Int64()]
+	}
+	return string(code)
+}
+
+// encodeCode encodes the number in the base of the alphabet, it is padded to the length with the first digit
+// of the alphabet and is longer if the number does not fit in it.
+func encodeCode(n uint64, length int, alphabet string) string {
+	base := uint64(len(alphabet))
+
+	var digits []byte
+	for n > 0 {
+		digits = append(digits, alphabet[n%base])
+		n /= base
+	}
+	for len(digits) < length {
+		digits = append(digits, alphabet[0])
+	}
+	for i, j := 0, len(digits)-1; i < j; i, j = i+1, j-1 {
+		digits[i], digits[j] = digits[j], digits[i]
+	}
+	return string(digits)
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stsg/shorty/internal/config"
+)
+
+// codeStrategies are the strategies of the code generators.
+var codeStrategies = []string{config.CodeRandom, config.CodeSequential, config.CodeHashids, config.CodeHash}
+
+func TestNewCodeGenerator(t *testing.T) {
+	for _, strategy := range codeStrategies {
+		t.Run(strategy, func(t *testing.T) {
+			gen, err := NewCodeGenerator(strategy, 7, 0.5, "salt", 0)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			seen := make(map[string]bool)
+			for i := 0; i < 1000; i++ {
+				code := gen.Generate("https://example.com/"+strings.Repeat("a", i), 0)
+				if len(code) != 7 || strings.Trim(code, codeAlphabet) != "" {
+					t.Fatalf("Expected a code of 7 characters of the alphabet, but got %q", code)
+				}
+				if seen[code] {
+					t.Fatalf("Expected unique codes, but got %q twice", code)
+				}
+				seen[code] = true
+			}
+		})
+	}
+
+	gen, err := NewCodeGenerator("", 0, 0, "", 0)
+	if err != nil || gen.Length() != DefaultCodeLength {
+		t.Errorf("Expected the default generator, but got %v, %v", gen, err)
+	}
+	if _, err := NewCodeGenerator("uuid", 6, 0.1, "", 0); !errors.Is(err, ErrUnknownCodeGenerator) {
+		t.Errorf("Expected ErrUnknownCodeGenerator, but got %v", err)
+	}
+}
+
+func TestSequentialGenerator(t *testing.T) {
+	gen := NewSequentialGenerator(4, DefaultCodeGrowthThreshold, 61)
+	for _, want := range []string{"111z", "1121", "1122"} {
+		if code := gen.Generate("", 0); code != want {
+			t.Errorf("Expected %s, but got %s", want, code)
+		}
+	}
+}
+
+func TestHashidsGenerator(t *testing.T) {
+	// The codes of the length run out without a repeat
+	gen := NewHashidsGenerator(2, 1, "salt", 0)
+	seen := make(map[string]bool)
+	for i := 0; i < len(codeAlphabet)*len(codeAlphabet); i++ {
+		code := gen.Generate("", 0)
+		if len(code) != 2 || seen[code] {
+			t.Fatalf("Expected unique codes of 2 characters, but got %q", code)
+		}
+		seen[code] = true
+	}
+
+	// The codes do not grow beyond the scrambled digits
+	gen = NewHashidsGenerator(maxHashidsLength+2, DefaultCodeGrowthThreshold, "salt", 0)
+	for i := 0; i < codeWindow; i++ {
+		gen.Report(true)
+	}
+	if code := gen.Generate("", 0); gen.Length() != maxHashidsLength || len(code) != maxHashidsLength {
+		t.Errorf("Expected codes of %d characters, but got %q", maxHashidsLength, code)
+	}
+
+	// The salt changes the codes, the same salt repeats them
+	first := NewHashidsGenerator(6, DefaultCodeGrowthThreshold, "salt", 100).Generate("", 0)
+	if code := NewHashidsGenerator(6, DefaultCodeGrowthThreshold, "salt", 100).Generate("", 0); code != first {
+		t.Errorf("Expected %s for the same salt, but got %s", first, code)
+	}
+	if code := NewHashidsGenerator(6, DefaultCodeGrowthThreshold, "pepper", 100).Generate("", 0); code == first {
+		t.Errorf("Expected another code for another salt, but got %s", code)
+	}
+}
+
+func TestHashGenerator(t *testing.T) {
+	gen := NewHashGenerator(8, DefaultCodeGrowthThreshold)
+	first := gen.Generate("https://example.com", 0)
+	if code := NewHashGenerator(8, DefaultCodeGrowthThreshold).Generate("https://example.com", 0); code != first {
+		t.Errorf("Expected %s for the same long URL, but got %s", first, code)
+	}
+	if code := gen.Generate("https://example.com", 1); code == first {
+		t.Errorf("Expected another code for the next attempt, but got %s", code)
+	}
+	if code := NewHashGenerator(4, DefaultCodeGrowthThreshold).Generate("https://example.com", 0); !strings.HasPrefix(first, code) {
+		t.Errorf("Expected a prefix of %s for a shorter length, but got %s", first, code)
+	}
+}
+
+func TestCodeLength_Report(t *testing.T) {
+	gen := NewRandomGenerator(6, 0.1)
+
+	// The taken candidates at the threshold keep the length, the ones above it grow it
+	for i := 0; i < codeWindow; i++ {
+		gen.Report(i < 10)
+	}
+	if gen.Length() != 6 {
+		t.Fatalf("Expected the length of 6, but got %d", gen.Length())
+	}
+	for i := 0; i < 11; i++ {
+		gen.Report(true)
+	}
+	if gen.Length() != 7 || len(gen.Generate("", 0)) != 7 {
+		t.Fatalf("Expected the length of 7, but got %d", gen.Length())
+	}
+
+	gen = NewRandomGenerator(maxCodeLength, 0.1)
+	for i := 0; i < codeWindow; i++ {
+		gen.Report(true)
+	}
+	if gen.Length() != maxCodeLength {
+		t.Errorf("Expected the length of %d, but got %d", maxCodeLength, gen.Length())
+	}
+}
+
+func TestNewShortURL(t *testing.T) {
+	gen := NewSequentialGenerator(6, 1, 0)
+
+	// The taken candidates are skipped
+	shortURL, err := freeShortURL(gen, "", func(shortURL string) bool { return shortURL != "111113" })
+	if err != nil || shortURL != "111113" {
+		t.Errorf("Expected 111113, but got %q, %v", shortURL, err)
+	}
+	if _, err := freeShortURL(gen, "", func(string) bool { return true }); !errors.Is(err, ErrNoFreeShortURL) {
+		t.Errorf("Expected ErrNoFreeShortURL, but got %v", err)
+	}
+
+	// An error other than a taken short URL is returned at once
+	errSave := errors.New("save failed")
+	calls := 0
+	if _, err := newShortURL(gen, "", func(string) error { calls++; return errSave }); !errors.Is(err, errSave) || calls != 1 {
+		t.Errorf("Expected the save error after a call, but got %v after %d", err, calls)
+	}
+}
+
+func TestMapStorage_CodeGenerator(t *testing.T) {
+	s, _ := NewMapStorage()
+	s.gen = NewHashGenerator(6, DefaultCodeGrowthThreshold)
+	ctx := context.Background()
+
+	shortURL, err := s.GetShortURL(ctx, 1, "https://example.com", time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := s.gen.Generate("https://example.com", 0); shortURL != want {
+		t.Errorf("Expected the hash short URL %s, but got %s", want, shortURL)
+	}
+}
+
+func BenchmarkCodeGenerators(b *testing.B) {
+	for _, strategy := range codeStrategies {
+		b.Run(strategy, func(b *testing.B) {
+			gen, _ := NewCodeGenerator(strategy, DefaultCodeLength, DefaultCodeGrowthThreshold, "salt", 0)
+			for i := 0; i < b.N; i++ {
+				gen.Generate("https://example.com", 0)
+			}
+		})
+	}
+}
@@ -2,30 +2,45 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/lib/pq"
 
 	"github.com/stsg/shorty/internal/config"
 )
 
-const uniqueViolation = pq.ErrorCode("23505")
+// copyBatchRowsMin is the number of the new rows of a batch from which they are saved with COPY.
+const copyBatchRowsMin = 1000
 
 // ErrURLDeleted error is returned when a URL is deleted.
 var ErrURLDeleted = errors.New("URL deleted")
 
+// errLongURLOwned is returned by Save in the DedupUser scope when the user already has a live short URL of the long URL.
+var errLongURLOwned = errors.New("long URL already shortened by the user")
+
 // DBStorage is a struct that holds DB storage data.
+//
+// In the user dedup scope a user keeps a single live short URL of a long URL, the inserts of a long URL
+// of a user are serialized by a transaction-level advisory lock of the pair. The global dedup scope
+// is kept by the lookups only, so two users shortening the same long URL at once may both get a new short URL.
+// The short URLs are generated by gen.
 type DBStorage struct {
-	db *sql.DB
+	db    *sql.DB
+	dedup string
+	gen   CodeGenerator
 }
 
 // NewDBStorage initializes a new DBStorage object to DB instance based on the provided config.
 //
+// The database is migrated to the latest version of the embedded migrations unless they are skipped
+// in the config, then the operators apply them with the migrate command.
+//
 // Parameter:
 // - config: config.Config - the configuration settings for the database storage.
 // Returns:
@@ -37,102 +52,117 @@ func NewDBStorage(config config.Config) (*DBStorage, error) {
 		return nil, fmt.Errorf("DB open error: %s", err)
 	}
 
-	if !IsTableExist(db, "urls") {
-		driver, err := postgres.WithInstance(db, &postgres.Config{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to create migration driver: %s", err)
-		}
-		m, err := migrate.NewWithDatabaseInstance(
-			"file://data/db/migration",
-			"postgres", driver,
-		)
+	if !config.GetSkipMigrations() {
+		err = MigrateUp(context.Background(), db)
 		if err != nil {
-			return nil, fmt.Errorf("DB migrate registration error: %s", err)
-		}
-		err = m.Up()
-		if err != nil {
-			return nil, fmt.Errorf("DB migration error: %s", err)
+			db.Close()
+			return nil, err
 		}
 	}
 
-	return &DBStorage{db: db}, nil
+	s := &DBStorage{db: db, dedup: config.GetDedupScope()}
+	s.gen, err = newConfigCodeGenerator(config, func() (int, error) { return s.GetLastID(context.Background()) })
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
 }
 
 // Save saves a short URL and its corresponding long URL to the database for a given user.
 //
 // Parameters:
+// - ctx: the request context, cancelling it aborts the query.
 // - userID: the ID of the user for whom the URL is being saved.
 // - shortURL: the shortened URL.
 // - longURL: the original URL.
+// - expiresAt: the expiration time, zero for a URL that never expires.
 //
 // Returns:
-// - error: an error if there was a problem saving the URL to the database.
-func (s *DBStorage) Save(userID uint64, shortURL string, longURL string) error {
-	var dbErr *pq.Error
-
-	query := "INSERT INTO urls(short_url, original_url, user_id, deleted) VALUES ($1, $2, $3, $4)"
-	_, err := s.db.Exec(query, shortURL, longURL, userID, false)
-	if err != nil {
-		if errors.As(err, &dbErr) && dbErr.Code == uniqueViolation {
-			return ErrUniqueViolation
-		}
-		return err
-	}
-
-	return nil
-}
-
-// SaveNew saves a new short URL in the database.
-//
-// It takes the following parameters:
-// - userID: an unsigned 64-bit integer representing the ID of the user.
-// - shortURL: a string representing the short URL.
-// - longURL: a string representing the long URL.
+// - error: ErrUniqueViolation if the short URL already exists, an error if the user already has a live short URL
+// of the long URL in the user dedup scope or if there was a problem saving the URL to the database.
 //
-// It returns an error if there was an issue saving the short URL.
-func (s *DBStorage) SaveNew(userID uint64, shortURL string, longURL string) error {
-	tx, err := s.db.Begin()
+// The URL is saved in a single transaction: in the user dedup scope the long URL of the user is locked
+// and looked up, then the row is inserted unless the short URL is taken.
+func (s *DBStorage) Save(ctx context.Context, userID uint64, shortURL string, longURL string, expiresAt time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.New("cannot start transaction when saving new short URL")
+		return contextError(ctx, err)
 	}
 	defer tx.Rollback()
 
-	if !s.IsShortURLExist(shortURL) {
-		err = s.Save(userID, shortURL, longURL)
-		if err == nil {
-			if err = tx.Commit(); err != nil {
-				return errors.New("cannot commit transaction when saving new short URL")
-			}
-			return nil
+	if s.dedup == config.DedupUser {
+		if err := lockOwnedLongURLs(ctx, tx, userID, []string{longURL}); err != nil {
+			return err
+		}
+		owned, err := queryShortURLs(ctx, tx, ownedShortURLsQuery, userID, pq.Array([]string{longURL}))
+		if err != nil {
+			return err
+		}
+		if len(owned) > 0 {
+			return errLongURLOwned
 		}
-		return errors.New("cannot save new short URL")
 	}
 
-	return ErrUniqueViolation
+	query := "INSERT INTO urls(short_url, original_url, user_id, deleted, expires_at) VALUES ($1, $2, $3, $4, $5) " +
+		"ON CONFLICT (short_url) DO NOTHING RETURNING short_url"
+	err = tx.QueryRowContext(ctx, query, shortURL, longURL, userID, false, nullTime(expiresAt)).Scan(&shortURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUniqueViolation
+	}
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+// lockOwnedLongURLs takes the transaction-level advisory locks of the long URLs of the user,
+// so the other transactions saving them wait until the transaction ends.
+//
+// The locks are taken in the order of their keys, so two transactions locking several long URLs do not deadlock.
+func lockOwnedLongURLs(ctx context.Context, tx *sql.Tx, userID uint64, longURLs []string) error {
+	query := "SELECT pg_advisory_xact_lock(k) FROM " +
+		"(SELECT DISTINCT hashtextextended(u, $1::bigint) AS k FROM unnest($2::text[]) AS u ORDER BY k) AS locks"
+	_, err := tx.ExecContext(ctx, query, userID, pq.Array(longURLs))
+	return contextError(ctx, err)
 }
 
 // GetRealURL retrieves the original URL associated with the provided short URL.
 //
-// Parameter: shortURL string
+// Parameter: ctx context.Context, shortURL string
 // Returns: string, error
-func (s *DBStorage) GetRealURL(shortURL string) (string, error) {
+//
+// ErrURLDeleted is returned for a deleted URL and ErrURLExpired for a URL past its expiration time.
+func (s *DBStorage) GetRealURL(ctx context.Context, shortURL string) (string, error) {
 	var longURL string
 	var deleted bool
+	var expiresAt sql.NullTime
 
-	query := "SELECT original_url, deleted FROM urls WHERE short_url = $1"
-	err := s.db.QueryRow(query, shortURL).Scan(&longURL, &deleted)
+	query := "SELECT original_url, deleted, expires_at FROM urls WHERE short_url = $1"
+	err := s.db.QueryRowContext(ctx, query, shortURL).Scan(&longURL, &deleted, &expiresAt)
 	if deleted {
 		return "", ErrURLDeleted
 	}
 	if err != nil {
-		return "", err
+		return "", contextError(ctx, err)
+	}
+	if isExpired(expiresAt.Time, time.Now()) {
+		return "", ErrURLExpired
 	}
 	return longURL, nil
 }
 
 // GetShortURLBatch retrieves short URLs for a batch of long URLs.
 //
+// The batch is saved in a single transaction by a few set-based queries: the long URLs already shortened
+// in the dedup scope are looked up at once, the new rows are inserted by a multi-row INSERT, or by COPY
+// for a large batch, skipping the rows conflicting with the saved ones, and the random short URLs taken
+// meanwhile are regenerated in the next round. An item that cannot be shortened is reported by its Err
+// and does not fail the batch.
+//
 // Parameters:
+// - ctx context.Context: The request context, the whole batch is aborted when it is done.
 // - userID: The ID of the user.
 // - bAddr: The base address for the short URLs.
 // - longURLs: A slice of ReqJSONBatch containing the long URLs.
@@ -140,92 +170,461 @@ func (s *DBStorage) GetRealURL(shortURL string) (string, error) {
 // Returns:
 // - rwJSON: A slice of ResJSONBatch containing the short URLs.
 // - error: An error if any occurred during the retrieval process.
-func (s *DBStorage) GetShortURLBatch(userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error) {
-	var rwJSON []ResJSONBatch
+func (s *DBStorage) GetShortURLBatch(ctx context.Context, userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error) {
+	results := make([]batchResult, len(longURLs))
+	rows := make([]batchRow, 0, len(longURLs))
+
+	now := time.Now()
+	for i, item := range longURLs {
+		expiresAt, err := ExpirationTime(item.ExpiresAt, item.TTL, now)
+		if err == nil && item.Alias != "" {
+			err = ValidateAlias(item.Alias)
+		}
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+		rows = append(rows, batchRow{
+			item:      i,
+			shortURL:  item.Alias,
+			longURL:   item.URL,
+			expiresAt: expiresAt,
+			alias:     item.Alias != "",
+		})
+	}
 
-	tx, txErr := s.db.Begin()
-	if txErr != nil {
-		return rwJSON, errors.New("cannot start transaction when saving new short URL")
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		if err := checkContext(ctx); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("cannot start transaction when saving new short URL")
 	}
 	defer tx.Rollback()
 
-	for _, rqElemJSON := range longURLs {
-		shortURL, err := s.GetShortURL(userID, rqElemJSON.URL)
-		shortURL = bAddr + "/" + shortURL
+	if err := s.saveBatch(ctx, tx, userID, rows, results); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		if err := checkContext(ctx); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("cannot commit transaction when saving new short URL")
+	}
+
+	rwJSON := make([]ResJSONBatch, 0, len(longURLs))
+	for i, rqElemJSON := range longURLs {
 		rwElemJSON := ResJSONBatch{
 			ID:     rqElemJSON.ID,
-			Result: shortURL,
+			Result: bAddr + "/" + results[i].shortURL,
 		}
-		if err != nil {
-			rwElemJSON.Result = err.Error()
+		if err := results[i].err; err != nil {
+			rwElemJSON.fail(err)
 		}
 		rwJSON = append(rwJSON, rwElemJSON)
 	}
-	if txErr = tx.Commit(); txErr != nil {
-		return rwJSON, errors.New("cannot commit transaction when saving new short URL")
-	}
 	return rwJSON, nil
 }
 
+// batchRow is a new row of a batch item.
+type batchRow struct {
+	item      int // the index of the item in the batch
+	shortURL  string
+	longURL   string
+	expiresAt time.Time
+	alias     bool
+	attempt   int // the number of the generated short URLs of the row found taken
+}
+
+// batchResult is the short URL or the error of a batch item.
+type batchResult struct {
+	shortURL string
+	err      error
+}
+
+// saveBatch saves the new rows of a batch in the transaction and sets the results of their items.
+//
+// A long URL already shortened in the dedup scope, also by an earlier item of the batch, gets the existing
+// short URL with ErrUniqueViolation and a taken alias gets ErrAliasTaken. The returned error fails the whole batch.
+//
+// In the user dedup scope the long URLs of the batch are locked first, so the user cannot save them meanwhile.
+func (s *DBStorage) saveBatch(ctx context.Context, tx *sql.Tx, userID uint64, rows []batchRow, results []batchResult) error {
+	if s.dedup == config.DedupUser {
+		if err := lockOwnedLongURLs(ctx, tx, userID, batchLongURLs(rows)); err != nil {
+			return err
+		}
+	}
+	saved, err := s.findShortURLs(ctx, tx, userID, batchLongURLs(rows))
+	if err != nil {
+		return err
+	}
+
+	for pending := rows; len(pending) > 0; {
+		// A long URL is inserted once, its later items wait for the result of the first one
+		var insert, next []batchRow
+		picked := make(map[string]bool)
+		for _, row := range pending {
+			if s.dedup != config.DedupNone {
+				if shortURL, ok := saved[row.longURL]; ok {
+					results[row.item] = batchResult{shortURL: shortURL, err: ErrUniqueViolation}
+					continue
+				}
+				if picked[row.longURL] {
+					next = append(next, row)
+					continue
+				}
+				picked[row.longURL] = true
+			}
+			insert = append(insert, row)
+		}
+		insert, err = assignShortURLs(s.gen, insert, results)
+		if err != nil {
+			return err
+		}
+
+		inserted, err := insertBatchRows(ctx, tx, userID, insert)
+		if err != nil {
+			return err
+		}
+		// A row is skipped if its short URL is taken
+		for _, row := range insert {
+			switch {
+			case inserted[row.shortURL]:
+				results[row.item] = batchResult{shortURL: row.shortURL}
+				saved[row.longURL] = row.shortURL
+				if !row.alias {
+					s.gen.Report(false)
+				}
+			case row.alias:
+				results[row.item] = batchResult{shortURL: row.shortURL, err: ErrAliasTaken}
+			default:
+				s.gen.Report(true)
+				row.attempt++
+				next = append(next, row)
+			}
+		}
+
+		sort.Slice(next, func(i, j int) bool { return next[i].item < next[j].item })
+		pending = next
+	}
+	return nil
+}
+
+// assignShortURLs sets the short URLs generated by gen of the rows without an alias, unique within the rows.
+//
+// The aliases are taken first in the order of the items, a repeated alias gets ErrAliasTaken
+// in the results and its row is dropped. ErrNoFreeShortURL is returned if all the candidates
+// generated for a row are taken.
+func assignShortURLs(gen CodeGenerator, rows []batchRow, results []batchResult) ([]batchRow, error) {
+	taken := make(map[string]bool, len(rows))
+	assigned := rows[:0]
+	for _, row := range rows {
+		if !row.alias {
+			assigned = append(assigned, row)
+			continue
+		}
+		if taken[row.shortURL] {
+			results[row.item] = batchResult{shortURL: row.shortURL, err: ErrAliasTaken}
+			continue
+		}
+		taken[row.shortURL] = true
+		assigned = append(assigned, row)
+	}
+	for i := range assigned {
+		row := &assigned[i]
+		if row.alias {
+			continue
+		}
+		for {
+			if row.attempt == maxCodeAttempts {
+				return nil, ErrNoFreeShortURL
+			}
+			row.shortURL = gen.Generate(row.longURL, row.attempt)
+			if !taken[row.shortURL] {
+				break
+			}
+			gen.Report(true)
+			row.attempt++
+		}
+		taken[row.shortURL] = true
+	}
+	return assigned, nil
+}
+
+// batchLongURLs returns the long URLs of the rows.
+func batchLongURLs(rows []batchRow) []string {
+	longURLs := make([]string, 0, len(rows))
+	for _, row := range rows {
+		longURLs = append(longURLs, row.longURL)
+	}
+	return longURLs
+}
+
+// ownedShortURLsQuery selects the live short URLs of the long URLs $2 owned by the user $1.
+const ownedShortURLsQuery = "SELECT original_url, short_url FROM urls WHERE user_id = $1 AND original_url = ANY($2) AND NOT deleted"
+
+// findShortURLs returns the live short URLs the long URLs are already shortened to in the dedup scope
+// mapped by the long URLs.
+func (s *DBStorage) findShortURLs(ctx context.Context, tx *sql.Tx, userID uint64, longURLs []string) (map[string]string, error) {
+	switch s.dedup {
+	case config.DedupGlobal:
+		query := "SELECT DISTINCT ON (original_url) original_url, short_url FROM urls " +
+			"WHERE original_url = ANY($1) AND NOT deleted ORDER BY original_url, uuid"
+		return queryShortURLs(ctx, tx, query, pq.Array(longURLs))
+	case config.DedupNone:
+		return make(map[string]string), nil
+	}
+	return queryShortURLs(ctx, tx, ownedShortURLsQuery, userID, pq.Array(longURLs))
+}
+
+// queryShortURLs runs the query selecting the long and the short URLs in the transaction
+// and returns the short URLs mapped by the long URLs.
+func queryShortURLs(ctx context.Context, tx *sql.Tx, query string, args ...any) (map[string]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	shortURLs := make(map[string]string)
+	for rows.Next() {
+		var longURL, shortURL string
+		if err := rows.Scan(&longURL, &shortURL); err != nil {
+			return nil, contextError(ctx, err)
+		}
+		shortURLs[longURL] = shortURL
+	}
+	if err := rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return shortURLs, nil
+}
+
+// insertBatchRows inserts the rows of a batch in the transaction skipping the rows conflicting with the saved ones.
+//
+// The rows are inserted by a multi-row INSERT, from copyBatchRowsMin rows on they are copied to a temporary table
+// first, which keeps the INSERT under the limit of the query parameters. It returns the inserted short URLs.
+func insertBatchRows(ctx context.Context, tx *sql.Tx, userID uint64, rows []batchRow) (map[string]bool, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	if len(rows) >= copyBatchRowsMin {
+		return copyBatchRows(ctx, tx, userID, rows)
+	}
+
+	var query strings.Builder
+	args := make([]any, 1, 1+3*len(rows))
+	args[0] = userID
+	query.WriteString("INSERT INTO urls(short_url, original_url, user_id, deleted, expires_at) VALUES ")
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&query, "($%d, $%d, $1, false, $%d)", n+1, n+2, n+3)
+		args = append(args, row.shortURL, row.longURL, nullTime(row.expiresAt))
+	}
+	query.WriteString(" ON CONFLICT DO NOTHING RETURNING short_url")
+	return queryInserted(ctx, tx, query.String(), args...)
+}
+
+// copyBatchRows copies the rows of a batch to a temporary table with COPY and inserts them from there
+// in the transaction skipping the rows conflicting with the saved ones.
+//
+// It returns the inserted short URLs.
+func copyBatchRows(ctx context.Context, tx *sql.Tx, userID uint64, rows []batchRow) (map[string]bool, error) {
+	query := "CREATE TEMP TABLE IF NOT EXISTS urls_batch (short_url text, original_url text, expires_at timestamptz) ON COMMIT DROP"
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if _, err := tx.ExecContext(ctx, "TRUNCATE urls_batch"); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("urls_batch", "short_url", "original_url", "expires_at"))
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer stmt.Close()
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row.shortURL, row.longURL, nullTime(row.expiresAt)); err != nil {
+			return nil, contextError(ctx, err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	query = "INSERT INTO urls(short_url, original_url, user_id, deleted, expires_at) " +
+		"SELECT short_url, original_url, $1::bigint, false, expires_at FROM urls_batch " +
+		"ON CONFLICT DO NOTHING RETURNING short_url"
+	return queryInserted(ctx, tx, query, userID)
+}
+
+// queryInserted runs the INSERT query returning the short URLs in the transaction and returns them.
+func queryInserted(ctx context.Context, tx *sql.Tx, query string, args ...any) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	inserted := make(map[string]bool)
+	for rows.Next() {
+		var shortURL string
+		if err := rows.Scan(&shortURL); err != nil {
+			return nil, contextError(ctx, err)
+		}
+		inserted[shortURL] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return inserted, nil
+}
+
 // GetShortURL retrieves or generates a short URL for the given long URL and user ID.
 //
 // Parameters:
+// - ctx context.Context: the request context.
 // - userID uint64: the user ID associated with the URL.
 // - longURL string: the long URL to generate a short URL for.
+// - expiresAt time.Time: the expiration time of a new short URL, zero for a URL that never expires.
 // Return type(s): string, error
-func (s *DBStorage) GetShortURL(userID uint64, longURL string) (string, error) {
-	var shortURL string
-	query := "SELECT short_url FROM urls WHERE original_url = $1"
-	err := s.db.QueryRow(query, longURL).Scan(&shortURL)
-	if !errors.Is(err, sql.ErrNoRows) {
+//
+// The existing short URL and ErrUniqueViolation are returned if the long URL is already shortened in the dedup scope.
+func (s *DBStorage) GetShortURL(ctx context.Context, userID uint64, longURL string, expiresAt time.Time) (string, error) {
+	shortURL, err := s.findShortURL(ctx, userID, longURL)
+	if err == nil {
 		return shortURL, ErrUniqueViolation
 	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
 
-	shortURL = GenShortURL()
+	shortURL, err = newShortURL(s.gen, longURL, func(shortURL string) error {
+		return s.Save(ctx, userID, shortURL, longURL, expiresAt)
+	})
+	if errors.Is(err, errLongURLOwned) {
+		return s.ownedConflict(ctx, userID, longURL)
+	}
+	if err != nil {
+		return "", err
+	}
+	return shortURL, nil
+}
 
-	for {
-		err = s.SaveNew(userID, shortURL, longURL)
-		if err == nil {
-			return shortURL, nil
-		}
-		if !errors.Is(err, ErrUniqueViolation) {
-			return "", err
-		}
-		shortURL = GenShortURL()
+// findShortURL returns the live short URL the long URL is already shortened to in the dedup scope.
+//
+// It returns sql.ErrNoRows if there is none.
+func (s *DBStorage) findShortURL(ctx context.Context, userID uint64, longURL string) (string, error) {
+	var shortURL string
+
+	switch s.dedup {
+	case config.DedupGlobal:
+		query := "SELECT short_url FROM urls WHERE original_url = $1 AND NOT deleted ORDER BY uuid LIMIT 1"
+		err := s.db.QueryRowContext(ctx, query, longURL).Scan(&shortURL)
+		return shortURL, contextError(ctx, err)
+	case config.DedupNone:
+		return "", sql.ErrNoRows
+	}
+	return s.ownedShortURL(ctx, userID, longURL)
+}
+
+// ownedShortURL returns the live short URL of the long URL owned by the user.
+//
+// It returns sql.ErrNoRows if there is none.
+func (s *DBStorage) ownedShortURL(ctx context.Context, userID uint64, longURL string) (string, error) {
+	var shortURL string
+
+	query := "SELECT short_url FROM urls WHERE user_id = $1 AND original_url = $2 AND NOT deleted"
+	err := s.db.QueryRowContext(ctx, query, userID, longURL).Scan(&shortURL)
+	return shortURL, contextError(ctx, err)
+}
+
+// ownedConflict returns the live short URL of the long URL the user saved concurrently with ErrUniqueViolation.
+//
+// It is called when the user saved the long URL in the user dedup scope after it was looked up.
+func (s *DBStorage) ownedConflict(ctx context.Context, userID uint64, longURL string) (string, error) {
+	shortURL, err := s.ownedShortURL(ctx, userID, longURL)
+	if err != nil {
+		return "", err
+	}
+	return shortURL, ErrUniqueViolation
+}
+
+// SaveAlias saves the long URL under a user-chosen alias.
+//
+// Parameters:
+// - ctx context.Context: the request context.
+// - userID uint64: the user ID associated with the URL.
+// - alias string: the alias to be used as the short URL, it should be validated with ValidateAlias.
+// - longURL string: the long URL to be saved.
+// - expiresAt time.Time: the expiration time, zero for a URL that never expires.
+// Return type(s): string, error
+//
+// The existing short URL and ErrUniqueViolation are returned if the long URL is already shortened in the dedup scope,
+// the alias and ErrAliasTaken are returned if the alias is used by another URL.
+func (s *DBStorage) SaveAlias(ctx context.Context, userID uint64, alias string, longURL string, expiresAt time.Time) (string, error) {
+	shortURL, err := s.findShortURL(ctx, userID, longURL)
+	if err == nil {
+		return shortURL, ErrUniqueViolation
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	err = s.Save(ctx, userID, alias, longURL, expiresAt)
+	if errors.Is(err, errLongURLOwned) {
+		return s.ownedConflict(ctx, userID, longURL)
+	}
+	if errors.Is(err, ErrUniqueViolation) {
+		return alias, ErrAliasTaken
 	}
+	if err != nil {
+		return "", err
+	}
+	return alias, nil
 }
 
 // IsShortURLExist checks if the short URL exists in the DBStorage.
 //
-// shortURL string
+// ctx context.Context, shortURL string
 // bool
-func (s *DBStorage) IsShortURLExist(shortURL string) bool {
+func (s *DBStorage) IsShortURLExist(ctx context.Context, shortURL string) bool {
 	var longURL string
 	query := "SELECT original_url FROM urls WHERE short_url = $1"
-	err := s.db.QueryRow(query, shortURL).Scan(&longURL)
+	err := s.db.QueryRowContext(ctx, query, shortURL).Scan(&longURL)
 	return !errors.Is(err, sql.ErrNoRows)
 }
 
 // IsRealURLExist checks if the given long URL exists in the database.
 //
-// longURL string
+// ctx context.Context, longURL string
 // bool
-func (s *DBStorage) IsRealURLExist(longURL string) bool {
+func (s *DBStorage) IsRealURLExist(ctx context.Context, longURL string) bool {
 	var shortURL string
-	query := "SELECT short_url FROM urls WHERE original_url = $1"
-	err := s.db.QueryRow(query, longURL).Scan(&shortURL)
+	query := "SELECT short_url FROM urls WHERE original_url = $1 AND NOT deleted LIMIT 1"
+	err := s.db.QueryRowContext(ctx, query, longURL).Scan(&shortURL)
 	return !errors.Is(err, sql.ErrNoRows)
 }
 
 // IsReady checks if the DBStorage is ready.
 //
-// No parameters.
+// It takes the request context.
 // Returns a boolean value.
-func (s *DBStorage) IsReady() bool {
-	err := s.db.Ping()
+func (s *DBStorage) IsReady(ctx context.Context) bool {
+	err := s.db.PingContext(ctx)
 	return err == nil
 }
 
+// Close closes the database pool of the DBStorage.
+//
+// It returns an error if there was a problem closing the pool.
+func (s *DBStorage) Close() error {
+	return s.db.Close()
+}
+
 // IsTableExist checks if a table exists in the database.
 //
 // It takes a *sql.DB object and a string representing the table name as parameters.
@@ -237,23 +636,23 @@ func IsTableExist(db *sql.DB, table string) bool {
 	return err == nil
 }
 
-// GetAllURLs retrieves all URLs for a given user and base address.
+// GetAllURLs retrieves all URLs for a given user and base address, the deleted URLs are skipped.
 //
-// userID uint64, bAddr string
+// ctx context.Context, userID uint64, bAddr string
 // []ResJSONURL, error
-func (s *DBStorage) GetAllURLs(userID uint64, bAddr string) ([]ResJSONURL, error) {
+func (s *DBStorage) GetAllURLs(ctx context.Context, userID uint64, bAddr string) ([]ResJSONURL, error) {
 	var rwJSON []ResJSONURL
-	query := "SELECT short_url, original_url FROM urls WHERE user_id = $1"
-	rows, err := s.db.Query(query, userID)
+	query := "SELECT short_url, original_url FROM urls WHERE user_id = $1 AND NOT deleted ORDER BY uuid"
+	rows, err := s.db.QueryContext(ctx, query, userID)
 	if err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var shortURL, longURL string
 		if err := rows.Scan(&shortURL, &longURL); err != nil {
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 		shortURL = bAddr + "/" + shortURL
 		rwJSON = append(rwJSON, ResJSONURL{
@@ -262,20 +661,21 @@ func (s *DBStorage) GetAllURLs(userID uint64, bAddr string) ([]ResJSONURL, error
 		})
 	}
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
 	return rwJSON, nil
 }
 
 // GetLastID retrieves the last ID from the "urls" table in the database.
 //
+// It takes the request context.
 // It returns an integer representing the last ID and an error if any occurred.
-func (s *DBStorage) GetLastID() (int, error) {
+func (s *DBStorage) GetLastID(ctx context.Context) (int, error) {
 	var lastID sql.NullInt64
 	query := "SELECT MAX(uuid) FROM urls"
-	err := s.db.QueryRow(query).Scan(&lastID)
+	err := s.db.QueryRowContext(ctx, query).Scan(&lastID)
 	if err != nil {
-		return 0, err
+		return 0, contextError(ctx, err)
 	}
 	if !lastID.Valid {
 		return 0, nil
@@ -283,41 +683,55 @@ func (s *DBStorage) GetLastID() (int, error) {
 	return int(lastID.Int64), nil
 }
 
+// deleteURLsQuery marks the short URLs $2 of the user $1 as deleted.
+const deleteURLsQuery = "UPDATE urls SET deleted = true WHERE user_id = $1 AND short_url = ANY($2) AND NOT deleted"
+
 // DeleteURLs deletes URLs associated with a specific user.
 //
+// The URLs are marked as deleted by a single UPDATE.
+//
+// ctx: the request context.
 // userID: the ID of the user whose URLs are being deleted.
 // delURLs: a slice of strings containing the URLs to be deleted.
 // error: an error indicating any issues that occurred during the deletion process.
-func (s *DBStorage) DeleteURLs(userID uint64, delURLs []string) error {
-	for _, i := range delURLs {
-		query := "UPDATE urls SET deleted = true WHERE short_url = $1 and user_id = $2"
-		_, err := s.db.Exec(query, i, userID)
-		if err != nil {
-			return err
-		}
+func (s *DBStorage) DeleteURLs(ctx context.Context, userID uint64, delURLs []string) error {
+	if len(delURLs) == 0 {
+		return nil
 	}
-
-	return nil
+	_, err := s.db.ExecContext(ctx, deleteURLsQuery, userID, pq.Array(delURLs))
+	return contextError(ctx, err)
 }
 
 // DeleteURL updates the "deleted" field in the "urls" table for the given short URLs and user IDs.
 //
-// It takes a map of short URLs to user IDs as input. The function iterates over the map and
-// executes an SQL query to update the "deleted" field to true for each short URL and user ID
-// combination. If any error occurs during the execution of the query, it is returned.
+// It takes the request context and a map of short URLs to user IDs as input. The short URLs are grouped
+// by the users and marked as deleted by a single UPDATE per user in one transaction.
 //
-// The function returns an error if there was an error executing the SQL query, otherwise it
-// returns nil.
-func (s *DBStorage) DeleteURL(delURL map[string]uint64) error {
-	query := "UPDATE urls SET deleted = true WHERE short_url = $1 and user_id = $2"
+// The function returns an error if there was an error executing the SQL query, ErrStorageClosed
+// if the database is closed, otherwise it returns nil.
+func (s *DBStorage) DeleteURL(ctx context.Context, delURL map[string]uint64) error {
+	if len(delURL) == 0 {
+		return nil
+	}
+	byUser := make(map[uint64][]string)
 	for sURL, userID := range delURL {
-		_, err := s.db.Exec(query, sURL, userID)
+		byUser[userID] = append(byUser[userID], sURL)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return closedError(contextError(ctx, err))
+	}
+	defer tx.Rollback()
+
+	for userID, shortURLs := range byUser {
+		_, err := tx.ExecContext(ctx, deleteURLsQuery, userID, pq.Array(shortURLs))
 		if err != nil {
-			return err
+			return contextError(ctx, err)
 		}
 	}
 
-	return nil
+	return contextError(ctx, tx.Commit())
 }
 
 // GetStats retrieves statistics about the URLs stored in the database.
@@ -329,15 +743,211 @@ func (s *DBStorage) DeleteURL(delURL map[string]uint64) error {
 // Returns:
 // - ResJSONStats: A struct containing the counts of URLs and users.
 // - error: An error if the query execution fails.
-func (s *DBStorage) GetStats() (ResJSONStats, error) {
+func (s *DBStorage) GetStats(ctx context.Context) (ResJSONStats, error) {
 	var urls, users sql.NullInt64
 	query := "SELECT COUNT DISTINCT(short_url) AS urls, COUNT(DISTINCT user_id) AS users FROM urls"
-	err := s.db.QueryRow(query).Scan(&urls, &users)
+	err := s.db.QueryRowContext(ctx, query).Scan(&urls, &users)
 	if err != nil {
-		return ResJSONStats{}, err
+		return ResJSONStats{}, contextError(ctx, err)
 	}
 	return ResJSONStats{
 		URLCount:  int(urls.Int64),
 		UserCount: int(users.Int64),
 	}, nil
 }
+
+// DeleteExpired marks the URLs that are expired at now as deleted in the "urls" table.
+//
+// Parameters:
+// - ctx: the request context.
+// - now: the time to compare expiration times with.
+//
+// Returns:
+// - int: the number of deleted URLs.
+// - error: an error if the query execution fails.
+func (s *DBStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	query := "UPDATE urls SET deleted = true WHERE NOT deleted AND expires_at IS NOT NULL AND expires_at <= $1"
+	res, err := s.db.ExecContext(ctx, query, now)
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// SaveClicks saves the redirects of short URLs to the "clicks" table in a single transaction.
+//
+// Parameters:
+// - ctx: the request context.
+// - clicks: the redirects to be saved.
+//
+// Returns:
+// - error: an error if the clicks cannot be saved.
+func (s *DBStorage) SaveClicks(ctx context.Context, clicks []Click) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO clicks(short_url, clicked_at, referrer, user_agent, ip_prefix) VALUES ($1, $2, $3, $4, $5)"
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer stmt.Close()
+
+	for _, click := range clicks {
+		_, err = stmt.ExecContext(ctx, click.ShortURL, click.Time, click.Referrer, click.UserAgent, click.IPPrefix)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+// GetURLStats retrieves the click stats of a short URL owned by the given user.
+//
+// Parameters:
+// - ctx: the request context.
+// - userID: the ID of the user.
+// - shortURL: the short URL.
+//
+// Returns:
+// - ResJSONURLStats: the total clicks, unique visitors and a per-day histogram.
+// - error: ErrURLNotFound if the short URL does not exist or is owned by another user.
+func (s *DBStorage) GetURLStats(ctx context.Context, userID uint64, shortURL string) (ResJSONURLStats, error) {
+	var owner uint64
+
+	query := "SELECT user_id FROM urls WHERE short_url = $1"
+	err := s.db.QueryRowContext(ctx, query, shortURL).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID) {
+		return ResJSONURLStats{}, ErrURLNotFound
+	}
+	if err != nil {
+		return ResJSONURLStats{}, contextError(ctx, err)
+	}
+
+	stats := ResJSONURLStats{
+		ShortURL: shortURL,
+		Daily:    []ResJSONDailyStats{},
+	}
+	query = "SELECT COUNT(*), COUNT(DISTINCT (ip_prefix, user_agent)) FROM clicks WHERE short_url = $1"
+	err = s.db.QueryRowContext(ctx, query, shortURL).Scan(&stats.Clicks, &stats.UniqueVisitors)
+	if err != nil {
+		return ResJSONURLStats{}, contextError(ctx, err)
+	}
+
+	query = "SELECT to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, COUNT(*) FROM clicks WHERE short_url = $1 GROUP BY day ORDER BY day"
+	rows, err := s.db.QueryContext(ctx, query, shortURL)
+	if err != nil {
+		return ResJSONURLStats{}, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day ResJSONDailyStats
+		if err := rows.Scan(&day.Date, &day.Clicks); err != nil {
+			return ResJSONURLStats{}, contextError(ctx, err)
+		}
+		stats.Daily = append(stats.Daily, day)
+	}
+	if err := rows.Err(); err != nil {
+		return ResJSONURLStats{}, contextError(ctx, err)
+	}
+	return stats, nil
+}
+
+// nullTime converts an expiration time to sql.NullTime, a zero time is stored as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// SaveAPIKey saves a new API key in the api_keys table.
+//
+// ctx: the request context.
+// key: the API key with the hash of the key.
+// It returns an error if the key cannot be saved.
+func (s *DBStorage) SaveAPIKey(ctx context.Context, key APIKey) error {
+	query := "INSERT INTO api_keys (id, user_id, hash, name, created_at) VALUES ($1, $2, $3, $4, $5)"
+	_, err := s.db.ExecContext(ctx, query, key.ID, key.UserID, key.Hash, key.Name, key.CreatedAt)
+	return contextError(ctx, err)
+}
+
+// GetAPIKeys retrieves all API keys of the given user.
+//
+// ctx: the request context.
+// userID: the ID of the user.
+// It returns the API keys of the user sorted by creation time and an error if the keys cannot be read.
+func (s *DBStorage) GetAPIKeys(ctx context.Context, userID uint64) ([]APIKey, error) {
+	var keys []APIKey
+
+	query := "SELECT id, user_id, hash, name, created_at, last_used_at FROM api_keys WHERE user_id = $1 ORDER BY created_at"
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key APIKey
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.UserID, &key.Hash, &key.Name, &key.CreatedAt, &lastUsedAt); err != nil {
+			return nil, contextError(ctx, err)
+		}
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey deletes the API key with the given ID owned by the given user.
+//
+// ctx: the request context.
+// userID: the ID of the user.
+// id: the ID of the API key.
+// It returns ErrAPIKeyNotFound if the key does not exist or is owned by another user.
+func (s *DBStorage) RevokeAPIKey(ctx context.Context, userID uint64, id string) error {
+	query := "DELETE FROM api_keys WHERE id = $1 AND user_id = $2"
+	result, err := s.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// UseAPIKey resolves the API key hash to its user and sets the last use time of the key.
+//
+// ctx: the request context.
+// hash: the hash of the API key.
+// now: the time of the use.
+// It returns the ID of the user owning the key, ErrAPIKeyNotFound if the key does not exist.
+func (s *DBStorage) UseAPIKey(ctx context.Context, hash string, now time.Time) (uint64, error) {
+	var userID uint64
+
+	query := "UPDATE api_keys SET last_used_at = $2 WHERE hash = $1 RETURNING user_id"
+	err := s.db.QueryRowContext(ctx, query, hash, now).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+	return userID, nil
+}
@@ -2,45 +2,118 @@ package storage
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/stsg/shorty/internal/config"
 )
 
+// Log compaction thresholds.
+//
+// The file is compacted when it has at least compactMinLines lines
+// and the tombstones make up at least compactRatio of them.
+const (
+	compactMinLines = 100
+	compactRatio    = 0.25
+)
+
 // FileStorage is a struct that holds FS storage data.
+//
+// The file is an append-only log of JSON lines. A deletion is written as a tombstone
+// line with the short URL, the user ID and deleted set to true, it is applied to the
+// record of the short URL on replay. The log is rewritten by Compact when the
+// tombstones make up too much of it.
+//
+// The records are kept in fm in the order of the file, short, long, owned and users are
+// the indexes of the records by short URL, long URL, long URL of a user and user ID,
+// long and owned only index the records that are not deleted.
+// The FileStorage is safe for concurrent use, mu guards the records, the indexes and the file.
+//
+// A long URL is shortened once in the dedup scope, the per-user scope unless it is set by NewFileStorage.
+// The short URLs are generated by gen, random ones of DefaultCodeLength unless it is set by NewFileStorage.
 type FileStorage struct {
-	File  *os.File
-	Path  string
-	fm    []fileMap
-	count int
+	mu         sync.RWMutex
+	dedup      string
+	gen        CodeGenerator
+	File       *os.File
+	Path       string
+	ClicksPath string
+	KeysPath   string
+	fm         []fileMap
+	short      map[string]int
+	long       map[string]int
+	owned      map[ownerKey]int
+	users      map[uint64][]int
+	clicks     map[string][]Click
+	apiKeys    map[string]APIKey
+	count      int
+	tombstones int
 }
 
 // URL file storage srtruct
-// A struct named fileMap with five fields: UUID, ShortURL, LongURL, UserID, and Deleted.
+// A struct named fileMap with six fields: UUID, ShortURL, LongURL, UserID, Deleted and ExpiresAt.
 // Each field is tagged with a JSON key that determines
 // how the struct is serialized or deserialized to/from JSON.
 // The UUID field is a string, ShortURL and LongURL are both strings,
-// UserID is an unsigned 64-bit integer, and Deleted is a boolean.
+// UserID is an unsigned 64-bit integer, Deleted is a boolean
+// and ExpiresAt is a time pointer, nil for a URL that never expires.
 type fileMap struct {
-	UUID     string `json:"uuid"`
-	ShortURL string `json:"short_url"`
-	LongURL  string `json:"original_url"`
-	UserID   uint64 `json:"user_id"`
-	Deleted  bool   `json:"deleted"`
+	UUID      string     `json:"uuid"`
+	ShortURL  string     `json:"short_url"`
+	LongURL   string     `json:"original_url"`
+	UserID    uint64     `json:"user_id"`
+	Deleted   bool       `json:"deleted"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// expiresAt returns the expiration time of the record, zero if it never expires.
+func (fm fileMap) expiresAt() time.Time {
+	if fm.ExpiresAt == nil {
+		return time.Time{}
+	}
+	return *fm.ExpiresAt
 }
 
 // NewFileStorage creates a new FileStorage instance.
 //
 // It takes a config.Config object as a parameter and returns a pointer to a FileStorage object and an error.
+// The clicks are kept next to the URLs in a file with the ".clicks" suffix,
+// the API keys in a file with the ".keys" suffix.
 func NewFileStorage(config config.Config) (*FileStorage, error) {
+	fs, err := openFileStorage(config.GetFileStorage())
+	if err != nil {
+		return nil, err
+	}
+	fs.dedup = config.GetDedupScope()
+	fs.gen, err = newConfigCodeGenerator(config, func() (int, error) { return fs.count, nil })
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// openFileStorage replays the log at the path and loads the clicks.
+func openFileStorage(path string) (*FileStorage, error) {
 	var fMap fileMap
 
 	fs := &FileStorage{
-		Path:  config.GetFileStorage(),
-		count: 0,
+		gen:        NewRandomGenerator(DefaultCodeLength, DefaultCodeGrowthThreshold),
+		Path:       path,
+		ClicksPath: path + ".clicks",
+		KeysPath:   path + ".keys",
+		short:      make(map[string]int),
+		long:       make(map[string]int),
+		owned:      make(map[ownerKey]int),
+		users:      make(map[uint64][]int),
+		clicks:     make(map[string][]Click),
+		apiKeys:    make(map[string]APIKey),
+		count:      0,
 	}
 	err := fs.Open()
 	if err != nil {
@@ -51,51 +124,315 @@ func NewFileStorage(config config.Config) (*FileStorage, error) {
 	scanner := bufio.NewScanner(fs.File)
 	for scanner.Scan() {
 		line := scanner.Bytes()
+		fMap = fileMap{}
 		err := json.Unmarshal(line, &fMap)
 		if err != nil {
 			continue
 		}
-		fs.fm = append(fs.fm, fMap)
-		fs.count += 1
+		if fMap.Deleted && fs.applyTombstone(fMap) {
+			fs.tombstones += 1
+			continue
+		}
+		fs.add(fMap)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	err = fs.loadClicks()
+	if err != nil {
+		return nil, err
+	}
+
+	err = fs.loadAPIKeys()
+	if err != nil {
+		return nil, err
 	}
 
 	return fs, nil
 }
 
+// applyTombstone marks the record of the tombstone short URL as deleted.
+//
+// It returns false if there is no such record owned by the tombstone user,
+// the line is then a deleted record written by Compact.
+func (s *FileStorage) applyTombstone(tombstone fileMap) bool {
+	key, exist := s.short[tombstone.ShortURL]
+	if !exist || s.fm[key].UserID != tombstone.UserID {
+		return false
+	}
+	s.fm[key].Deleted = true
+	s.unindex(key)
+	return true
+}
+
+// add appends the record to fm and adds it to the indexes.
+//
+// The indexes keep the first record of a short URL or a long URL,
+// a deleted record written by Compact is not indexed by its long URL.
+func (s *FileStorage) add(record fileMap) {
+	key := len(s.fm)
+	s.fm = append(s.fm, record)
+	if _, exist := s.short[record.ShortURL]; !exist {
+		s.short[record.ShortURL] = key
+	}
+	if !record.Deleted {
+		if _, exist := s.long[record.LongURL]; !exist {
+			s.long[record.LongURL] = key
+		}
+		if _, exist := s.owned[ownerKey{record.UserID, record.LongURL}]; !exist {
+			s.owned[ownerKey{record.UserID, record.LongURL}] = key
+		}
+	}
+	s.users[record.UserID] = append(s.users[record.UserID], key)
+	s.count += 1
+}
+
+// unindex removes the deleted record from the long URL indexes, so the long URL can be shortened again.
+func (s *FileStorage) unindex(key int) {
+	record := s.fm[key]
+	if s.long[record.LongURL] == key {
+		delete(s.long, record.LongURL)
+	}
+	if s.owned[ownerKey{record.UserID, record.LongURL}] == key {
+		delete(s.owned, ownerKey{record.UserID, record.LongURL})
+	}
+}
+
+// lookup returns the key of the record the long URL is already shortened in within the dedup scope,
+// the caller holds the lock.
+func (s *FileStorage) lookup(userID uint64, longURL string) (int, bool) {
+	switch s.dedup {
+	case config.DedupGlobal:
+		key, exist := s.long[longURL]
+		return key, exist
+	case config.DedupNone:
+		return 0, false
+	}
+	key, exist := s.owned[ownerKey{userID, longURL}]
+	return key, exist
+}
+
+// loadClicks reads the clicks file into memory.
+//
+// A missing clicks file is not an error, lines that cannot be parsed are skipped.
+func (s *FileStorage) loadClicks() error {
+	file, err := os.Open(s.ClicksPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var click Click
+		if err := json.Unmarshal(scanner.Bytes(), &click); err != nil {
+			continue
+		}
+		s.clicks[click.ShortURL] = append(s.clicks[click.ShortURL], click)
+	}
+	return scanner.Err()
+}
+
+// loadAPIKeys reads the API keys file into memory.
+//
+// A missing API keys file is not an error, lines that cannot be parsed are skipped.
+func (s *FileStorage) loadAPIKeys() error {
+	file, err := os.Open(s.KeysPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var key APIKey
+		if err := json.Unmarshal(scanner.Bytes(), &key); err != nil {
+			continue
+		}
+		s.apiKeys[key.Hash] = key
+	}
+	return scanner.Err()
+}
+
+// writeAPIKeys rewrites the API keys file with the keys in memory, the caller holds the write lock.
+//
+// The file is small, so it is replaced as a whole on every change.
+func (s *FileStorage) writeAPIKeys() error {
+	return rewriteFile(s.KeysPath, 0600, func(writer *bufio.Writer) error {
+		encoder := json.NewEncoder(writer)
+		for _, key := range s.apiKeys {
+			if err := encoder.Encode(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Save saves the given short URL and long URL for the specified user ID.
 //
 // Parameters:
+// - ctx: The request context.
 // - userID: The ID of the user.
 // - shortURL: The shortened URL.
 // - longURL: The original URL.
+// - expiresAt: The expiration time, zero for a URL that never expires.
 //
 // Returns:
 // - error: An error if the save operation fails.
-func (s *FileStorage) Save(userID uint64, shortURL string, longURL string) error {
+func (s *FileStorage) Save(ctx context.Context, userID uint64, shortURL string, longURL string, expiresAt time.Time) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(userID, shortURL, longURL, expiresAt)
+}
+
+// save appends the record to the file and adds it to the indexes, the caller holds the write lock.
+func (s *FileStorage) save(userID uint64, shortURL string, longURL string, expiresAt time.Time) error {
 	var fMap = fileMap{
 		UUID:     strconv.Itoa(s.count),
 		ShortURL: shortURL,
 		LongURL:  longURL,
 		UserID:   userID,
 	}
-	s.fm = append(s.fm, fMap)
-	jsonData, err := json.Marshal(fMap)
+	if !expiresAt.IsZero() {
+		fMap.ExpiresAt = &expiresAt
+	}
+	err := s.appendLines([]fileMap{fMap})
 	if err != nil {
 		return err
 	}
-	err = s.Open()
+	s.add(fMap)
+	return nil
+}
+
+// appendLines writes the records to the end of the file, one JSON line each.
+//
+// The lines are written with a single write, so a batch of tombstones is appended as a whole.
+func (s *FileStorage) appendLines(records []fileMap) error {
+	var data []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+		data = append(data, byte('\n'))
+	}
+	err := s.Open()
 	if err != nil {
 		return err
 	}
 	defer s.File.Close()
-	_, err = s.File.Write(append(jsonData, byte('\n')))
+	_, err = s.File.Write(data)
+	return err
+}
+
+// deleteRecords marks the records with the given keys as deleted and appends their tombstones to the file.
+//
+// The in-memory records are only changed after the tombstones are written.
+// The file is compacted afterwards if the tombstones make up too much of it.
+func (s *FileStorage) deleteRecords(keys []int) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	tombstones := make([]fileMap, 0, len(keys))
+	for _, key := range keys {
+		tombstones = append(tombstones, fileMap{
+			ShortURL: s.fm[key].ShortURL,
+			UserID:   s.fm[key].UserID,
+			Deleted:  true,
+		})
+	}
+	err := s.appendLines(tombstones)
 	if err != nil {
 		return err
 	}
-	s.count += 1
+	for _, key := range keys {
+		s.fm[key].Deleted = true
+		s.unindex(key)
+	}
+	s.tombstones += len(tombstones)
+
+	lines := s.count + s.tombstones
+	if lines >= compactMinLines && float64(s.tombstones) >= compactRatio*float64(lines) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Compact rewrites the file without tombstones.
+//
+// Every record is written once, a deleted record keeps its deleted flag, so the short URL
+// is still reported as deleted and is never given out again. The file is replaced
+// atomically, so the storage file is always complete even if the compaction fails.
+//
+// Returns:
+// - error: An error if the file cannot be rewritten.
+func (s *FileStorage) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+// compact rewrites the file without tombstones, the caller holds the write lock.
+func (s *FileStorage) compact() error {
+	err := rewriteFile(s.Path, 0644, func(writer *bufio.Writer) error {
+		encoder := json.NewEncoder(writer)
+		for _, record := range s.fm {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.tombstones = 0
 	return nil
 }
 
+// rewriteFile atomically replaces the file at the path with the data written by write.
+//
+// The data is written to a temporary file next to the file which then replaces it with a rename,
+// so the file is always complete even if writing fails.
+func rewriteFile(path string, perm os.FileMode, write func(writer *bufio.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 // Open opens the file storage and returns an error if unsuccessful.
 //
 // No parameters.
@@ -111,31 +448,59 @@ func (s *FileStorage) Open() error {
 
 // Close closes the FileStorage.
 //
+// The file is opened for every write and closed after it, so Close waits for the write in progress
+// and closes the file only if it is still open.
+//
 // It returns an error if there was a problem closing the file.
 func (s *FileStorage) Close() error {
-	return s.File.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.File == nil {
+		return nil
+	}
+	err := s.File.Close()
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
 }
 
 // GetRealURL retrieves the corresponding long URL for a given short URL from the FileStorage.
 //
 // Parameters:
+// - ctx: the request context.
 // - shortURL: the short URL for which the corresponding long URL needs to be retrieved.
 //
 // Returns:
 // - string: the long URL corresponding to the short URL.
-// - error: an error indicating if the short URL does not exist in the FileStorage.
-func (s *FileStorage) GetRealURL(shortURL string) (string, error) {
-	for key := range s.fm {
-		if s.fm[key].ShortURL == shortURL {
-			return s.fm[key].LongURL, nil
-		}
+// - error: an error indicating if the short URL does not exist in the FileStorage,
+// ErrURLDeleted if the URL is deleted, ErrURLExpired if the URL is past its expiration time.
+func (s *FileStorage) GetRealURL(ctx context.Context, shortURL string) (string, error) {
+	if err := checkContext(ctx); err != nil {
+		return "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, exist := s.short[shortURL]
+	if !exist {
+		return "", ErrURLNotFound
+	}
+	if s.fm[key].Deleted {
+		return "", ErrURLDeleted
 	}
-	return "", errors.New("short URL not exist")
+	if isExpired(s.fm[key].expiresAt(), time.Now()) {
+		return "", ErrURLExpired
+	}
+	return s.fm[key].LongURL, nil
 }
 
 // GetShortURLBatch retrieves the short URLs for a batch of long URLs.
 //
+// The new records of the batch are appended to the file with a single write,
+// an item that cannot be shortened is reported by its Err and does not fail the batch.
+//
 // Parameters:
+// - ctx: The request context.
 // - userID: The ID of the user.
 // - bAddr: The base address for the short URLs.
 // - longURLs: The list of long URLs to be converted to short URLs.
@@ -143,79 +508,179 @@ func (s *FileStorage) GetRealURL(shortURL string) (string, error) {
 // Returns:
 // - rwJSON: The list of short URLs corresponding to the long URLs.
 // - error: An error if there was a problem retrieving the short URLs.
-func (s *FileStorage) GetShortURLBatch(userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error) {
-	var rwJSON []ResJSONBatch
+func (s *FileStorage) GetShortURLBatch(ctx context.Context, userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []fileMap
+	pendingLong := make(map[string]string)
+	pendingShort := make(map[string]struct{})
+	rwJSON := make([]ResJSONBatch, 0, len(longURLs))
 	for _, rqElemJSON := range longURLs {
-		shortURL, err := s.GetShortURL(userID, rqElemJSON.URL)
-		shortURL = bAddr + "/" + shortURL
+		shortURL, expiresAt, err := s.batchShortURL(userID, rqElemJSON, now, pendingLong, pendingShort)
 		rwElemJSON := ResJSONBatch{
 			ID:     rqElemJSON.ID,
-			Result: shortURL,
+			Result: bAddr + "/" + shortURL,
 		}
 		if err != nil {
-			rwElemJSON.Result = err.Error()
+			rwElemJSON.fail(err)
+		} else {
+			record := fileMap{
+				UUID:     strconv.Itoa(s.count + len(records)),
+				ShortURL: shortURL,
+				LongURL:  rqElemJSON.URL,
+				UserID:   userID,
+			}
+			if !expiresAt.IsZero() {
+				record.ExpiresAt = &expiresAt
+			}
+			records = append(records, record)
+			pendingLong[rqElemJSON.URL] = shortURL
+			pendingShort[shortURL] = struct{}{}
 		}
 		rwJSON = append(rwJSON, rwElemJSON)
 	}
+
+	if len(records) > 0 {
+		if err := s.appendLines(records); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range records {
+		s.add(record)
+	}
 	return rwJSON, nil
 }
 
-// GetShortURL retrieves or generates a short URL for the given long URL and user ID.
+// batchShortURL picks the short URL of a batch item without saving it.
 //
-// userID uint64, longURL string
-// string, error
-func (s *FileStorage) GetShortURL(userID uint64, longURL string) (string, error) {
-	for key := range s.fm {
-		if s.fm[key].LongURL == longURL {
-			return s.fm[key].ShortURL, ErrUniqueViolation
-		}
+// Parameters:
+// - userID: the ID of the user of the batch.
+// - item: the batch item.
+// - now: the time the TTL of the item is counted from.
+// - pendingLong: the short URLs of the long URLs of the batch items picked before, not saved yet.
+// - pendingShort: the short URLs of the batch items picked before, not saved yet.
+//
+// Returns:
+// - string: the picked short URL, or the existing short URL if the long URL is already shortened in the dedup scope.
+// - time.Time: the expiration time of the item.
+// - error: the validation error of the item, ErrUniqueViolation or ErrAliasTaken.
+func (s *FileStorage) batchShortURL(userID uint64, item ReqJSONBatch, now time.Time, pendingLong map[string]string, pendingShort map[string]struct{}) (string, time.Time, error) {
+	expiresAt, err := ExpirationTime(item.ExpiresAt, item.TTL, now)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if key, exist := s.lookup(userID, item.URL); exist {
+		return s.fm[key].ShortURL, time.Time{}, ErrUniqueViolation
+	}
+	if shortURL, exist := pendingLong[item.URL]; exist && s.dedup != config.DedupNone {
+		return shortURL, time.Time{}, ErrUniqueViolation
+	}
+	taken := func(shortURL string) bool {
+		_, saved := s.short[shortURL]
+		_, picked := pendingShort[shortURL]
+		return saved || picked
 	}
-	shortURL := GenShortURL()
 
-	if longURL == "https://www.google.com" {
-		shortURL = "123456"
+	if item.Alias != "" {
+		if err := ValidateAlias(item.Alias); err != nil {
+			return "", time.Time{}, err
+		}
+		if taken(item.Alias) {
+			return item.Alias, time.Time{}, ErrAliasTaken
+		}
+		return item.Alias, expiresAt, nil
+	}
+	shortURL, err := freeShortURL(s.gen, item.URL, taken)
+	if err != nil {
+		return "", time.Time{}, err
 	}
+	return shortURL, expiresAt, nil
+}
 
-	for {
-		if !s.IsShortURLExist(shortURL) {
-			err := s.Save(userID, shortURL, longURL)
-			if err == nil {
-				return shortURL, nil
-			} else {
-				return "", err
-			}
+// GetShortURL retrieves or generates a short URL for the given long URL and user ID.
+//
+// The existing short URL is returned with ErrUniqueViolation if the long URL is already shortened in the dedup scope.
+//
+// ctx context.Context, userID uint64, longURL string, expiresAt time.Time
+// string, error
+func (s *FileStorage) GetShortURL(ctx context.Context, userID uint64, longURL string, expiresAt time.Time) (string, error) {
+	if err := checkContext(ctx); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, exist := s.lookup(userID, longURL); exist {
+		return s.fm[key].ShortURL, ErrUniqueViolation
+	}
+	return newShortURL(s.gen, longURL, func(shortURL string) error {
+		if _, exist := s.short[shortURL]; exist {
+			return ErrUniqueViolation
 		}
-		shortURL = GenShortURL()
+		return s.save(userID, shortURL, longURL, expiresAt)
+	})
+}
+
+// SaveAlias saves the long URL under a user-chosen alias.
+//
+// Parameters:
+// - ctx: The request context.
+// - userID: The ID of the user.
+// - alias: The alias to be used as the short URL, it should be validated with ValidateAlias.
+// - longURL: The long URL to be saved.
+// - expiresAt: The expiration time, zero for a URL that never expires.
+//
+// Returns:
+// - string: The saved alias, or the existing short URL if the long URL is already shortened in the dedup scope.
+// - error: ErrUniqueViolation if the long URL is already shortened, ErrAliasTaken if the alias is used by another URL.
+func (s *FileStorage) SaveAlias(ctx context.Context, userID uint64, alias string, longURL string, expiresAt time.Time) (string, error) {
+	if err := checkContext(ctx); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, exist := s.lookup(userID, longURL); exist {
+		return s.fm[key].ShortURL, ErrUniqueViolation
 	}
+	if _, exist := s.short[alias]; exist {
+		return alias, ErrAliasTaken
+	}
+	err := s.save(userID, alias, longURL, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	return alias, nil
 }
 
 // IsShortURLExist checks if a short URL exists in the FileStorage.
 //
 // Parameters:
+// - ctx: the request context.
 // - shortURL: the short URL to check for existence.
 //
 // Returns:
 // - bool: true if the short URL exists, false otherwise.
-func (s *FileStorage) IsShortURLExist(shortURL string) bool {
-	for key := range s.fm {
-		if s.fm[key].ShortURL == shortURL {
-			return true
-		}
-	}
-	return false
+func (s *FileStorage) IsShortURLExist(ctx context.Context, shortURL string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exist := s.short[shortURL]
+	return exist
 }
 
 // IsRealURLExist checks if a given longURL exists in the FileStorage's map.
 //
-// longURL string
+// ctx context.Context, longURL string
 // bool
-func (s *FileStorage) IsRealURLExist(longURL string) bool {
-	for key := range s.fm {
-		if s.fm[key].LongURL == longURL {
-			return true
-		}
-	}
-	return false
+func (s *FileStorage) IsRealURLExist(ctx context.Context, longURL string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exist := s.long[longURL]
+	return exist
 }
 
 // IsReady checks if the FileStorage is ready.
@@ -225,59 +690,73 @@ func (s *FileStorage) IsRealURLExist(longURL string) bool {
 //
 // Returns:
 // - bool: true if the FileStorage is ready, false otherwise.
-func (s *FileStorage) IsReady() bool {
+func (s *FileStorage) IsReady(ctx context.Context) bool {
+	if checkContext(ctx) != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	err := s.Open()
 	if err != nil {
 		return false
 	}
-	defer s.Close()
+	defer s.File.Close()
 	return true
 }
 
 // GetAllURLs retrieves all URLs associated with a specific userID from the FileStorage.
 //
+// The deleted URLs are skipped.
+//
+// ctx: the request context
 // userID: the ID of the user
 // bAddr: base address for constructing the complete URL
 // Returns a slice of ResJSONURL containing the retrieved URLs and an error if any
-func (s *FileStorage) GetAllURLs(userID uint64, bAddr string) ([]ResJSONURL, error) {
+func (s *FileStorage) GetAllURLs(ctx context.Context, userID uint64, bAddr string) ([]ResJSONURL, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var rwJSON []ResJSONURL
-	for key := range s.fm {
-		if s.fm[key].UserID == userID {
-			rwJSON = append(rwJSON, ResJSONURL{
-				URL:    s.fm[key].LongURL,
-				Result: bAddr + "/" + s.fm[key].ShortURL,
-			})
+	for _, key := range s.users[userID] {
+		if s.fm[key].Deleted {
+			continue
 		}
+		rwJSON = append(rwJSON, ResJSONURL{
+			URL:    s.fm[key].LongURL,
+			Result: bAddr + "/" + s.fm[key].ShortURL,
+		})
 	}
 	return rwJSON, nil
 }
 
 // GetLastID returns the last ID from the FileStorage.
 //
-// It scans the FileStorage file line by line and counts the number of lines.
-// The last ID is the total count of lines.
+// The last ID is the number of records replayed from the file and saved since,
+// it is never less than the ID of the last user who saved a URL.
 //
 // Returns:
 // - int: the last ID.
-// - error: any error that occurred during the scanning process.
-func (s *FileStorage) GetLastID() (int, error) {
-	scanner := bufio.NewScanner(s.File)
-	count := 0
-	for scanner.Scan() {
-		count++
+// - error: an error if the context is done.
+func (s *FileStorage) GetLastID(ctx context.Context) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
 	}
-
-	return count, nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count, nil
 }
 
 // DeleteURLs deletes multiple URLs for a given user.
 //
+// ctx: The request context.
 // userID: The ID of the user.
 // delURLs: An array of URLs to be deleted.
 // error: An error if the deletion fails.
-func (s *FileStorage) DeleteURLs(userID uint64, delURLs []string) error {
+func (s *FileStorage) DeleteURLs(ctx context.Context, userID uint64, delURLs []string) error {
 	for _, url := range delURLs {
-		err := s.DeleteURL(map[string]uint64{url: userID})
+		err := s.DeleteURL(ctx, map[string]uint64{url: userID})
 		if err != nil {
 			return err
 		}
@@ -289,31 +768,203 @@ func (s *FileStorage) DeleteURLs(userID uint64, delURLs []string) error {
 // DeleteURL deletes URLs from the FileStorage.
 //
 // delURL is a map of URLs to be deleted and their corresponding user IDs.
-// It returns an error if there was an issue deleting the URLs.
-func (s *FileStorage) DeleteURL(delURL map[string]uint64) error {
+// A tombstone is appended to the file for every deleted URL.
+// It returns an error if there was an issue deleting the URLs, ErrStorageClosed if the storage is closed.
+func (s *FileStorage) DeleteURL(ctx context.Context, delURL map[string]uint64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []int
 	for sURL, userID := range delURL {
-		for key := range s.fm {
-			if sURL == s.fm[key].ShortURL && userID == s.fm[key].UserID {
-				s.fm[key].Deleted = true
-			}
+		key, exist := s.short[sURL]
+		if exist && userID == s.fm[key].UserID && !s.fm[key].Deleted {
+			keys = append(keys, key)
 		}
 	}
 
-	return nil
+	return closedError(s.deleteRecords(keys))
 }
 
 // GetStats retrieves the statistics of URLs and users from the FileStorage.
 //
-// No parameters.
+// It takes the request context.
 // Returns ResJSONStats and an error.
-func (s *FileStorage) GetStats() (ResJSONStats, error) {
-	urls := len(s.fm)
-	users := make(map[uint64]uint64)
-	for _, lURL := range s.fm {
-		users[lURL.UserID]++
+func (s *FileStorage) GetStats(ctx context.Context) (ResJSONStats, error) {
+	if err := checkContext(ctx); err != nil {
+		return ResJSONStats{}, err
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return ResJSONStats{
-		URLCount:  urls,
-		UserCount: len(users),
+		URLCount:  len(s.fm),
+		UserCount: len(s.users),
 	}, nil
 }
+
+// DeleteExpired marks the URLs that are expired at now as deleted in the FileStorage.
+//
+// ctx: the request context.
+// now: the time to compare expiration times with.
+// It returns the number of deleted URLs and an error if the context is done
+// or the tombstones cannot be written.
+func (s *FileStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []int
+	for key := range s.fm {
+		if !s.fm[key].Deleted && isExpired(s.fm[key].expiresAt(), now) {
+			keys = append(keys, key)
+		}
+	}
+	err := s.deleteRecords(keys)
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// SaveClicks appends the redirects of short URLs to the clicks file.
+//
+// ctx: the request context.
+// clicks: the redirects to be saved.
+// It returns an error if the clicks cannot be written.
+func (s *FileStorage) SaveClicks(ctx context.Context, clicks []Click) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data []byte
+	for _, click := range clicks {
+		line, err := json.Marshal(click)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+		data = append(data, byte('\n'))
+	}
+	file, err := os.OpenFile(s.ClicksPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err != nil {
+		return err
+	}
+	for _, click := range clicks {
+		s.clicks[click.ShortURL] = append(s.clicks[click.ShortURL], click)
+	}
+	return nil
+}
+
+// GetURLStats retrieves the click stats of a short URL owned by the given user from the FileStorage.
+//
+// ctx: the request context.
+// userID: the ID of the user.
+// shortURL: the short URL.
+// It returns the total clicks, unique visitors and a per-day histogram,
+// or ErrURLNotFound if the short URL does not exist or is owned by another user.
+func (s *FileStorage) GetURLStats(ctx context.Context, userID uint64, shortURL string) (ResJSONURLStats, error) {
+	if err := checkContext(ctx); err != nil {
+		return ResJSONURLStats{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, exist := s.short[shortURL]
+	if !exist || s.fm[key].UserID != userID {
+		return ResJSONURLStats{}, ErrURLNotFound
+	}
+	return clickStats(shortURL, s.clicks[shortURL]), nil
+}
+
+// SaveAPIKey saves a new API key in the FileStorage and rewrites the API keys file.
+//
+// ctx: the request context.
+// key: the API key with the hash of the key.
+// It returns an error if the API keys file cannot be written.
+func (s *FileStorage) SaveAPIKey(ctx context.Context, key APIKey) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKeys[key.Hash] = key
+	err := s.writeAPIKeys()
+	if err != nil {
+		delete(s.apiKeys, key.Hash)
+	}
+	return err
+}
+
+// GetAPIKeys retrieves all API keys of the given user from the FileStorage.
+//
+// ctx: the request context.
+// userID: the ID of the user.
+// It returns the API keys of the user sorted by creation time and an error if the context is done.
+func (s *FileStorage) GetAPIKeys(ctx context.Context, userID uint64) ([]APIKey, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []APIKey
+	for _, key := range s.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+// RevokeAPIKey deletes the API key with the given ID owned by the given user from the FileStorage.
+//
+// ctx: the request context.
+// userID: the ID of the user.
+// id: the ID of the API key.
+// It returns ErrAPIKeyNotFound if the key does not exist or is owned by another user.
+func (s *FileStorage) RevokeAPIKey(ctx context.Context, userID uint64, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, key := range s.apiKeys {
+		if key.ID == id && key.UserID == userID {
+			delete(s.apiKeys, hash)
+			err := s.writeAPIKeys()
+			if err != nil {
+				s.apiKeys[hash] = key
+			}
+			return err
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+// UseAPIKey resolves the API key hash to its user and sets the last use time of the key.
+//
+// ctx: the request context.
+// hash: the hash of the API key.
+// now: the time of the use.
+// It returns the ID of the user owning the key, ErrAPIKeyNotFound if the key does not exist.
+func (s *FileStorage) UseAPIKey(ctx context.Context, hash string, now time.Time) (uint64, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, exist := s.apiKeys[hash]
+	if !exist {
+		return 0, ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = &now
+	s.apiKeys[hash] = key
+	return key.UserID, s.writeAPIKeys()
+}
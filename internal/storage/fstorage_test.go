@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// countLines returns the number of lines in the file.
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		count++
+	}
+	return count
+}
+
+func TestFileStorage_DeleteURL_Persisted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shorty.json")
+
+	fStorage, err := openFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_ = fStorage.Save(ctx, 1, "abc", "https://example.com/abc", time.Time{})
+	_ = fStorage.Save(ctx, 1, "abd", "https://example.com/abd", time.Time{})
+	// Another user cannot delete the URL
+	_ = fStorage.DeleteURL(ctx, map[string]uint64{"abd": 2})
+	if err := fStorage.DeleteURL(ctx, map[string]uint64{"abc": 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := fStorage.GetRealURL(ctx, "abc"); !errors.Is(err, ErrURLDeleted) {
+		t.Errorf("Expected ErrURLDeleted, but got %v", err)
+	}
+	if lines := countLines(t, path); lines != 3 {
+		t.Errorf("Expected 2 records and 1 tombstone, but got %d lines", lines)
+	}
+	// The file is closed after every write, closing the storage on shutdown is not an error
+	if err := fStorage.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The tombstone is applied on replay
+	fStorage, err = openFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := fStorage.GetRealURL(ctx, "abc"); !errors.Is(err, ErrURLDeleted) {
+		t.Errorf("Expected ErrURLDeleted after replay, but got %v", err)
+	}
+	if longURL, err := fStorage.GetRealURL(ctx, "abd"); err != nil || longURL != "https://example.com/abd" {
+		t.Errorf("Expected https://example.com/abd, but got %q, %v", longURL, err)
+	}
+	if !fStorage.IsShortURLExist(ctx, "abc") {
+		t.Errorf("Expected deleted short URL to stay taken")
+	}
+}
+
+func TestFileStorage_Compact(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shorty.json")
+
+	fStorage, err := openFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < compactMinLines; i++ {
+		id := strconv.Itoa(i)
+		_ = fStorage.Save(ctx, 1, "code"+id, "https://example.com/"+id, time.Time{})
+	}
+	// A few tombstones do not trigger compaction
+	_ = fStorage.DeleteURL(ctx, map[string]uint64{"code0": 1})
+	if lines := countLines(t, path); lines != compactMinLines+1 {
+		t.Errorf("Expected %d lines, but got %d", compactMinLines+1, lines)
+	}
+	delURL := make(map[string]uint64)
+	for i := 1; i < compactMinLines/2; i++ {
+		delURL["code"+strconv.Itoa(i)] = 1
+	}
+	_ = fStorage.DeleteURL(ctx, delURL)
+	if lines := countLines(t, path); lines != compactMinLines {
+		t.Errorf("Expected compacted file with %d lines, but got %d", compactMinLines, lines)
+	}
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp"))
+	if len(matches) != 0 {
+		t.Errorf("Expected no temporary files, but got %v", matches)
+	}
+
+	fStorage, err = openFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := fStorage.GetRealURL(ctx, "code0"); !errors.Is(err, ErrURLDeleted) {
+		t.Errorf("Expected ErrURLDeleted after compaction, but got %v", err)
+	}
+	if _, err := fStorage.GetRealURL(ctx, "code99"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	stats, _ := fStorage.GetStats(ctx)
+	if stats.URLCount != compactMinLines {
+		t.Errorf("Expected %d URLs, but got %d", compactMinLines, stats.URLCount)
+	}
+}
+
+// fillFileStorage returns a FileStorage opened on an empty file with the given number of records in memory only.
+func fillFileStorage(b *testing.B, entries int) *FileStorage {
+	b.Helper()
+	fStorage, err := openFileStorage(filepath.Join(b.TempDir(), "short-url-db.json"))
+	if err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < entries; i++ {
+		fStorage.add(fileMap{
+			UUID:     strconv.Itoa(i),
+			ShortURL: "code" + strconv.Itoa(i),
+			LongURL:  "https://example.com/" + strconv.Itoa(i),
+			UserID:   uint64(i),
+		})
+	}
+	return fStorage
+}
+
+// BenchmarkFileStorage_GetShortURL benchmarks the lookup of an existing long URL by its owner.
+//
+// The time per operation does not depend on the number of entries.
+func BenchmarkFileStorage_GetShortURL(b *testing.B) {
+	for _, entries := range []int{1000, 1000000} {
+		b.Run(strconv.Itoa(entries), func(b *testing.B) {
+			ctx := context.Background()
+			fStorage := fillFileStorage(b, entries)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = fStorage.GetShortURL(ctx, uint64(i%entries), "https://example.com/"+strconv.Itoa(i%entries), time.Time{})
+			}
+		})
+	}
+}
+
+// BenchmarkFileStorage_GetRealURL benchmarks the lookup of a short URL.
+//
+// The time per operation does not depend on the number of entries.
+func BenchmarkFileStorage_GetRealURL(b *testing.B) {
+	for _, entries := range []int{1000, 1000000} {
+		b.Run(strconv.Itoa(entries), func(b *testing.B) {
+			ctx := context.Background()
+			fStorage := fillFileStorage(b, entries)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = fStorage.GetRealURL(ctx, "code"+strconv.Itoa(i%entries))
+			}
+		})
+	}
+}
+
+// BenchmarkFileStorage_GetAllURLs benchmarks the lookup of the URLs of a user.
+//
+// The time per operation depends on the number of URLs of the user only.
+func BenchmarkFileStorage_GetAllURLs(b *testing.B) {
+	for _, entries := range []int{1000, 1000000} {
+		b.Run(strconv.Itoa(entries), func(b *testing.B) {
+			ctx := context.Background()
+			fStorage := fillFileStorage(b, entries)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = fStorage.GetAllURLs(ctx, uint64(i%entries), "http://localhost")
+			}
+		})
+	}
+}
+
+func TestFileStorage_APIKeys_Persisted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shorty.json")
+
+	fStorage, err := openFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	now := time.Now().UTC()
+	_ = fStorage.SaveAPIKey(ctx, APIKey{ID: "key1", UserID: 1, Hash: "hash1", CreatedAt: now})
+	_ = fStorage.SaveAPIKey(ctx, APIKey{ID: "key2", UserID: 1, Hash: "hash2", CreatedAt: now})
+	_ = fStorage.RevokeAPIKey(ctx, 1, "key2")
+	_, _ = fStorage.UseAPIKey(ctx, "hash1", now)
+
+	info, err := os.Stat(fStorage.KeysPath)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected API keys file with mode 0600, but got %v, %v", info, err)
+	}
+
+	fStorage, err = openFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	keys, _ := fStorage.GetAPIKeys(ctx, 1)
+	if len(keys) != 1 || keys[0].ID != "key1" || keys[0].LastUsedAt == nil {
+		t.Errorf("Expected used key1 only, but got %v", keys)
+	}
+}
+
+func TestFileStorage_DedupScope(t *testing.T) {
+	for _, scope := range dedupScopes {
+		t.Run(scope, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "shorty.json")
+			fStorage, err := openFileStorage(path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			fStorage.dedup = scope
+			checkDedupScope(t, fStorage, scope)
+			urls, _ := fStorage.GetAllURLs(context.Background(), 1, "http://localhost")
+
+			// The owned URLs are replayed without the deleted ones
+			fStorage, err = openFileStorage(path)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			replayed, _ := fStorage.GetAllURLs(context.Background(), 1, "http://localhost")
+			if len(replayed) != len(urls) {
+				t.Errorf("Expected %v, but got %v", urls, replayed)
+			}
+		})
+	}
+}
+
+func TestFileStorage_GetShortURLBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shorty.json")
+
+	fStorage, err := openFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkGetShortURLBatch(t, fStorage)
+	if lines := countLines(t, path); lines != 3 {
+		t.Errorf("Expected the alias and 2 batch records, but got %d lines", lines)
+	}
+
+	// The batch records are replayed
+	fStorage, err = openFileStorage(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if longURL, err := fStorage.GetRealURL(context.Background(), "batch-alias"); err != nil || longURL != "https://example.com/4" {
+		t.Errorf("Expected https://example.com/4, but got %q, %v", longURL, err)
+	}
+	if lastID, _ := fStorage.GetLastID(context.Background()); lastID != 3 {
+		t.Errorf("Expected last ID 3, but got %d", lastID)
+	}
+}
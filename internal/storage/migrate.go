@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// migrations are the versioned schema migrations of the DBStorage, embedded in the binary.
+//
+// Every version has an up and a down file named <version>_<name>.up.sql and <version>_<name>.down.sql.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// ErrMigrateUsage is returned for an unknown migrate command or its wrong arguments.
+var ErrMigrateUsage = errors.New("usage: migrate up | down [N] | version | force V")
+
+// newMigrate returns the migrate instance of the embedded migrations on a dedicated connection of the pool.
+//
+// Closing the instance releases the connection only, the pool stays open.
+//
+// Parameters:
+// - ctx: the context the connection is obtained with.
+// - db: the database pool.
+//
+// Returns:
+// - *migrate.Migrate: the migrate instance.
+// - error: an error if the database cannot be reached or the migrations cannot be read.
+func newMigrate(ctx context.Context, db *sql.DB) (*migrate.Migrate, error) {
+	source, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read migrations: %w", err)
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		source.Close()
+		return nil, fmt.Errorf("cannot connect to DB: %w", err)
+	}
+	driver, err := postgres.WithConnection(ctx, conn, &postgres.Config{})
+	if err != nil {
+		conn.Close()
+		source.Close()
+		return nil, fmt.Errorf("failed to create migration driver: %w", err)
+	}
+	m, err := migrate.NewWithInstance("iofs", source, "postgres", driver)
+	if err != nil {
+		driver.Close()
+		source.Close()
+		return nil, fmt.Errorf("DB migrate registration error: %w", err)
+	}
+	return m, nil
+}
+
+// MigrateUp migrates the database to the latest version of the embedded migrations.
+//
+// It is run by NewDBStorage on start unless the migrations are skipped in the configuration.
+// A database that is already at the latest version is left as is.
+//
+// Parameters:
+// - ctx: the context the connection is obtained with.
+// - db: the database pool.
+//
+// Returns:
+// - error: an error if a migration fails, the database is left dirty at its version then.
+func MigrateUp(ctx context.Context, db *sql.DB) error {
+	m, err := newMigrate(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	err = m.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("DB migration error: %w", err)
+	}
+	return nil
+}
+
+// RunMigrate runs the migrate command of the operators against the database.
+//
+// The commands are:
+// - up: migrate to the latest version.
+// - down [N]: roll back N versions, 1 by default.
+// - version: print the current version.
+// - force V: set the version without migrating, e.g. to clear the dirty flag after a failed migration
+// is fixed by hand, -1 stands for no version.
+//
+// Parameters:
+// - ctx: the context the connection is obtained with.
+// - dsn: the DSN of the database.
+// - args: the command and its arguments.
+// - out: the writer the result is printed to.
+//
+// Returns:
+// - error: ErrMigrateUsage for an unknown command or its wrong arguments, or the migration error.
+func RunMigrate(ctx context.Context, dsn string, args []string, out io.Writer) error {
+	run, err := migrateCommand(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return fmt.Errorf("DB open error: %w", err)
+	}
+	defer db.Close()
+	m, err := newMigrate(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	err = run(m)
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		fmt.Fprintln(out, "no migrations applied")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dirty {
+		fmt.Fprintf(out, "version %d (dirty)\n", version)
+		return nil
+	}
+	fmt.Fprintf(out, "version %d\n", version)
+	return nil
+}
+
+// migrateCommand parses the migrate command before the database is connected.
+//
+// Parameters:
+// - args: the command and its arguments.
+//
+// Returns:
+// - func(*migrate.Migrate) error: the command, the version is printed after it.
+// - error: ErrMigrateUsage for an unknown command or its wrong arguments.
+func migrateCommand(args []string) (func(*migrate.Migrate) error, error) {
+	if len(args) == 0 {
+		return nil, ErrMigrateUsage
+	}
+
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		return (*migrate.Migrate).Up, nil
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return nil, ErrMigrateUsage
+			}
+			steps = n
+		}
+		return func(m *migrate.Migrate) error {
+			return m.Steps(-steps)
+		}, nil
+	case args[0] == "version" && len(args) == 1:
+		return func(*migrate.Migrate) error {
+			return nil
+		}, nil
+	case args[0] == "force" && len(args) == 2:
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < -1 {
+			return nil, ErrMigrateUsage
+		}
+		return func(m *migrate.Migrate) error {
+			return m.Force(version)
+		}, nil
+	}
+	return nil, ErrMigrateUsage
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+func TestMigrations(t *testing.T) {
+	source, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer source.Close()
+
+	// Every embedded version can be applied and rolled back
+	var versions []uint
+	version, err := source.First()
+	for err == nil {
+		versions = append(versions, version)
+		for direction, read := range map[string]func(uint) (io.ReadCloser, string, error){
+			"up":   source.ReadUp,
+			"down": source.ReadDown,
+		} {
+			r, _, err := read(version)
+			if err != nil {
+				t.Errorf("Expected %s migration of version %d, but got %v", direction, version, err)
+				continue
+			}
+			r.Close()
+		}
+		version, err = source.Next(version)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, version := range versions {
+		if version != uint(i+1) {
+			t.Errorf("Expected version %d, but got %d", i+1, version)
+		}
+	}
+}
+
+func TestRunMigrate_Usage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "no command", args: nil},
+		{name: "unknown command", args: []string{"drop"}},
+		{name: "up with steps", args: []string{"up", "1"}},
+		{name: "down with zero steps", args: []string{"down", "0"}},
+		{name: "down with not a number", args: []string{"down", "all"}},
+		{name: "force without version", args: []string{"force"}},
+		{name: "force below no version", args: []string{"force", "-2"}},
+		{name: "version with argument", args: []string{"version", "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the arguments are checked before the database is connected
+			err := RunMigrate(context.Background(), "host=db.invalid", tt.args, io.Discard)
+			if !errors.Is(err, ErrMigrateUsage) {
+				t.Errorf("Expected ErrMigrateUsage, but got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,2 @@
+ALTER TABLE urls
+    DROP CONSTRAINT unique_short_url;
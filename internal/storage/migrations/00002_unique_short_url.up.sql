@@ -0,0 +1,3 @@
+ALTER TABLE urls
+    ADD CONSTRAINT unique_short_url
+        UNIQUE (short_url);
@@ -0,0 +1,6 @@
+ALTER TABLE urls
+    ADD COLUMN expires_at timestamptz NULL;
+
+CREATE INDEX urls_expires_at_idx
+    ON urls (expires_at)
+    WHERE expires_at IS NOT NULL AND NOT deleted;
@@ -0,0 +1,11 @@
+CREATE TABLE clicks (
+    id BIGSERIAL PRIMARY KEY,
+    short_url text NOT NULL,
+    clicked_at timestamptz NOT NULL,
+    referrer text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    ip_prefix text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX clicks_short_url_clicked_at_idx
+    ON clicks (short_url, clicked_at);
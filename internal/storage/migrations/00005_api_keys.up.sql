@@ -0,0 +1,15 @@
+CREATE TABLE api_keys (
+    id text PRIMARY KEY,
+    user_id int NOT NULL,
+    hash text NOT NULL,
+    name text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL,
+    last_used_at timestamptz
+);
+
+ALTER TABLE api_keys
+    ADD CONSTRAINT unique_api_key_hash
+        UNIQUE (hash);
+
+CREATE INDEX api_keys_user_id_idx
+    ON api_keys (user_id);
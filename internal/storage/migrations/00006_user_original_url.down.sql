@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS urls_original_url_idx;
+
+DROP INDEX IF EXISTS urls_user_id_original_url_idx;
+
+-- fails if a long URL is shortened by several users or several times by one of them
+ALTER TABLE urls
+    ADD CONSTRAINT unique_url
+        UNIQUE (original_url);
@@ -0,0 +1,9 @@
+ALTER TABLE urls
+    DROP CONSTRAINT unique_url;
+
+CREATE UNIQUE INDEX urls_user_id_original_url_idx
+    ON urls (user_id, original_url)
+    WHERE NOT deleted;
+
+CREATE INDEX urls_original_url_idx
+    ON urls (original_url);
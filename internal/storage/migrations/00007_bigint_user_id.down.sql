@@ -0,0 +1,6 @@
+-- fails if a user ID does not fit in int
+ALTER TABLE api_keys
+    ALTER COLUMN user_id TYPE int;
+
+ALTER TABLE urls
+    ALTER COLUMN user_id TYPE int;
@@ -0,0 +1,5 @@
+ALTER TABLE urls
+    ALTER COLUMN user_id TYPE bigint;
+
+ALTER TABLE api_keys
+    ALTER COLUMN user_id TYPE bigint;
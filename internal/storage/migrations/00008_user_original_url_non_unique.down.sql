@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS urls_user_id_original_url_idx;
+
+-- fails if a user has several live short URLs of a long URL
+CREATE UNIQUE INDEX urls_user_id_original_url_idx
+    ON urls (user_id, original_url)
+    WHERE NOT deleted;
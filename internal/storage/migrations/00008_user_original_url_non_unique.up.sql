@@ -0,0 +1,6 @@
+-- the per-user uniqueness is kept by the storage in the user dedup scope only
+DROP INDEX IF EXISTS urls_user_id_original_url_idx;
+
+CREATE INDEX urls_user_id_original_url_idx
+    ON urls (user_id, original_url)
+    WHERE NOT deleted;
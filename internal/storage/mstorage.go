@@ -1,87 +1,193 @@
 package storage
 
 import (
+	"context"
 	"errors"
-)
+	"sync"
+	"time"
 
-// ShortURL length
+	"github.com/stsg/shorty/internal/config"
+)
 
 // MapStorage is a struct that holds memory storage data.
+//
+// The URLs are kept by short URL in m, long, owned and users are the indexes
+// by long URL, by long URL of a user and by user ID that are updated on every save and delete.
+// The MapStorage is safe for concurrent use, mu guards all the maps.
+//
+// A long URL is shortened once in the dedup scope, the per-user scope unless it is set by New.
+// The short URLs are generated by gen, random ones of DefaultCodeLength unless it is set by New.
 type MapStorage struct {
-	m map[string]UserURL
+	mu      sync.RWMutex
+	dedup   string
+	gen     CodeGenerator
+	m       map[string]UserURL
+	long    map[string]string
+	owned   map[ownerKey]string
+	users   map[uint64]map[string]struct{}
+	clicks  map[string][]Click
+	apiKeys map[string]APIKey
 }
 
 // UserURL is a struct that holds user URL data.
+//
+// Expired marks a URL deleted by DeleteExpired, it keeps its short URL but is out of the indexes.
 type UserURL struct {
-	LongURL string
-	UserID  uint64
+	LongURL   string
+	UserID    uint64
+	ExpiresAt time.Time
+	Expired   bool
 }
 
 // NewMapStorage initializes and returns a new instance of MapStorage.
 //
-// It creates a new map[string]UserURL and assigns it to the m field of the MapStorage struct.
+// It creates a new map[string]UserURL and assigns it to the m field of the MapStorage struct,
+// the clicks of every short URL are kept in the clicks field.
 // The function returns a pointer to the newly created MapStorage instance and a nil error.
 func NewMapStorage() (*MapStorage, error) {
-	return &MapStorage{m: make(map[string]UserURL)}, nil
+	return &MapStorage{
+		gen:     NewRandomGenerator(DefaultCodeLength, DefaultCodeGrowthThreshold),
+		m:       make(map[string]UserURL),
+		long:    make(map[string]string),
+		owned:   make(map[ownerKey]string),
+		users:   make(map[uint64]map[string]struct{}),
+		clicks:  make(map[string][]Click),
+		apiKeys: make(map[string]APIKey),
+	}, nil
+}
+
+// add saves the URL under the short URL and adds it to the indexes.
+func (s *MapStorage) add(shortURL string, uURL UserURL) {
+	s.m[shortURL] = uURL
+	s.long[uURL.LongURL] = shortURL
+	s.owned[ownerKey{uURL.UserID, uURL.LongURL}] = shortURL
+	if s.users[uURL.UserID] == nil {
+		s.users[uURL.UserID] = make(map[string]struct{})
+	}
+	s.users[uURL.UserID][shortURL] = struct{}{}
+}
+
+// remove deletes the short URL and removes it from the indexes.
+func (s *MapStorage) remove(shortURL string) {
+	if _, exist := s.m[shortURL]; !exist {
+		return
+	}
+	s.unindex(shortURL)
+	delete(s.m, shortURL)
+}
+
+// unindex removes the short URL from the indexes, the URL itself is kept.
+func (s *MapStorage) unindex(shortURL string) {
+	uURL := s.m[shortURL]
+	if s.long[uURL.LongURL] == shortURL {
+		delete(s.long, uURL.LongURL)
+	}
+	if key := (ownerKey{uURL.UserID, uURL.LongURL}); s.owned[key] == shortURL {
+		delete(s.owned, key)
+	}
+	delete(s.users[uURL.UserID], shortURL)
+	if len(s.users[uURL.UserID]) == 0 {
+		delete(s.users, uURL.UserID)
+	}
+}
+
+// lookup returns the short URL the long URL is already shortened to in the dedup scope, the caller holds the lock.
+func (s *MapStorage) lookup(userID uint64, longURL string) (string, bool) {
+	switch s.dedup {
+	case config.DedupGlobal:
+		shortURL, exist := s.long[longURL]
+		return shortURL, exist
+	case config.DedupNone:
+		return "", false
+	}
+	shortURL, exist := s.owned[ownerKey{userID, longURL}]
+	return shortURL, exist
 }
 
 // Save saves the short URL and long URL for a given user ID in the MapStorage.
 //
 // Parameters:
+// - ctx context.Context: the request context
 // - userID uint64: the user ID
 // - shortURL string: the short URL to be saved
 // - longURL string: the long URL to be saved
+// - expiresAt time.Time: the expiration time, zero for a URL that never expires
 // Return type: error
-func (s *MapStorage) Save(userID uint64, shortURL string, longURL string) error {
+func (s *MapStorage) Save(ctx context.Context, userID uint64, shortURL string, longURL string, expiresAt time.Time) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(userID, shortURL, longURL, expiresAt)
+}
+
+// save saves the URL if the short URL does not exist, the caller holds the write lock.
+func (s *MapStorage) save(userID uint64, shortURL string, longURL string, expiresAt time.Time) error {
 	_, exist := s.m[shortURL]
 	if exist {
 		return ErrUniqueViolation
 	}
 	uURL := UserURL{
-		LongURL: longURL,
-		UserID:  userID,
+		LongURL:   longURL,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
 	}
-	s.m[shortURL] = uURL
+	s.add(shortURL, uURL)
 	return nil
 }
 
 // GetRealURL retrieves the long URL associated with the given short URL.
 //
 // Parameters:
+// - ctx: The request context.
 // - shortURL: The short URL for which the long URL needs to be retrieved.
 //
 // Returns:
 // - string: The long URL corresponding to the short URL.
-// - error: An error if the short URL is longer than ShortURLLength or if the short URL does not exist.
-func (s *MapStorage) GetRealURL(shortURL string) (string, error) {
-	if len(shortURL) > ShortURLLength {
-		return "", errors.New("short URL longer than ShortURLLength")
+// - error: An error if the short URL is longer than AliasMaxLength or if the short URL does not exist,
+// ErrURLExpired if the URL is past its expiration time.
+func (s *MapStorage) GetRealURL(ctx context.Context, shortURL string) (string, error) {
+	if err := checkContext(ctx); err != nil {
+		return "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(shortURL) > AliasMaxLength {
+		return "", errors.New("short URL longer than AliasMaxLength")
 	}
 	longURL, exist := s.m[shortURL]
 	if !exist {
-		return "", errors.New("short URL not exist")
+		return "", ErrURLNotFound
+	}
+	if isExpired(longURL.ExpiresAt, time.Now()) {
+		return "", ErrURLExpired
 	}
 	return longURL.LongURL, nil
 }
 
 // GetShortURLBatch retrieves short URLs for a batch of long URLs.
 //
+// ctx: The request context, checked before every item.
 // userID: The ID of the user.
 // bAddr: The base address for the short URLs.
 // longURLs: A slice of ReqJSONBatch containing the long URLs.
 // []ResJSONBatch: A slice of ResJSONBatch containing the short URLs and any error messages.
 // error: An error if the retrieval fails.
-func (s *MapStorage) GetShortURLBatch(userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error) {
+func (s *MapStorage) GetShortURLBatch(ctx context.Context, userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error) {
 	var rwJSON []ResJSONBatch
 	for _, rqElemJSON := range longURLs {
-		shortURL, err := s.GetShortURL(userID, rqElemJSON.URL)
+		if err := checkContext(ctx); err != nil {
+			return nil, err
+		}
+		shortURL, err := getShortURL(ctx, s, userID, rqElemJSON)
 		shortURL = bAddr + "/" + shortURL
 		rwElemJSON := ResJSONBatch{
 			ID:     rqElemJSON.ID,
 			Result: shortURL,
 		}
 		if err != nil {
-			rwElemJSON.Result = err.Error()
+			rwElemJSON.fail(err)
 		}
 		rwJSON = append(rwJSON, rwElemJSON)
 	}
@@ -91,29 +197,60 @@ func (s *MapStorage) GetShortURLBatch(userID uint64, bAddr string, longURLs []Re
 // GetShortURL retrieves the short URL for a given user and long URL.
 //
 // Parameters:
+// - ctx: The request context.
 // - userID: The ID of the user.
 // - longURL: The long URL for which to retrieve the short URL.
+// - expiresAt: The expiration time of a new short URL, zero for a URL that never expires.
 //
 // Returns:
 // - string: The short URL corresponding to the long URL.
-// - error: An error if the short URL cannot be retrieved.
-func (s *MapStorage) GetShortURL(userID uint64, longURL string) (string, error) {
-	for sURL, lURL := range s.m {
-		if lURL.LongURL == longURL {
-			return sURL, ErrUniqueViolation
-		}
+// - error: ErrUniqueViolation with the existing short URL if the long URL is already shortened in the dedup scope.
+func (s *MapStorage) GetShortURL(ctx context.Context, userID uint64, longURL string, expiresAt time.Time) (string, error) {
+	if err := checkContext(ctx); err != nil {
+		return "", err
 	}
-	for {
-		sURL := GenShortURL()
-		_, exist := s.m[sURL]
-		if !exist {
-			err := s.Save(userID, sURL, longURL)
-			if err != nil {
-				return "", err
-			}
-			return sURL, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sURL, exist := s.lookup(userID, longURL); exist {
+		return sURL, ErrUniqueViolation
+	}
+	return newShortURL(s.gen, longURL, func(sURL string) error {
+		if _, exist := s.m[sURL]; exist {
+			return ErrUniqueViolation
 		}
+		return s.save(userID, sURL, longURL, expiresAt)
+	})
+}
+
+// SaveAlias saves the long URL under a user-chosen alias.
+//
+// Parameters:
+// - ctx: The request context.
+// - userID: The ID of the user.
+// - alias: The alias to be used as the short URL, it should be validated with ValidateAlias.
+// - longURL: The long URL to be saved.
+// - expiresAt: The expiration time, zero for a URL that never expires.
+//
+// Returns:
+// - string: The saved alias, or the existing short URL if the long URL is already shortened in the dedup scope.
+// - error: ErrUniqueViolation if the long URL is already shortened, ErrAliasTaken if the alias is used by another URL.
+func (s *MapStorage) SaveAlias(ctx context.Context, userID uint64, alias string, longURL string, expiresAt time.Time) (string, error) {
+	if err := checkContext(ctx); err != nil {
+		return "", err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sURL, exist := s.lookup(userID, longURL); exist {
+		return sURL, ErrUniqueViolation
+	}
+	err := s.save(userID, alias, longURL, expiresAt)
+	if errors.Is(err, ErrUniqueViolation) {
+		return alias, ErrAliasTaken
+	}
+	if err != nil {
+		return "", err
+	}
+	return alias, nil
 }
 
 // IsShortURLExist checks if a short URL already exists in the MapStorage.
@@ -125,69 +262,86 @@ func (s *MapStorage) GetShortURL(userID uint64, longURL string) (string, error)
 // Returns:
 //
 //	bool - indicating if the short URL exists.
-func (s *MapStorage) IsShortURLExist(shortURL string) bool {
+func (s *MapStorage) IsShortURLExist(ctx context.Context, shortURL string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	_, exist := s.m[shortURL]
 	return exist
 }
 
 // IsRealURLExist checks if the given long URL exists in the MapStorage.
 //
-// It takes a longURL string as a parameter and returns a boolean.
-func (s *MapStorage) IsRealURLExist(longURL string) bool {
-	for _, lURL := range s.m {
-		if lURL.LongURL == longURL {
-			return true
-		}
-	}
-	return false
+// It takes the request context and a longURL string as parameters and returns a boolean.
+func (s *MapStorage) IsRealURLExist(ctx context.Context, longURL string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exist := s.long[longURL]
+	return exist
 }
 
 // IsReady checks if the MapStorage is ready.
 //
 // Returns a boolean value indicating if the MapStorage is ready.
-func (s *MapStorage) IsReady() bool {
+func (s *MapStorage) IsReady(ctx context.Context) bool {
 	return true
 }
 
+// Close closes the MapStorage.
+//
+// The memory storage has nothing to release, it always returns nil.
+func (s *MapStorage) Close() error {
+	return nil
+}
+
 // GetAllURLs retrieves all URLs for a given user and base address.
 //
 // Parameters:
+// - ctx: The request context.
 // - userID: The ID of the user.
 // - bAddr: The base address.
 //
 // Returns:
 // - []ResJSONURL: A slice of ResJSONURL structs containing the retrieved URLs.
 // - error: An error if any occurred during the retrieval process.
-func (s *MapStorage) GetAllURLs(userID uint64, bAddr string) ([]ResJSONURL, error) {
+func (s *MapStorage) GetAllURLs(ctx context.Context, userID uint64, bAddr string) ([]ResJSONURL, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var rwJSON []ResJSONURL
-	for sURL, lURL := range s.m {
-		if lURL.UserID == userID {
-			rwElemJSON := ResJSONURL{
-				URL:    lURL.LongURL,
-				Result: bAddr + "/" + sURL,
-			}
-			rwJSON = append(rwJSON, rwElemJSON)
+	for sURL := range s.users[userID] {
+		rwElemJSON := ResJSONURL{
+			URL:    s.m[sURL].LongURL,
+			Result: bAddr + "/" + sURL,
 		}
+		rwJSON = append(rwJSON, rwElemJSON)
 	}
 	return rwJSON, nil
 }
 
 // GetLastID returns the last ID from the MapStorage.
 //
-// It does not take any parameters.
+// It takes the request context.
 // It returns an integer and an error.
-func (s *MapStorage) GetLastID() (int, error) {
+func (s *MapStorage) GetLastID(ctx context.Context) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return len(s.m), nil
 }
 
 // DeleteURLs deletes multiple URLs for a given user.
 //
+// ctx: The request context.
 // userID: The ID of the user.
 // delURLs: A slice of strings containing the URLs to be deleted.
 // error: An error if any occurred during the deletion process.
-func (s *MapStorage) DeleteURLs(userID uint64, delURLs []string) error {
+func (s *MapStorage) DeleteURLs(ctx context.Context, userID uint64, delURLs []string) error {
 	for _, url := range delURLs {
-		err := s.DeleteURL(map[string]uint64{url: userID})
+		err := s.DeleteURL(ctx, map[string]uint64{url: userID})
 		if err != nil {
 			return err
 		}
@@ -197,12 +351,18 @@ func (s *MapStorage) DeleteURLs(userID uint64, delURLs []string) error {
 
 // DeleteURL deletes the specified URLs from the MapStorage.
 //
-// delURL: a map containing the URLs to be deleted along with their corresponding values.
+// ctx: the request context.
+// delURL: a map containing the URLs to be deleted along with the IDs of their users, URLs owned by other users are skipped.
 // error: an error, if any.
-func (s *MapStorage) DeleteURL(delURL map[string]uint64) error {
+func (s *MapStorage) DeleteURL(ctx context.Context, delURL map[string]uint64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for key, value := range delURL {
-		if value != 0 {
-			delete(s.m, key)
+		if uURL, exist := s.m[key]; exist && !uURL.Expired && uURL.UserID == value {
+			s.remove(key)
 		}
 	}
 
@@ -211,16 +371,181 @@ func (s *MapStorage) DeleteURL(delURL map[string]uint64) error {
 
 // GetStats calculates the URL and user statistics for the MapStorage.
 //
-// No parameters.
+// It takes the request context.
 // Returns ResJSONStats struct containing URLCount and UserCount, and an error.
-func (s *MapStorage) GetStats() (ResJSONStats, error) {
-	urls := len(s.m)
-	users := make(map[uint64]uint64)
-	for _, lURL := range s.m {
-		users[lURL.UserID]++
+func (s *MapStorage) GetStats(ctx context.Context) (ResJSONStats, error) {
+	if err := checkContext(ctx); err != nil {
+		return ResJSONStats{}, err
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return ResJSONStats{
-		URLCount:  urls,
-		UserCount: len(users),
+		URLCount:  len(s.m),
+		UserCount: len(s.users),
 	}, nil
 }
+
+// DeleteExpired deletes the URLs that are expired at now from the MapStorage.
+//
+// The URLs are only marked as expired and removed from the indexes, so their short URLs
+// keep answering ErrURLExpired and are not reused.
+//
+// Parameters:
+// - ctx: The request context.
+// - now: The time to compare expiration times with.
+//
+// Returns:
+// - int: The number of deleted URLs.
+// - error: An error if the context is done.
+func (s *MapStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for sURL, lURL := range s.m {
+		if !lURL.Expired && isExpired(lURL.ExpiresAt, now) {
+			s.unindex(sURL)
+			lURL.Expired = true
+			s.m[sURL] = lURL
+			count++
+		}
+	}
+	return count, nil
+}
+
+// SaveClicks saves the redirects of short URLs in the MapStorage.
+//
+// Parameters:
+// - ctx: The request context.
+// - clicks: The redirects to be saved.
+//
+// Returns:
+// - error: An error if the context is done.
+func (s *MapStorage) SaveClicks(ctx context.Context, clicks []Click) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, click := range clicks {
+		s.clicks[click.ShortURL] = append(s.clicks[click.ShortURL], click)
+	}
+	return nil
+}
+
+// GetURLStats retrieves the click stats of a short URL owned by the given user.
+//
+// Parameters:
+// - ctx: The request context.
+// - userID: The ID of the user.
+// - shortURL: The short URL.
+//
+// Returns:
+// - ResJSONURLStats: The total clicks, unique visitors and a per-day histogram.
+// - error: ErrURLNotFound if the short URL does not exist or is owned by another user.
+func (s *MapStorage) GetURLStats(ctx context.Context, userID uint64, shortURL string) (ResJSONURLStats, error) {
+	if err := checkContext(ctx); err != nil {
+		return ResJSONURLStats{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lURL, exist := s.m[shortURL]
+	if !exist || lURL.UserID != userID {
+		return ResJSONURLStats{}, ErrURLNotFound
+	}
+	return clickStats(shortURL, s.clicks[shortURL]), nil
+}
+
+// SaveAPIKey saves a new API key in the MapStorage.
+//
+// Parameters:
+// - ctx: The request context.
+// - key: The API key with the hash of the key.
+//
+// Returns:
+// - error: An error if the context is done.
+func (s *MapStorage) SaveAPIKey(ctx context.Context, key APIKey) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKeys[key.Hash] = key
+	return nil
+}
+
+// GetAPIKeys retrieves all API keys of the given user.
+//
+// Parameters:
+// - ctx: The request context.
+// - userID: The ID of the user.
+//
+// Returns:
+// - []APIKey: The API keys of the user sorted by creation time.
+// - error: An error if the context is done.
+func (s *MapStorage) GetAPIKeys(ctx context.Context, userID uint64) ([]APIKey, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []APIKey
+	for _, key := range s.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+// RevokeAPIKey deletes the API key with the given ID owned by the given user.
+//
+// Parameters:
+// - ctx: The request context.
+// - userID: The ID of the user.
+// - id: The ID of the API key.
+//
+// Returns:
+// - error: ErrAPIKeyNotFound if the key does not exist or is owned by another user.
+func (s *MapStorage) RevokeAPIKey(ctx context.Context, userID uint64, id string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, key := range s.apiKeys {
+		if key.ID == id && key.UserID == userID {
+			delete(s.apiKeys, hash)
+			return nil
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+// UseAPIKey resolves the API key hash to its user and sets the last use time of the key.
+//
+// Parameters:
+// - ctx: The request context.
+// - hash: The hash of the API key.
+// - now: The time of the use.
+//
+// Returns:
+// - uint64: The ID of the user owning the key.
+// - error: ErrAPIKeyNotFound if the key does not exist.
+func (s *MapStorage) UseAPIKey(ctx context.Context, hash string, now time.Time) (uint64, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, exist := s.apiKeys[hash]
+	if !exist {
+		return 0, ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = &now
+	s.apiKeys[hash] = key
+	return key.UserID, nil
+}
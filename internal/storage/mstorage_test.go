@@ -1,6 +1,14 @@
 package storage
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stsg/shorty/internal/config"
+)
 
 func TestGetAllURLs_EmptyList(t *testing.T) {
 	// Initialize MapStorage object
@@ -12,7 +20,7 @@ func TestGetAllURLs_EmptyList(t *testing.T) {
 	}
 
 	// Invoke GetAllURLs method
-	result, err := mStorage.GetAllURLs(123, "http://example.com")
+	result, err := mStorage.GetAllURLs(context.Background(), 123, "http://example.com")
 
 	// Check if the result is an empty list
 	if len(result) != 0 {
@@ -24,3 +32,256 @@ func TestGetAllURLs_EmptyList(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
+
+func TestGetShortURL_CanceledContext(t *testing.T) {
+	mStorage, _ := NewMapStorage()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A canceled request must not be saved
+	_, err := mStorage.GetShortURL(ctx, 1, "https://example.com", time.Time{})
+	if !errors.Is(err, ErrRequestCanceled) {
+		t.Errorf("Expected ErrRequestCanceled, but got %v", err)
+	}
+	if mStorage.IsRealURLExist(context.Background(), "https://example.com") {
+		t.Errorf("URL saved for a canceled request")
+	}
+}
+
+func TestGetRealURL_DeadlineExceeded(t *testing.T) {
+	mStorage, _ := NewMapStorage()
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err := mStorage.GetRealURL(ctx, "123456")
+	if !errors.Is(err, ErrDeadlineExceeded) {
+		t.Errorf("Expected ErrDeadlineExceeded, but got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded in the error chain, but got %v", err)
+	}
+}
+
+func TestSaveAlias(t *testing.T) {
+	ctx := context.Background()
+	mStorage, _ := NewMapStorage()
+	mStorage.dedup = config.DedupGlobal
+
+	shortURL, err := mStorage.SaveAlias(ctx, 1, "spring-sale", "https://example.com/spring", time.Time{})
+	if err != nil || shortURL != "spring-sale" {
+		t.Fatalf("Expected alias to be saved, but got %q, %v", shortURL, err)
+	}
+
+	longURL, err := mStorage.GetRealURL(ctx, "spring-sale")
+	if err != nil || longURL != "https://example.com/spring" {
+		t.Errorf("Expected alias to resolve, but got %q, %v", longURL, err)
+	}
+
+	// The same alias for another URL is taken
+	shortURL, err = mStorage.SaveAlias(ctx, 2, "spring-sale", "https://example.com/autumn", time.Time{})
+	if !errors.Is(err, ErrAliasTaken) || shortURL != "spring-sale" {
+		t.Errorf("Expected ErrAliasTaken, but got %q, %v", shortURL, err)
+	}
+
+	// The same URL under another alias returns the existing short URL
+	shortURL, err = mStorage.SaveAlias(ctx, 2, "other-sale", "https://example.com/spring", time.Time{})
+	if !errors.Is(err, ErrUniqueViolation) || shortURL != "spring-sale" {
+		t.Errorf("Expected ErrUniqueViolation, but got %q, %v", shortURL, err)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	mStorage, _ := NewMapStorage()
+	now := time.Now()
+
+	_ = mStorage.Save(ctx, 1, "expired", "https://example.com/expired", now.Add(-time.Minute))
+	_ = mStorage.Save(ctx, 1, "alive", "https://example.com/alive", now.Add(time.Hour))
+	_ = mStorage.Save(ctx, 1, "forever", "https://example.com/forever", time.Time{})
+
+	_, err := mStorage.GetRealURL(ctx, "expired")
+	if !errors.Is(err, ErrURLExpired) {
+		t.Errorf("Expected ErrURLExpired, but got %v", err)
+	}
+
+	count, err := mStorage.DeleteExpired(ctx, now)
+	if err != nil || count != 1 {
+		t.Errorf("Expected 1 deleted URL, but got %d, %v", count, err)
+	}
+	for _, shortURL := range []string{"alive", "forever"} {
+		if _, err := mStorage.GetRealURL(ctx, shortURL); err != nil {
+			t.Errorf("Expected %s to resolve, but got %v", shortURL, err)
+		}
+	}
+
+	// The deleted URL is still expired, its short URL is not reused and its long URL can be shortened again
+	if _, err := mStorage.GetRealURL(ctx, "expired"); !errors.Is(err, ErrURLExpired) {
+		t.Errorf("Expected ErrURLExpired after the deletion, but got %v", err)
+	}
+	if err := mStorage.Save(ctx, 2, "expired", "https://example.com/other", time.Time{}); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Expected ErrUniqueViolation for the expired short URL, but got %v", err)
+	}
+	shortURL, err := mStorage.GetShortURL(ctx, 1, "https://example.com/expired", time.Time{})
+	if err != nil || shortURL == "expired" {
+		t.Errorf("Expected a new short URL, but got %q, %v", shortURL, err)
+	}
+	if count, err := mStorage.DeleteExpired(ctx, now); err != nil || count != 0 {
+		t.Errorf("Expected no deleted URL on the second run, but got %d, %v", count, err)
+	}
+}
+
+func TestGetURLStats(t *testing.T) {
+	ctx := context.Background()
+	mStorage, _ := NewMapStorage()
+	day := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	_ = mStorage.Save(ctx, 1, "abcdef", "https://example.com", time.Time{})
+	err := mStorage.SaveClicks(ctx, []Click{
+		{ShortURL: "abcdef", Time: day, IPPrefix: "10.0.0.0/24", UserAgent: "curl"},
+		{ShortURL: "abcdef", Time: day.Add(time.Hour), IPPrefix: "10.0.0.0/24", UserAgent: "curl"},
+		{ShortURL: "abcdef", Time: day.Add(24 * time.Hour), IPPrefix: "10.0.1.0/24", UserAgent: "curl"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	stats, err := mStorage.GetURLStats(ctx, 1, "abcdef")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats.Clicks != 3 || stats.UniqueVisitors != 2 {
+		t.Errorf("Expected 3 clicks from 2 visitors, but got %d from %d", stats.Clicks, stats.UniqueVisitors)
+	}
+	want := []ResJSONDailyStats{{Date: "2024-03-01", Clicks: 2}, {Date: "2024-03-02", Clicks: 1}}
+	if len(stats.Daily) != len(want) || stats.Daily[0] != want[0] || stats.Daily[1] != want[1] {
+		t.Errorf("Expected %v, but got %v", want, stats.Daily)
+	}
+
+	// Stats of another user's URL are not available
+	_, err = mStorage.GetURLStats(ctx, 2, "abcdef")
+	if !errors.Is(err, ErrURLNotFound) {
+		t.Errorf("Expected ErrURLNotFound, but got %v", err)
+	}
+}
+
+func TestMapStorage_Indexes(t *testing.T) {
+	ctx := context.Background()
+	mStorage, _ := NewMapStorage()
+	mStorage.dedup = config.DedupGlobal
+
+	_ = mStorage.Save(ctx, 1, "abc", "https://example.com/abc", time.Time{})
+	_ = mStorage.Save(ctx, 2, "abd", "https://example.com/abd", time.Time{})
+
+	shortURL, err := mStorage.GetShortURL(ctx, 3, "https://example.com/abd", time.Time{})
+	if !errors.Is(err, ErrUniqueViolation) || shortURL != "abd" {
+		t.Errorf("Expected abd and ErrUniqueViolation, but got %s, %v", shortURL, err)
+	}
+
+	_ = mStorage.DeleteURL(ctx, map[string]uint64{"abd": 2})
+	if mStorage.IsRealURLExist(ctx, "https://example.com/abd") {
+		t.Errorf("Expected deleted long URL to be removed from the index")
+	}
+	urls, _ := mStorage.GetAllURLs(ctx, 2, "http://localhost")
+	if len(urls) != 0 {
+		t.Errorf("Expected no URLs of user 2, but got %v", urls)
+	}
+	stats, _ := mStorage.GetStats(ctx)
+	if stats.URLCount != 1 || stats.UserCount != 1 {
+		t.Errorf("Expected 1 URL of 1 user, but got %v", stats)
+	}
+}
+
+// BenchmarkMapStorage_GetShortURL benchmarks the lookup of an existing long URL by its owner.
+//
+// The time per operation does not depend on the number of entries.
+func BenchmarkMapStorage_GetShortURL(b *testing.B) {
+	for _, entries := range []int{1000, 1000000} {
+		b.Run(strconv.Itoa(entries), func(b *testing.B) {
+			ctx := context.Background()
+			mStorage, _ := NewMapStorage()
+			for i := 0; i < entries; i++ {
+				mStorage.add("code"+strconv.Itoa(i), UserURL{
+					LongURL: "https://example.com/" + strconv.Itoa(i),
+					UserID:  uint64(i % 1000),
+				})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = mStorage.GetShortURL(ctx, uint64(i%entries%1000), "https://example.com/"+strconv.Itoa(i%entries), time.Time{})
+			}
+		})
+	}
+}
+
+// BenchmarkMapStorage_GetAllURLs benchmarks the lookup of the URLs of a user.
+//
+// The time per operation depends on the number of URLs of the user only.
+func BenchmarkMapStorage_GetAllURLs(b *testing.B) {
+	for _, entries := range []int{1000, 1000000} {
+		b.Run(strconv.Itoa(entries), func(b *testing.B) {
+			ctx := context.Background()
+			mStorage, _ := NewMapStorage()
+			for i := 0; i < entries; i++ {
+				mStorage.add("code"+strconv.Itoa(i), UserURL{
+					LongURL: "https://example.com/" + strconv.Itoa(i),
+					UserID:  uint64(i),
+				})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = mStorage.GetAllURLs(ctx, uint64(i%entries), "http://localhost")
+			}
+		})
+	}
+}
+
+func TestMapStorage_APIKeys(t *testing.T) {
+	ctx := context.Background()
+	mStorage, _ := NewMapStorage()
+
+	now := time.Now().UTC()
+	_ = mStorage.SaveAPIKey(ctx, APIKey{ID: "key1", UserID: 1, Hash: "hash1", CreatedAt: now})
+	_ = mStorage.SaveAPIKey(ctx, APIKey{ID: "key2", UserID: 1, Hash: "hash2", CreatedAt: now.Add(time.Second)})
+	_ = mStorage.SaveAPIKey(ctx, APIKey{ID: "key3", UserID: 2, Hash: "hash3", CreatedAt: now})
+
+	userID, err := mStorage.UseAPIKey(ctx, "hash2", now)
+	if err != nil || userID != 1 {
+		t.Errorf("Expected user 1, but got %d, %v", userID, err)
+	}
+	if _, err := mStorage.UseAPIKey(ctx, "unknown", now); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound, but got %v", err)
+	}
+
+	keys, _ := mStorage.GetAPIKeys(ctx, 1)
+	if len(keys) != 2 || keys[0].ID != "key1" || keys[0].LastUsedAt != nil || keys[1].LastUsedAt == nil {
+		t.Errorf("Expected key1 unused and key2 used, but got %v", keys)
+	}
+
+	// Another user cannot revoke the key
+	if err := mStorage.RevokeAPIKey(ctx, 2, "key1"); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound, but got %v", err)
+	}
+	if err := mStorage.RevokeAPIKey(ctx, 1, "key1"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := mStorage.UseAPIKey(ctx, "hash1", now); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound for a revoked key, but got %v", err)
+	}
+}
+
+func TestMapStorage_DedupScope(t *testing.T) {
+	for _, scope := range dedupScopes {
+		t.Run(scope, func(t *testing.T) {
+			mStorage, _ := NewMapStorage()
+			mStorage.dedup = scope
+			checkDedupScope(t, mStorage, scope)
+		})
+	}
+}
+
+func TestMapStorage_GetShortURLBatch(t *testing.T) {
+	mStorage, _ := NewMapStorage()
+	checkGetShortURLBatch(t, mStorage)
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hammer runs Save, GetShortURL, GetRealURL, GetAllURLs and DeleteURL in parallel,
+// it is meant to be run with the race detector.
+func hammer(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			userID := uint64(worker + 1)
+			for i := 0; i < 50; i++ {
+				id := strconv.Itoa(worker) + "-" + strconv.Itoa(i)
+				_ = s.Save(ctx, userID, "save"+id, "https://example.com/save/"+id, time.Time{})
+				shortURL, err := s.GetShortURL(ctx, userID, "https://example.com/"+id, time.Time{})
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				// All workers race for the same long URL
+				_, _ = s.GetShortURL(ctx, userID, "https://example.com/shared", time.Time{})
+				_, _ = s.GetRealURL(ctx, shortURL)
+				_, _ = s.GetAllURLs(ctx, userID, "http://localhost")
+				_, _ = s.GetStats(ctx)
+				_ = s.DeleteURL(ctx, map[string]uint64{"save" + id: userID})
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if !s.IsRealURLExist(ctx, "https://example.com/shared") {
+		t.Errorf("Expected the shared long URL to be saved")
+	}
+	urls, err := s.GetAllURLs(ctx, 1, "http://localhost")
+	if err != nil || len(urls) < 50 {
+		t.Errorf("Expected at least 50 URLs of user 1, but got %d, %v", len(urls), err)
+	}
+}
+
+func TestMapStorage_Concurrent(t *testing.T) {
+	mStorage, _ := NewMapStorage()
+	hammer(t, mStorage)
+}
+
+func TestFileStorage_Concurrent(t *testing.T) {
+	fStorage, err := openFileStorage(filepath.Join(t.TempDir(), "shorty.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hammer(t, fStorage)
+}
+
+func TestBoltStorage_Concurrent(t *testing.T) {
+	bStorage, err := openBoltStorage(filepath.Join(t.TempDir(), "shorty.db"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer bStorage.Close()
+	hammer(t, bStorage)
+}
@@ -1,15 +1,25 @@
 package storage
 
 import (
+	"context"
 	"errors"
-	"math/rand"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
 
 	"github.com/stsg/shorty/internal/config"
 )
 
 // ReqJSON request JSON for serializing/deserializng URL
 type ReqJSON struct {
-	URL string `json:"url,omitempty"`
+	URL       string     `json:"url,omitempty"`
+	Alias     string     `json:"alias,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
 }
 
 // ResJSON result JSON for serializing/deserializng URL
@@ -19,14 +29,31 @@ type ResJSON struct {
 
 // ReqJSONBatch request JSON for serializing/deserializng URLs batch
 type ReqJSONBatch struct {
-	ID  string `json:"correlation_id"`
-	URL string `json:"original_url,omitempty"`
+	ID        string     `json:"correlation_id"`
+	URL       string     `json:"original_url,omitempty"`
+	Alias     string     `json:"alias,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
 }
 
 // ResJSONBatch result JSON for serializing/deserializng URLs batch
 type ResJSONBatch struct {
 	ID     string `json:"correlation_id"`
 	Result string `json:"short_url,omitempty"`
+	// Err is the error of the item, Result holds its message then
+	Err error `json:"-"`
+	// Existing is the existing short URL of an item failed with ErrUniqueViolation or ErrAliasTaken
+	Existing string `json:"-"`
+}
+
+// fail sets the error of the batch item.
+// The short URL in Result is kept in Existing if the item conflicts with an existing short URL.
+func (r *ResJSONBatch) fail(err error) {
+	if errors.Is(err, ErrUniqueViolation) || errors.Is(err, ErrAliasTaken) {
+		r.Existing = r.Result
+	}
+	r.Result = err.Error()
+	r.Err = err
 }
 
 // ResJSONURL result JSON for serializing/deserializng URLs list
@@ -39,55 +66,327 @@ type ResJSONURL struct {
 type ResJSONStats struct {
 	URLCount  int `json:"urls,omitempty"`
 	UserCount int `json:"users,omitempty"`
+	// PendingDeletions is filled by the App, it is the number of the queued deletions not saved yet.
+	PendingDeletions int `json:"pending_deletions,omitempty"`
+}
+
+// ResJSONURLStats result JSON for serializing/deserializng click stats of a short URL
+type ResJSONURLStats struct {
+	ShortURL       string              `json:"short_url"`
+	Clicks         int                 `json:"clicks"`
+	UniqueVisitors int                 `json:"unique_visitors"`
+	Daily          []ResJSONDailyStats `json:"daily"`
+}
+
+// ResJSONDailyStats result JSON for serializing/deserializng clicks of a single day
+type ResJSONDailyStats struct {
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+// Click holds a single redirect of a short URL.
+//
+// IPPrefix is the network of the visitor (/24 for IPv4, /48 for IPv6), the full address is never stored.
+type Click struct {
+	ShortURL  string    `json:"short_url"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IPPrefix  string    `json:"ip_prefix,omitempty"`
+}
+
+// APIKey holds an API key of a user.
+//
+// Only the SHA-256 hash of the key is stored, the key itself is shown to the user once when it is created.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     uint64     `json:"user_id"`
+	Hash       string     `json:"hash"`
+	Name       string     `json:"name,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// ReqJSONAPIKey request JSON for creating an API key
+type ReqJSONAPIKey struct {
+	Name string `json:"name,omitempty"`
+}
+
+// ResJSONAPIKey result JSON for serializing/deserializng an API key, Key is only set when the key is created
+type ResJSONAPIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Key        string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// ownerKey is the key of the long URL of a user in the per-user indexes of the storages.
+type ownerKey struct {
+	userID  uint64
+	longURL string
+}
+
+// clickDateLayout is the layout of the dates in the daily click histogram.
+const clickDateLayout = "2006-01-02"
+
+// AliasMinLength is the minimal length of a user-chosen alias.
+const AliasMinLength = 3
+
+// AliasMaxLength is the maximal length of a user-chosen alias.
+const AliasMaxLength = 64
+
+// aliasCharset is the set of characters allowed in a user-chosen alias.
+const aliasCharset = "1234567890ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-_"
+
+// reservedAliases holds the aliases that clash with the application routes.
+var reservedAliases = []string{
+	"ping",
+	"api",
+	"debug",
+	"v2",
 }
 
-// ShortURLLength is the length of the short URL.
-var ShortURLLength = 6
+// ErrURLNotFound is an error that is returned when a short URL does not exist.
+var ErrURLNotFound = errors.New("short URL not exist")
 
 // ErrUniqueViolation is an error that is returned when a short URL already exist.
 var ErrUniqueViolation = errors.New("short URL already exist")
 
-// Storage class definition represents a storage interface in Go. Here's a list explaining what each method does:
-//
-// Save(userID uint64, shortURL string, longURL string) error: Saves a short URL and its corresponding long URL for a specific user.
-// GetRealURL(shortURL string) (string, error): Retrieves the real (long) URL associated with a given short URL.
-// GetShortURL(userID uint64, longURL string) (string, error): Retrieves the short URL associated with a given long URL for a specific user.
-// GetShortURLBatch(userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error): Retrieves short URLs in batch for a specific user.
-// GetAllURLs(userID uint64, bAddr string) ([]ResJSONURL, error): Retrieves all URLs for a specific user.
-// IsRealURLExist(longURL string) bool: Checks if a real (long) URL exists in the storage.
-// IsShortURLExist(longURL string) bool: Checks if a short URL exists in the storage.
-// IsReady() bool: Checks if the storage is ready.
-// GetLastID() (int, error): Retrieves the last ID used.
+// ErrAliasTaken is an error that is returned when a user-chosen alias is already used by another URL.
+var ErrAliasTaken = errors.New("alias already taken")
+
+// ErrAliasInvalid is an error that is returned when an alias has a wrong length or characters.
+var ErrAliasInvalid = errors.New("alias is invalid")
+
+// ErrAliasReserved is an error that is returned when an alias is one of the reserved words.
+var ErrAliasReserved = errors.New("alias is reserved")
+
+// ErrURLExpired is an error that is returned when a URL is past its expiration time.
+var ErrURLExpired = errors.New("URL expired")
+
+// ErrExpirationInvalid is an error that is returned when a requested expiration can not be applied.
+var ErrExpirationInvalid = errors.New("expiration is invalid")
+
+// ErrAPIKeyNotFound is an error that is returned when an API key does not exist or is owned by another user.
+var ErrAPIKeyNotFound = errors.New("API key not exist")
+
+// ErrRequestCanceled is an error that is returned when the caller canceled a storage request.
+var ErrRequestCanceled = errors.New("storage request canceled")
+
+// ErrDeadlineExceeded is an error that is returned when a storage request did not finish before its deadline.
+var ErrDeadlineExceeded = errors.New("storage request deadline exceeded")
+
+// ErrStorageClosed is an error that is returned when a storage is used after it is closed.
+var ErrStorageClosed = errors.New("storage closed")
+
+// sqlDBClosed is the message of the error database/sql returns for a closed database, the error is not exported.
+const sqlDBClosed = "sql: database is closed"
+
+// Storage class definition represents a storage interface in Go. Every method takes
+// a context.Context as the first parameter and stops as soon as the context is done,
+// returning ErrRequestCanceled or ErrDeadlineExceeded. Here's a list explaining what each method does:
+//
+// Save(ctx, userID uint64, shortURL string, longURL string, expiresAt time.Time) error: Saves a short URL and its corresponding long URL for a specific user.
+// GetRealURL(ctx, shortURL string) (string, error): Retrieves the real (long) URL associated with a given short URL.
+// GetShortURL(ctx, userID uint64, longURL string, expiresAt time.Time) (string, error): Retrieves the short URL associated with a given long URL for a specific user,
+// the existing short URL is looked up in the dedup scope of the storage (see config.GetDedupScope).
+// SaveAlias(ctx, userID uint64, alias string, longURL string, expiresAt time.Time) (string, error): Saves a long URL under a user-chosen alias.
+// GetShortURLBatch(ctx, userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error): Retrieves short URLs in batch for a specific user.
+// GetAllURLs(ctx, userID uint64, bAddr string) ([]ResJSONURL, error): Retrieves all URLs owned by a specific user, the deleted ones are skipped.
+// IsRealURLExist(ctx, longURL string) bool: Checks if a real (long) URL exists in the storage.
+// IsShortURLExist(ctx, longURL string) bool: Checks if a short URL exists in the storage.
+// IsReady(ctx) bool: Checks if the storage is ready.
+// GetLastID(ctx) (int, error): Retrieves the last ID used.
+// DeleteExpired(ctx, now time.Time) (int, error): Soft-deletes URLs expired by now and returns their number.
+// SaveClicks(ctx, clicks []Click) error: Saves the redirects of short URLs.
+// GetURLStats(ctx, userID uint64, shortURL string) (ResJSONURLStats, error): Retrieves click stats of a short URL owned by a specific user.
+// SaveAPIKey(ctx, key APIKey) error: Saves a new API key.
+// GetAPIKeys(ctx, userID uint64) ([]APIKey, error): Retrieves all API keys of a specific user.
+// RevokeAPIKey(ctx, userID uint64, id string) error: Deletes an API key owned by a specific user.
+// UseAPIKey(ctx, hash string, now time.Time) (uint64, error): Resolves an API key hash to its user and records the use.
+// Close() error: Releases the storage resources, e.g. the database pool or the file, it is called once on shutdown.
+//
+// A zero expiresAt means the URL never expires.
 type Storage interface {
-	Save(userID uint64, shortURL string, longURL string) error
-	GetRealURL(shortURL string) (string, error)
-	GetShortURL(userID uint64, longURL string) (string, error)
-	GetShortURLBatch(userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error)
-	GetAllURLs(userID uint64, bAddr string) ([]ResJSONURL, error)
-	IsRealURLExist(longURL string) bool
-	IsShortURLExist(longURL string) bool
-	IsReady() bool
-	GetLastID() (int, error)
-	DeleteURLs(userID uint64, delURLs []string) error
-	DeleteURL(delURL map[string]uint64) error
-	GetStats() (ResJSONStats, error)
+	Save(ctx context.Context, userID uint64, shortURL string, longURL string, expiresAt time.Time) error
+	GetRealURL(ctx context.Context, shortURL string) (string, error)
+	GetShortURL(ctx context.Context, userID uint64, longURL string, expiresAt time.Time) (string, error)
+	SaveAlias(ctx context.Context, userID uint64, alias string, longURL string, expiresAt time.Time) (string, error)
+	GetShortURLBatch(ctx context.Context, userID uint64, bAddr string, longURLs []ReqJSONBatch) ([]ResJSONBatch, error)
+	GetAllURLs(ctx context.Context, userID uint64, bAddr string) ([]ResJSONURL, error)
+	IsRealURLExist(ctx context.Context, longURL string) bool
+	IsShortURLExist(ctx context.Context, longURL string) bool
+	IsReady(ctx context.Context) bool
+	GetLastID(ctx context.Context) (int, error)
+	DeleteURLs(ctx context.Context, userID uint64, delURLs []string) error
+	DeleteURL(ctx context.Context, delURL map[string]uint64) error
+	GetStats(ctx context.Context) (ResJSONStats, error)
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+	SaveClicks(ctx context.Context, clicks []Click) error
+	GetURLStats(ctx context.Context, userID uint64, shortURL string) (ResJSONURLStats, error)
+	SaveAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKeys(ctx context.Context, userID uint64) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID uint64, id string) error
+	UseAPIKey(ctx context.Context, hash string, now time.Time) (uint64, error)
+	Close() error
 }
 
-// GenShortURL generates a random short URL of length ShortURLLength using the characters from the charset.
+// sortAPIKeys sorts the API keys by creation time.
+func sortAPIKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+}
+
+// checkContext returns a typed storage error if the context is already done.
 //
-// It returns the generated short URL as a string.
-func GenShortURL() string {
-	charset := "1234567890ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+// It returns nil while the context is still alive.
+func checkContext(ctx context.Context) error {
+	return contextError(ctx, ctx.Err())
+}
 
-	if ShortURLLength < 1 {
-		return ""
+// contextError converts an error caused by a done context into ErrRequestCanceled or ErrDeadlineExceeded.
+//
+// Drivers do not always return context.Canceled as is, so the context itself is inspected
+// as well. The original error is kept in the chain. Any other error is returned unchanged.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	cause := ctx.Err()
+	if cause == nil {
+		cause = err
+	}
+	switch {
+	case errors.Is(cause, context.Canceled):
+		return fmt.Errorf("%w: %w", ErrRequestCanceled, err)
+	case errors.Is(cause, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrDeadlineExceeded, err)
 	}
+	return err
+}
+
+// closedError converts an error of a closed storage into ErrStorageClosed, the original error is kept in the chain.
+// Any other error is returned unchanged.
+func closedError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, bolt.ErrDatabaseNotOpen) || err.Error() == sqlDBClosed {
+		return fmt.Errorf("%w: %w", ErrStorageClosed, err)
+	}
+	return err
+}
+
+// ValidateAlias checks that a user-chosen alias can be used as a short URL.
+//
+// Parameters:
+// - alias: the alias to check.
+//
+// Returns:
+// - error: ErrAliasInvalid if the length or charset is wrong, ErrAliasReserved if the alias is a reserved word.
+func ValidateAlias(alias string) error {
+	if len(alias) < AliasMinLength || len(alias) > AliasMaxLength {
+		return fmt.Errorf("%w: length should be from %d to %d", ErrAliasInvalid, AliasMinLength, AliasMaxLength)
+	}
+	for _, c := range alias {
+		if !strings.ContainsRune(aliasCharset, c) {
+			return fmt.Errorf("%w: character %q is not allowed", ErrAliasInvalid, c)
+		}
+	}
+	for _, reserved := range reservedAliases {
+		if strings.EqualFold(alias, reserved) {
+			return fmt.Errorf("%w: %s", ErrAliasReserved, alias)
+		}
+	}
+	return nil
+}
 
-	shortURL := make([]byte, ShortURLLength)
-	for i := range shortURL {
-		shortURL[i] = charset[rand.Intn(len(charset))]
+// ExpirationTime calculates the expiration time of a URL from the requested absolute expiry or TTL.
+//
+// Parameters:
+// - expiresAt: the absolute expiration time, nil if not requested.
+// - ttl: the time to live in seconds, 0 if not requested.
+// - now: the current time.
+//
+// Returns:
+// - time.Time: the expiration time, zero if the URL never expires.
+// - error: ErrExpirationInvalid if both are requested, ttl is negative or expiresAt is in the past.
+func ExpirationTime(expiresAt *time.Time, ttl int64, now time.Time) (time.Time, error) {
+	if expiresAt != nil && ttl != 0 {
+		return time.Time{}, fmt.Errorf("%w: expires_at and ttl are mutually exclusive", ErrExpirationInvalid)
+	}
+	if ttl < 0 {
+		return time.Time{}, fmt.Errorf("%w: ttl should be positive", ErrExpirationInvalid)
 	}
-	return string(shortURL)
+	if ttl > 0 {
+		return now.Add(time.Duration(ttl) * time.Second), nil
+	}
+	if expiresAt != nil {
+		if !expiresAt.After(now) {
+			return time.Time{}, fmt.Errorf("%w: expires_at is in the past", ErrExpirationInvalid)
+		}
+		return *expiresAt, nil
+	}
+	return time.Time{}, nil
+}
+
+// isExpired reports whether a URL with the expiration time is expired at now.
+//
+// A zero expiresAt never expires.
+func isExpired(expiresAt time.Time, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// clickStats aggregates the clicks of a short URL into total clicks, unique visitors and a per-day histogram.
+//
+// A visitor is identified by the IP prefix and the user agent. Days are in UTC and sorted in ascending order.
+func clickStats(shortURL string, clicks []Click) ResJSONURLStats {
+	stats := ResJSONURLStats{
+		ShortURL: shortURL,
+		Daily:    []ResJSONDailyStats{},
+	}
+	visitors := make(map[string]struct{})
+	days := make(map[string]int)
+	for _, click := range clicks {
+		stats.Clicks++
+		visitors[click.IPPrefix+" "+click.UserAgent] = struct{}{}
+		days[click.Time.UTC().Format(clickDateLayout)]++
+	}
+	stats.UniqueVisitors = len(visitors)
+	for day, count := range days {
+		stats.Daily = append(stats.Daily, ResJSONDailyStats{Date: day, Clicks: count})
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
+	return stats
+}
+
+// getShortURL shortens a long URL for a batch item.
+//
+// The alias is validated and saved with SaveAlias when it is set,
+// otherwise a random short URL is generated by GetShortURL.
+func getShortURL(ctx context.Context, s Storage, userID uint64, item ReqJSONBatch) (string, error) {
+	expiresAt, err := ExpirationTime(item.ExpiresAt, item.TTL, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if item.Alias == "" {
+		return s.GetShortURL(ctx, userID, item.URL, expiresAt)
+	}
+	if err := ValidateAlias(item.Alias); err != nil {
+		return "", err
+	}
+	return s.SaveAlias(ctx, userID, item.Alias, item.URL, expiresAt)
+}
+
+// isItemError reports whether err is an error of a single batch item that does not fail the whole batch.
+func isItemError(err error) bool {
+	return errors.Is(err, ErrUniqueViolation) || errors.Is(err, ErrAliasTaken) ||
+		errors.Is(err, ErrAliasInvalid) || errors.Is(err, ErrAliasReserved) ||
+		errors.Is(err, ErrExpirationInvalid)
 }
 
 // New initializes and returns a Storage based on the provided configuration.
@@ -117,6 +416,20 @@ func New(conf config.Config) (Storage, error) {
 		return storage, nil
 	}
 
+	if conf.GetStorageType() == "bolt" {
+		storage, err := NewBoltStorage(conf)
+		if err != nil {
+			return nil, errors.New("cannot create bolt storage")
+		}
+		return storage, nil
+	}
+
 	storage, _ := NewMapStorage()
+	storage.dedup = conf.GetDedupScope()
+	gen, err := newConfigCodeGenerator(conf, func() (int, error) { return 0, nil })
+	if err != nil {
+		return nil, err
+	}
+	storage.gen = gen
 	return storage, nil
 }
@@ -1,42 +1,161 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stsg/shorty/internal/config"
 )
 
-// BenchmarkGenShortURL benchmarks the GenShortURL function.
-//
-// Parameter b is a testing.B type.
-// No return value.
-func BenchmarkGenShortURL(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		GenShortURL()
+func TestValidateAlias(t *testing.T) {
+	tests := []struct {
+		name  string
+		alias string
+		want  error
+	}{
+		{name: "valid", alias: "spring-sale", want: nil},
+		{name: "valid underscore", alias: "Spring_2024", want: nil},
+		{name: "too short", alias: "ab", want: ErrAliasInvalid},
+		{name: "too long", alias: strings.Repeat("a", AliasMaxLength+1), want: ErrAliasInvalid},
+		{name: "bad charset", alias: "spring/sale", want: ErrAliasInvalid},
+		{name: "non ascii", alias: "распродажа", want: ErrAliasInvalid},
+		{name: "reserved", alias: "ping", want: ErrAliasReserved},
+		{name: "reserved case insensitive", alias: "API", want: ErrAliasReserved},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateAlias(test.alias)
+			if !errors.Is(err, test.want) {
+				t.Errorf("Expected %v, but got %v", test.want, err)
+			}
+		})
 	}
 }
 
-func TestGenShortURLWithValidLength(t *testing.T) {
-	// Set the ShortURLLength to a valid value
-	ShortURLLength = 6
+func TestExpirationTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	future := now.Add(time.Hour)
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		ttl       int64
+		want      time.Time
+		wantErr   error
+	}{
+		{name: "never", want: time.Time{}},
+		{name: "ttl", ttl: 60, want: now.Add(time.Minute)},
+		{name: "expires at", expiresAt: &future, want: future},
+		{name: "both", expiresAt: &future, ttl: 60, wantErr: ErrExpirationInvalid},
+		{name: "negative ttl", ttl: -1, wantErr: ErrExpirationInvalid},
+		{name: "past", expiresAt: &past, wantErr: ErrExpirationInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ExpirationTime(test.expiresAt, test.ttl, now)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Expected %v, but got %v", test.wantErr, err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Expected %v, but got %v", test.want, got)
+			}
+		})
+	}
+}
 
-	// Call the GenShortURL function
-	result := GenShortURL()
+// checkGetShortURLBatch checks the per-item results of a batch against an empty storage.
+func checkGetShortURLBatch(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+
+	_, _ = s.SaveAlias(ctx, 1, "taken", "https://example.com/taken", time.Time{})
+	res, err := s.GetShortURLBatch(ctx, 1, "http://localhost", []ReqJSONBatch{
+		{ID: "1", URL: "https://example.com/1"},
+		{ID: "2", URL: "https://example.com/1"},
+		{ID: "3", URL: "https://example.com/3", Alias: "taken"},
+		{ID: "4", URL: "https://example.com/4", Alias: "batch-alias"},
+		{ID: "5", URL: "https://example.com/5", Alias: "a b"},
+	})
+	if err != nil || len(res) != 5 {
+		t.Fatalf("Expected 5 results, but got %v, %v", res, err)
+	}
+	if res[0].Err != nil || !errors.Is(res[1].Err, ErrUniqueViolation) {
+		t.Errorf("Expected a duplicate in the batch to violate uniqueness, but got %v", res)
+	}
+	if !errors.Is(res[2].Err, ErrAliasTaken) || res[3].Err != nil || !errors.Is(res[4].Err, ErrAliasInvalid) {
+		t.Errorf("Expected alias errors of the items, but got %v", res)
+	}
+	if res[3].Result != "http://localhost/batch-alias" {
+		t.Errorf("Expected http://localhost/batch-alias, but got %s", res[3].Result)
+	}
 
-	// Assert that the length of the generated short URL is equal to the specified ShortURLLength
-	if len(result) != ShortURLLength {
-		t.Errorf("Expected length of generated short URL to be %d, but got %d", ShortURLLength, len(result))
+	longURL, err := s.GetRealURL(ctx, strings.TrimPrefix(res[0].Result, "http://localhost/"))
+	if err != nil || longURL != "https://example.com/1" {
+		t.Errorf("Expected the batch URL to resolve, but got %q, %v", longURL, err)
 	}
 }
 
-// ShortURLLength is 0.
-func TestGenShortURLWithZeroLength(t *testing.T) {
-	// Set the ShortURLLength to 0
-	ShortURLLength = 0
+// dedupScopes are the dedup scopes the storages are checked in.
+var dedupScopes = []string{config.DedupGlobal, config.DedupUser, config.DedupNone}
 
-	// Call the GenShortURL function
-	result := GenShortURL()
+// checkDedupScope checks the short URLs of a long URL shortened by two users in the dedup scope of an empty storage.
+func checkDedupScope(t *testing.T, s Storage, scope string) {
+	t.Helper()
+	ctx := context.Background()
+	const longURL = "https://example.com/dedup"
 
-	// Assert that the length of the generated short URL is 0
-	if len(result) != ShortURLLength {
-		t.Errorf("Expected length of generated short URL to be %d, but got %d", ShortURLLength, len(result))
+	first, err := s.GetShortURL(ctx, 1, longURL, time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The same user gets the existing short URL unless the long URLs are not deduplicated
+	again, err := s.GetShortURL(ctx, 1, longURL, time.Time{})
+	if scope == config.DedupNone {
+		if err != nil || again == first {
+			t.Errorf("Expected a new short URL, but got %s, %v", again, err)
+		}
+	} else if !errors.Is(err, ErrUniqueViolation) || again != first {
+		t.Errorf("Expected %s and ErrUniqueViolation, but got %s, %v", first, again, err)
+	}
+
+	// Another user gets a short URL of its own unless the long URLs are deduplicated globally
+	other, err := s.GetShortURL(ctx, 2, longURL, time.Time{})
+	wantOwned := 1
+	if scope == config.DedupGlobal {
+		wantOwned = 0
+		if !errors.Is(err, ErrUniqueViolation) || other != first {
+			t.Errorf("Expected %s and ErrUniqueViolation, but got %s, %v", first, other, err)
+		}
+	} else if err != nil || other == first {
+		t.Errorf("Expected a new short URL, but got %s, %v", other, err)
+	}
+	urls, err := s.GetAllURLs(ctx, 2, "http://localhost")
+	if err != nil || len(urls) != wantOwned {
+		t.Errorf("Expected %d URLs of user 2, but got %v, %v", wantOwned, urls, err)
+	}
+
+	// A deleted short URL is not listed and its long URL is shortened again
+	if err := s.DeleteURLs(ctx, 1, []string{first}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	urls, err = s.GetAllURLs(ctx, 1, "http://localhost")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, url := range urls {
+		if url.Result == "http://localhost/"+first {
+			t.Errorf("Expected the deleted URL not to be listed, but got %v", urls)
+		}
+	}
+	if scope == config.DedupUser {
+		renewed, err := s.GetShortURL(ctx, 1, longURL, time.Time{})
+		if err != nil || renewed == first {
+			t.Errorf("Expected a new short URL, but got %s, %v", renewed, err)
+		}
 	}
 }